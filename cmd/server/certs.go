@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/newrelic/k8s-webhook/src/k8s"
+)
+
+// runCerts implements the certs subcommand, which issues the serving certificate of the webhook, writes it to the TLS
+// secret and patches the caBundle of the MutatingWebhookConfiguration and of the ValidatingWebhookConfiguration.
+func runCerts(args []string) error {
+	var opts k8s.CertBootstrapOptions
+
+	fs := flag.NewFlagSet("certs", flag.ContinueOnError)
+	fs.StringVar(&opts.ServiceName, "service", "newrelic-webhook-svc", "Name of the webhook service.")
+	fs.StringVar(&opts.Namespace, "namespace", metav1.NamespaceDefault, "Namespace of the webhook service and secret.")
+	fs.StringVar(&opts.SecretName, "secret", "newrelic-webhook-secret", "Name of the TLS secret.")
+	fs.StringVar(&opts.WebhookConfigName, "webhook", "newrelic-webhook-cfg", "Name of the MutatingWebhookConfiguration.")
+	fs.StringVar(&opts.ValidatingWebhookConfigName, "validating-webhook", "newrelic-webhook-validation-cfg",
+		"Name of the ValidatingWebhookConfiguration, patched only if it exists. Empty to skip it.")
+	fs.BoolVar(&opts.SelfSigned, "self-signed", true, "Sign the certificate with a CA generated by the webhook. Set to false to request it through a CSR.")
+	fs.StringVar(&opts.SignerName, "signer", k8s.KubeletServingSignerName, "Signer name of the CSR, with -self-signed=false.")
+	fs.DurationVar(&opts.Timeout, "timeout", 2*time.Minute, "How long to wait for the CSR to be signed and for the webhook configuration to exist.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	k8sClient, err := k8s.New()
+	if err != nil {
+		return err
+	}
+	return k8sClient.CertBootstrapper(opts).Run(context.Background())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net/http"
@@ -36,10 +37,42 @@ type envVarSpec struct {
 	TLSKeyFile       string        `default:"/etc/tls-key-cert-pair/tls.key" envconfig:"tls_key_file"`  // File containing the x509 private key for TLSCERTFILE.
 	ClusterName      string        `default:"cluster" split_words:"true"`                               // The name of the Kubernetes cluster.
 	Timeout          time.Duration // server timeout. Defaults to the timeout passed by K8s API via query param. If not present, to the defaultTimeout const value.
-	IgnoreNamespaces []string      `split_words:"true"` // The Webhook will ignore these namespaces.
+	IgnoreNamespaces []string      `split_words:"true"`                // The Webhook will ignore these namespaces.
+	ConfigMapCache   bool          `default:"true" split_words:"true"` // Serve config maps from a local cache instead of querying the K8s api on each admission.
+	ConfigMapResync  time.Duration `default:"10m" split_words:"true"`  // Resync period of the config map and owner caches.
+	ResolveOwners    bool          `default:"true" split_words:"true"` // Look up the Deployment and CronJob owning the pods instead of guessing them from the pod name.
+	ConfigFile       string        `split_words:"true"`                // Optional YAML configuration file, reloaded whenever it changes.
+
+	SelfManagedCerts      bool          `default:"false" split_words:"true"`                           // Issue and rotate the serving certificate with a CA stored in a secret.
+	CertRotateBefore      time.Duration `default:"720h" split_words:"true"`                            // Rotate (or warn about) the serving certificate when it expires within this period.
+	CertCheckInterval     time.Duration `default:"1h" split_words:"true"`                              // How often the expiry of the serving certificate is checked.
+	CertService           string        `default:"newrelic-webhook-svc" split_words:"true"`            // Service of the webhook, used as DNS name of the self-managed certificate.
+	CertNamespace         string        `default:"default" split_words:"true"`                         // Namespace of the webhook service and TLS secret.
+	CertSecret            string        `default:"newrelic-webhook-secret" split_words:"true"`         // TLS secret where the self-managed certificate is written.
+	CertWebhook           string        `default:"newrelic-webhook-cfg" split_words:"true"`            // MutatingWebhookConfiguration whose caBundle is kept in sync.
+	CertValidatingWebhook string        `default:"newrelic-webhook-validation-cfg" split_words:"true"` // ValidatingWebhookConfiguration whose caBundle is kept in sync, if it exists.
+
+	ShutdownGracePeriod time.Duration `default:"10s" split_words:"true"` // Time requests keep being served after SIGTERM, while the readiness probe fails.
+	ShutdownTimeout     time.Duration `default:"15s" split_words:"true"` // Time the ongoing requests are waited for once the grace period is over.
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "webhook-config":
+			err = runWebhookConfig(os.Args[2:], os.Stdout)
+		case "certs":
+			err = runCerts(os.Args[2:])
+		default:
+			log.Fatalf("unknown subcommand '%s'", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		return
+	}
+
 	var s envVarSpec
 	s.IgnoreNamespaces = []string{
 		metav1.NamespaceSystem,
@@ -54,20 +87,35 @@ func main() {
 	logger := setupLogger()
 	defer func() { _ = logger.Sync() }()
 
-	pair, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
-	if err != nil {
-		logger.Errorw("failed to load key pair", "err", err)
-	}
-
 	watcher, _ := fsnotify.NewWatcher()
 	defer func() { _ = watcher.Close() }()
 	// Watch the parent directory of the key/cert files so we can catch
 	// symlink updates of k8s secrets volumes and reload the certificates whenever they change.
-	watchDir, _ := filepath.Split(s.TLSCertFile)
+	watchDir := filepath.Dir(s.TLSCertFile)
 	if err := watcher.Add(watchDir); err != nil {
 		logger.Errorw("could not watch folder", "folder", watchDir, "err", err)
 	}
 
+	// The settings coming from env vars are the defaults for the ones missing in the configuration file.
+	defaultCfg := server.DefaultConfig()
+	defaultCfg.ClusterName = s.ClusterName
+	defaultCfg.IgnoreNamespaces = s.IgnoreNamespaces
+	cfg := defaultCfg
+	var configDir string
+	if s.ConfigFile != "" {
+		cfg, err = server.LoadConfig(s.ConfigFile, defaultCfg)
+		if err != nil {
+			logger.Fatalw("failed to load config file", "err", err)
+		}
+		// The config file is usually mounted from a ConfigMap, which is updated through a symlink swap as secrets are.
+		configDir = filepath.Dir(s.ConfigFile)
+		if configDir != watchDir {
+			if err := watcher.Add(configDir); err != nil {
+				logger.Errorw("could not watch folder", "folder", configDir, "err", err)
+			}
+		}
+	}
+
 	k8sClient, err := k8s.New()
 	if err != nil {
 		logger.Fatalw("Couldn't connect to k8s api: %s", err)
@@ -76,36 +124,79 @@ func main() {
 	whsvr := &server.Webhook{
 		KeyFile:     s.TLSKeyFile,
 		CertFile:    s.TLSCertFile,
-		Cert:        &pair,
-		ClusterName: s.ClusterName,
 		CertWatcher: watcher,
 		Server: &http.Server{
 			Addr: fmt.Sprintf(":%d", s.Port),
 		},
-		Logger:           logger,
-		IgnoreNamespaces: s.IgnoreNamespaces,
+		Logger: logger,
 	}
 	whsvr.Server.TLSConfig = &tls.Config{GetCertificate: whsvr.GetCert}
-	whsvr.Mutators = append(whsvr.Mutators,
-		server.NewEnvVarMutator(whsvr.ClusterName),
-		server.NewSidecarMutator(whsvr.ClusterName, k8sClient))
+
+	pair, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+	if err == nil {
+		err = whsvr.SetCert(&pair)
+	}
+	if err != nil {
+		logger.Errorw("failed to load key pair", "err", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// The version decides whether the sidecar of Jobs can be a native sidecar. It is read once, not on every reload.
+	serverVersion, err := k8sClient.ServerVersion()
+	if err != nil {
+		logger.Warnw("could not read the Kubernetes version, the sidecar of Jobs uses the termination signal in auto mode", "err", err)
+	} else {
+		logger.Infow("kubernetes version", "version", serverVersion.GitVersion)
+	}
+
+	clients := server.K8sClients{
+		ConfigMaps:    k8sClient,
+		Secrets:       k8sClient,
+		SecretWriter:  k8sClient,
+		Events:        k8sClient.EventRecorder("newrelic-webhook"),
+		ServerVersion: serverVersion,
+	}
+	if s.ConfigMapCache {
+		cfgMapCache := k8sClient.ConfigMapCache(s.ConfigMapResync)
+		cfgMapCache.Start(stopCh)
+		whsvr.ConfigMapCache = cfgMapCache
+		clients.ConfigMaps = cfgMapCache
+	}
+	if s.ResolveOwners {
+		ownerCache := k8sClient.OwnerCache(s.ConfigMapResync)
+		ownerCache.Start(stopCh)
+		clients.Owners = ownerCache
+	}
+	if err := whsvr.ApplyConfig(cfg, clients); err != nil {
+		logger.Fatalw("invalid configuration", "err", err)
+	}
+	for _, warning := range cfg.Warnings() {
+		logger.Warnw("configuration warning", "warning", warning)
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/mutate", withLoggingMiddleware(logger)(withTimeoutMiddleware(s.Timeout)(whsvr)))
+	mux.Handle("/validate", withLoggingMiddleware(logger)(withTimeoutMiddleware(s.Timeout)(whsvr.ValidateHandler())))
 	whsvr.Server.Handler = mux
 
 	// The health check needs to be in another server because it cannot be under TLS.
-	readinessProbe := server.TLSReadyReadinessProbe(whsvr)
+	// Metrics are exposed next to it so they can be scraped without a client certificate.
+	plainMux := http.NewServeMux()
+	plainMux.Handle("/", server.TLSReadyReadinessProbe(whsvr))
+	plainMux.Handle("/livez", server.LivenessProbe(whsvr))
+	plainMux.Handle("/metrics", server.MetricsHandler())
 	go func() {
 		logger.Info("starting the TLS readiness server")
-		if err := http.ListenAndServe(":8080", readinessProbe); err != nil {
+		if err := http.ListenAndServe(":8080", plainMux); err != nil {
 			logger.Errorw("failed to start TLS readiness server", "err", err)
 		}
 	}()
 
 	go func() {
 		logger.Info("starting the webhook server")
-		if err := whsvr.Server.ListenAndServeTLS("", ""); err != nil {
+		if err := whsvr.ListenAndServeTLS(); err != nil {
 			logger.Errorw("failed to start webhook server", "err", err)
 		}
 	}()
@@ -113,32 +204,126 @@ func main() {
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	var debounceTimer <-chan time.Time
+	var certBootstrapper *k8s.CertBootstrapper
+	if s.SelfManagedCerts {
+		certBootstrapper = k8sClient.CertBootstrapper(k8s.CertBootstrapOptions{
+			ServiceName:                 s.CertService,
+			Namespace:                   s.CertNamespace,
+			SecretName:                  s.CertSecret,
+			WebhookConfigName:           s.CertWebhook,
+			ValidatingWebhookConfigName: s.CertValidatingWebhook,
+			SelfSigned:                  true,
+		})
+	}
+	// The rotation talks to the K8s api, so it runs apart from the loop below, not to delay the shutdown and the reloads.
+	certCtx, stopCertChecks := context.WithCancel(context.Background())
+	defer stopCertChecks()
+	go checkCerts(certCtx, whsvr, certBootstrapper, s.CertCheckInterval, s.CertRotateBefore)
+
+	var debounceTimer, configDebounceTimer <-chan time.Time
 	for {
 		select {
+		case <-configDebounceTimer:
+			cfg, err := server.LoadConfig(s.ConfigFile, defaultCfg)
+			if err == nil {
+				err = whsvr.ApplyConfig(cfg, clients)
+			}
+			server.RecordConfigReload(err)
+			if err != nil {
+				logger.Errorw("reload config error", "err", err)
+				break
+			}
+			logger.Info("config reloaded!")
+			for _, warning := range cfg.Warnings() {
+				logger.Warnw("configuration warning", "warning", warning)
+			}
 		case <-debounceTimer:
 			pair, err := tls.LoadX509KeyPair(whsvr.CertFile, whsvr.KeyFile)
+			server.RecordCertReload(err)
 			if err != nil {
 				logger.Errorw("reload cert error", "err", err)
 				break
 			}
-			whsvr.Lock()
-			whsvr.Cert = &pair
-			whsvr.Unlock()
+			if err := whsvr.SetCert(&pair); err != nil {
+				logger.Errorw("reload cert error", "err", err)
+				break
+			}
 			logger.Info("cert/key pair reloaded!")
 		case event := <-whsvr.CertWatcher.Events:
 			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				debounceTimer = time.After(500 * time.Millisecond)
+				eventDir := filepath.Dir(event.Name)
+				if eventDir == watchDir {
+					debounceTimer = time.After(500 * time.Millisecond)
+				}
+				if eventDir == configDir {
+					configDebounceTimer = time.After(500 * time.Millisecond)
+				}
 			}
 		case <-signalChan:
 			logger.Info("got OS shutdown signal, shutting down webhook server gracefully...")
+			stopCertChecks()
 			_ = watcher.Close()
-			_ = whsvr.Server.Shutdown(context.Background())
+			if err := whsvr.Shutdown(s.ShutdownGracePeriod, s.ShutdownTimeout); err != nil {
+				logger.Errorw("webhook server shutdown error", "err", err)
+			}
 			return
 		}
 	}
 }
 
+// checkCerts checks the serving certificate right away and then every interval, until the context is done.
+func checkCerts(ctx context.Context, whsvr *server.Webhook, certBootstrapper *k8s.CertBootstrapper, interval, rotateBefore time.Duration) {
+	for {
+		checkCert(ctx, whsvr, certBootstrapper, rotateBefore)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkCert warns when the serving certificate is about to expire. When the certificates are self-managed, it is
+// rotated first, and the caBundle of the webhook is kept in sync with the CA, so the warning means the rotation failed.
+// The replicas can rotate it at the same time, see k8s.CertBootstrapper.RotateServingCert.
+func checkCert(ctx context.Context, whsvr *server.Webhook, certBootstrapper *k8s.CertBootstrapper, rotateBefore time.Duration) {
+	defer whsvr.CheckCertRenewal(rotateBefore)
+
+	whsvr.RLock()
+	var leaf *x509.Certificate
+	if whsvr.Cert != nil {
+		leaf = whsvr.Cert.Leaf
+	}
+	whsvr.RUnlock()
+
+	if certBootstrapper == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	certPEM, keyPEM, err := certBootstrapper.RotateServingCert(ctx, leaf, rotateBefore)
+	if err == nil && certPEM == nil {
+		return
+	}
+	if err == nil {
+		var pair tls.Certificate
+		if pair, err = tls.X509KeyPair(certPEM, keyPEM); err == nil {
+			err = whsvr.SetCert(&pair)
+		}
+	}
+	if err != nil && ctx.Err() == context.Canceled {
+		// The webhook is shutting down.
+		return
+	}
+	server.RecordCertRotation(err)
+	if err != nil {
+		whsvr.Logger.Errorw("cert rotation error", "err", err)
+		return
+	}
+	whsvr.Logger.Info("cert/key pair rotated!")
+}
+
 func withTimeoutMiddleware(timeout time.Duration) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
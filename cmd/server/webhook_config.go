@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/newrelic/k8s-webhook/src/server"
+)
+
+// runWebhookConfig implements the webhook-config subcommand, which prints the MutatingWebhookConfiguration
+// registering the webhook, or the ValidatingWebhookConfiguration of the /validate endpoint.
+func runWebhookConfig(args []string, out io.Writer) error {
+	var opts server.WebhookConfigOptions
+	var caFile, caBundle, failurePolicy, namespaceLabel string
+	var validating bool
+
+	fs := flag.NewFlagSet("webhook-config", flag.ContinueOnError)
+	fs.StringVar(&opts.Name, "name", "", "Name of the webhook configuration. Defaults to newrelic-webhook-cfg, or\n"+
+		"newrelic-webhook-validation-cfg with -validating.")
+	fs.StringVar(&opts.ServiceName, "service", "newrelic-webhook-svc", "Name of the webhook service.")
+	fs.StringVar(&opts.ServiceNamespace, "namespace", metav1.NamespaceDefault, "Namespace of the webhook service.")
+	fs.StringVar(&opts.Path, "path", "", "Path of the endpoint. Defaults to /mutate, or /validate with -validating.")
+	fs.StringVar(&caFile, "ca-file", "", "PEM file with the CA certificate that signed the webhook certificate.")
+	fs.StringVar(&caBundle, "ca-bundle", "", "Base64 encoded CA bundle. Ignored when -ca-file is set.")
+	fs.StringVar(&failurePolicy, "failure-policy", string(admissionregistrationv1.Ignore), "Failure policy: Ignore or Fail.")
+	fs.StringVar(&namespaceLabel, "namespace-label", "", "Only call the webhook for namespaces with this label set to 'enabled'.")
+	fs.BoolVar(&opts.EphemeralContainers, "ephemeral-containers", false, "Also register the webhook for ephemeral containers.")
+	fs.BoolVar(&validating, "validating", false, "Print the ValidatingWebhookConfiguration of the /validate endpoint.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch policy := admissionregistrationv1.FailurePolicyType(failurePolicy); policy {
+	case admissionregistrationv1.Ignore, admissionregistrationv1.Fail:
+		opts.FailurePolicy = policy
+	default:
+		return fmt.Errorf("invalid failure policy '%s'", failurePolicy)
+	}
+
+	var err error
+	if caFile != "" {
+		if opts.CABundle, err = ioutil.ReadFile(caFile); err != nil {
+			return errors.Wrapf(err, "error reading CA file '%s'", caFile)
+		}
+	} else if caBundle != "" {
+		if opts.CABundle, err = base64.StdEncoding.DecodeString(caBundle); err != nil {
+			return errors.Wrap(err, "error decoding CA bundle")
+		}
+	}
+
+	if namespaceLabel != "" {
+		opts.NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{namespaceLabel: "enabled"},
+		}
+	}
+
+	var cfg interface{} = server.NewMutatingWebhookConfiguration(opts)
+	if validating {
+		cfg = server.NewValidatingWebhookConfiguration(opts)
+	}
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling the webhook configuration")
+	}
+	_, err = out.Write(data)
+	return err
+}
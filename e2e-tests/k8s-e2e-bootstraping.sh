@@ -1,7 +1,7 @@
 #!/usr/bin/env sh
 
-E2E_KUBERNETES_VERSION=${E2E_E2E_KUBERNETES_VERSION:-v1.10.0}
-E2E_MINIKUBE_VERSION=${E2E_E2E_MINIKUBE_VERSION:-v0.33.1}
+E2E_KUBERNETES_VERSION=${E2E_KUBERNETES_VERSION:-v1.29.6}
+E2E_MINIKUBE_VERSION=${E2E_MINIKUBE_VERSION:-v1.33.1}
 E2E_SETUP_MINIKUBE=${E2E_SETUP_MINIKUBE:-}
 E2E_SETUP_KUBECTL=${E2E_SETUP_KUBECTL:-}
 E2E_START_MINIKUBE=${E2E_START_MINIKUBE:-}
@@ -15,13 +15,16 @@ setup_minikube() {
 }
 
 setup_kubectl() {
-    curl -sLo kubectl https://storage.googleapis.com/kubernetes-release/release/"$E2E_KUBERNETES_VERSION"/bin/linux/amd64/kubectl \
+    curl -sLo kubectl https://dl.k8s.io/release/"$E2E_KUBERNETES_VERSION"/bin/linux/amd64/kubectl \
         && chmod +x kubectl \
         && $E2E_SUDO mv kubectl /usr/local/bin/
 }
 
 start_minikube() {
-    $E2E_SUDO minikube start --vm-driver="$E2E_MINIKUBE_DRIVER" --bootstrapper=kubeadm --kubernetes-version="$E2E_KUBERNETES_VERSION" --logtostderr
+    # Only the none driver runs as root, the docker one refuses to.
+    start_sudo=""
+    [ "$E2E_MINIKUBE_DRIVER" = "none" ] && start_sudo="$E2E_SUDO"
+    $start_sudo minikube start --driver="$E2E_MINIKUBE_DRIVER" --kubernetes-version="$E2E_KUBERNETES_VERSION" --logtostderr
 }
 
 get_pod_name_by_label() {
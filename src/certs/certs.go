@@ -0,0 +1,180 @@
+// Package certs generates the keys and certificates used to serve the webhook over TLS.
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// CACertValidity is the validity of the self-signed CA certificates.
+	CACertValidity = 10 * 365 * 24 * time.Hour
+	// ServingCertValidity is the validity of the serving certificates signed by a self-signed CA.
+	ServingCertValidity = 365 * 24 * time.Hour
+
+	certificatePEMType = "CERTIFICATE"
+	privateKeyPEMType  = "PRIVATE KEY"
+	csrPEMType         = "CERTIFICATE REQUEST"
+)
+
+// KeyPair is a certificate along with its private key.
+type KeyPair struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// GenerateKey generates a new private key for a certificate.
+func GenerateKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// DNSNames returns the names the webhook service can be reached at from the K8s api server.
+func DNSNames(service, namespace string) []string {
+	return []string{
+		service,
+		fmt.Sprintf("%s.%s", service, namespace),
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+	}
+}
+
+// NewCSR creates a PEM encoded certificate signing request for the given subject and DNS names.
+func NewCSR(key crypto.Signer, subject pkix.Name, dnsNames []string) ([]byte, error) {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  subject,
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating certificate signing request")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: csrPEMType, Bytes: der}), nil
+}
+
+// NewCA creates a self-signed CA valid from now on for the given duration.
+func NewCA(commonName string, validity time.Duration) (*KeyPair, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating CA key")
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	cert, err := createCertificate(tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Cert: cert, Key: key}, nil
+}
+
+// SignServingCert creates a new key and a serving certificate for it signed by the CA, valid from now on for the given
+// duration. The validity is capped to the one of the CA.
+func (ca *KeyPair) SignServingCert(dnsNames []string, validity time.Duration) (*KeyPair, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating serving key")
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	if notAfter.After(ca.Cert.NotAfter) {
+		notAfter = ca.Cert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := createCertificate(tmpl, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{Cert: cert, Key: key}, nil
+}
+
+func createCertificate(tmpl, parent *x509.Certificate, pub crypto.PublicKey, signer crypto.Signer) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating serial number")
+	}
+	tmpl.SerialNumber = serial
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating certificate")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// CertPEM returns the PEM encoded certificate.
+func (kp *KeyPair) CertPEM() []byte {
+	return EncodeCert(kp.Cert)
+}
+
+// KeyPEM returns the PEM encoded private key.
+func (kp *KeyPair) KeyPEM() ([]byte, error) {
+	return EncodeKey(kp.Key)
+}
+
+// EncodeCert PEM encodes a certificate.
+func EncodeCert(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: certificatePEMType, Bytes: cert.Raw})
+}
+
+// EncodeKey PEM encodes a private key in PKCS #8 form.
+func EncodeKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling private key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: privateKeyPEMType, Bytes: der}), nil
+}
+
+// ParseKeyPair parses a PEM encoded certificate and PKCS #8 private key, as returned by CertPEM and KeyPEM.
+func ParseKeyPair(certPEM, keyPEM []byte) (*KeyPair, error) {
+	cert, err := ParseCert(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != privateKeyPEMType {
+		return nil, fmt.Errorf("no %s PEM block found", privateKeyPEMType)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return &KeyPair{Cert: cert, Key: signer}, nil
+}
+
+// ParseCert parses the first certificate of a PEM encoded bundle.
+func ParseCert(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != certificatePEMType {
+		return nil, fmt.Errorf("no %s PEM block found", certificatePEMType)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing certificate")
+	}
+	return cert, nil
+}
@@ -0,0 +1,40 @@
+package certs
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignServingCert(t *testing.T) {
+	ca, err := NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+
+	serving, err := ca.SignServingCert(DNSNames("svc", "ns"), 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"svc", "svc.ns", "svc.ns.svc"}, serving.Cert.DNSNames)
+	assert.Equal(t, ca.Cert.NotAfter, serving.Cert.NotAfter, "validity should be capped to the one of the CA")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	_, err = serving.Cert.Verify(x509.VerifyOptions{DNSName: "svc.ns.svc", Roots: roots})
+	assert.NoError(t, err)
+}
+
+func TestParseKeyPair(t *testing.T) {
+	ca, err := NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	keyPEM, err := ca.KeyPEM()
+	require.NoError(t, err)
+
+	parsed, err := ParseKeyPair(ca.CertPEM(), keyPEM)
+	require.NoError(t, err)
+	assert.True(t, parsed.Cert.Equal(ca.Cert))
+	assert.Equal(t, ca.Key.Public(), parsed.Key.Public())
+
+	_, err = ParseKeyPair(keyPEM, ca.CertPEM())
+	assert.Error(t, err)
+}
@@ -0,0 +1,480 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/newrelic/k8s-webhook/src/certs"
+)
+
+const (
+	// KubeletServingSignerName is the signer of the K8s api used for the CSRs by default. The K8s controller manager
+	// only signs requests for it whose subject looks like the one of a node.
+	KubeletServingSignerName = "kubernetes.io/kubelet-serving"
+
+	// The CA bundle of the K8s api server, which signs the certificates issued through CSRs.
+	clusterCAConfigMapNamespace = metav1.NamespaceSystem
+	clusterCAConfigMapName      = "extension-apiserver-authentication"
+	clusterCAConfigMapKey       = "client-ca-file"
+
+	// caSecretSuffix is appended to the name of the TLS secret to get the name of the secret holding the self-signed CA.
+	caSecretSuffix = "-ca"
+	// caCertKey is the key of the TLS secret holding the CA certificate, next to tls.crt and tls.key.
+	caCertKey = "ca.crt"
+	// previousCACertKey is the key of the CA secret holding the certificate of the CA it renewed.
+	previousCACertKey = "previous.crt"
+)
+
+// CertBootstrapOptions configures how the serving certificate of the webhook is issued and installed.
+type CertBootstrapOptions struct {
+	ServiceName       string
+	Namespace         string
+	SecretName        string
+	WebhookConfigName string
+	// ValidatingWebhookConfigName is the ValidatingWebhookConfiguration whose caBundle is also set, if it exists.
+	ValidatingWebhookConfigName string
+	// SelfSigned signs the serving certificate with a CA generated by the webhook, stored in the secret named
+	// SecretName-ca, instead of requesting it to the K8s api through a CertificateSigningRequest.
+	SelfSigned bool
+	// SignerName of the CertificateSigningRequest. Defaults to KubeletServingSignerName.
+	SignerName string
+	// Timeout for the CSR to be signed and for the MutatingWebhookConfiguration to show up.
+	Timeout time.Duration
+	// PollInterval between the checks of the CSR and of the MutatingWebhookConfiguration.
+	PollInterval time.Duration
+}
+
+// CertBootstrapper issues the serving certificate of the webhook, stores it in a TLS secret and patches the caBundle of
+// the MutatingWebhookConfiguration so the K8s api server trusts it.
+type CertBootstrapper struct {
+	clientset kubernetes.Interface
+	opts      CertBootstrapOptions
+}
+
+// NewCertBootstrapper creates a certificate bootstrapper. Unset durations and the signer name take their defaults.
+func NewCertBootstrapper(clientset kubernetes.Interface, opts CertBootstrapOptions) *CertBootstrapper {
+	if opts.SignerName == "" {
+		opts.SignerName = KubeletServingSignerName
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Minute
+	}
+	if opts.PollInterval == 0 {
+		opts.PollInterval = 2 * time.Second
+	}
+	return &CertBootstrapper{clientset: clientset, opts: opts}
+}
+
+// Run issues a new serving certificate, writes it to the TLS secret and patches the caBundle of the webhook.
+func (b *CertBootstrapper) Run(ctx context.Context) error {
+	var certPEM, keyPEM, caPEM []byte
+	var err error
+	if b.opts.SelfSigned {
+		var ca *certs.KeyPair
+		ca, caPEM, err = b.EnsureCA(ctx, 0)
+		if err != nil {
+			return err
+		}
+		certPEM, keyPEM, err = b.signServingCert(ca)
+		if err != nil {
+			return err
+		}
+	} else {
+		certPEM, keyPEM, err = b.requestServingCert(ctx)
+		if err != nil {
+			return err
+		}
+		caPEM, err = b.clusterCABundle(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := b.WriteTLSSecret(ctx, certPEM, keyPEM, caPEM); err != nil {
+		return err
+	}
+	return b.PatchCABundle(ctx, caPEM)
+}
+
+// EnsureCA returns the self-signed CA stored in the CA secret along with the CA bundle to be trusted by the K8s api
+// server. The CA is created if it does not exist yet, and renewed if it expires within renewBefore. The bundle keeps
+// the previous CA until it expires, so the serving certificates it signed are still trusted while they are replaced.
+func (b *CertBootstrapper) EnsureCA(ctx context.Context, renewBefore time.Duration) (*certs.KeyPair, []byte, error) {
+	ca, bundle, _, err := b.ensureCA(ctx, renewBefore)
+	return ca, bundle, err
+}
+
+// ensureCA is EnsureCA, also returning the resourceVersion of the CA secret, so the replicas can tell whether another
+// one renewed it in the meantime.
+func (b *CertBootstrapper) ensureCA(ctx context.Context, renewBefore time.Duration) (*certs.KeyPair, []byte, string, error) {
+	name := b.opts.SecretName + caSecretSuffix
+	secrets := b.clientset.CoreV1().Secrets(b.opts.Namespace)
+
+	secret, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !k8s_errors.IsNotFound(err) {
+		return nil, nil, "", errors.Wrapf(err, "error getting CA secret '%s/%s'", b.opts.Namespace, name)
+	}
+	exists := err == nil
+	var previous []byte
+	if exists {
+		ca, err := certs.ParseKeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, nil, "", errors.Wrapf(err, "invalid CA secret '%s/%s'", b.opts.Namespace, name)
+		}
+		if time.Until(ca.Cert.NotAfter) > renewBefore {
+			return ca, caBundle(ca.CertPEM(), secret.Data[previousCACertKey]), secret.ResourceVersion, nil
+		}
+		previous = ca.CertPEM()
+	}
+
+	ca, err := certs.NewCA(fmt.Sprintf("%s.%s CA", b.opts.ServiceName, b.opts.Namespace), certs.CACertValidity)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	data := map[string][]byte{
+		corev1.TLSCertKey:       ca.CertPEM(),
+		corev1.TLSPrivateKeyKey: keyPEM,
+	}
+	if previous != nil {
+		data[previousCACertKey] = previous
+	}
+
+	var written *corev1.Secret
+	if !exists {
+		written, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: b.opts.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}, metav1.CreateOptions{})
+	} else {
+		secret.Data = data
+		written, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if k8s_errors.IsAlreadyExists(err) || k8s_errors.IsConflict(err) {
+		// Another replica created or renewed it in the meantime.
+		return b.ensureCA(ctx, renewBefore)
+	}
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "error writing CA secret '%s/%s'", b.opts.Namespace, name)
+	}
+	return ca, caBundle(ca.CertPEM(), previous), written.ResourceVersion, nil
+}
+
+// checkCAVersion returns a conflict error when the CA secret no longer has the given resourceVersion, i.e. another
+// replica renewed the CA after it was read.
+func (b *CertBootstrapper) checkCAVersion(ctx context.Context, resourceVersion string) error {
+	name := b.opts.SecretName + caSecretSuffix
+	secret, err := b.clientset.CoreV1().Secrets(b.opts.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "error getting CA secret '%s/%s'", b.opts.Namespace, name)
+	}
+	if secret.ResourceVersion != resourceVersion {
+		return k8s_errors.NewConflict(corev1.Resource("secrets"), name, fmt.Errorf("the CA was renewed by another replica"))
+	}
+	return nil
+}
+
+// caBundle concatenates the CA certificate with the previous one, unless it has already expired.
+func caBundle(current, previous []byte) []byte {
+	bundle := append([]byte{}, current...)
+	if cert, err := certs.ParseCert(previous); err == nil && time.Now().Before(cert.NotAfter) {
+		bundle = append(bundle, previous...)
+	}
+	return bundle
+}
+
+// RotateServingCert issues a new serving certificate signed by the self-signed CA when the current one is missing,
+// expires within renewBefore or was not signed by the CA, and writes it to the TLS secret. The caBundle of the webhook
+// is patched whenever it is out of sync with the CA. It returns the PEM encoded certificate and key, or nil if the
+// current certificate is kept.
+//
+// Several replicas can rotate at the same time. The caBundle is only patched if neither the CA secret nor the webhook
+// configuration changed since they were read, and the rotation starts over with the new CA otherwise, so a replica
+// holding a renewed CA is never overwritten by one holding the previous CA.
+func (b *CertBootstrapper) RotateServingCert(ctx context.Context, current *x509.Certificate, renewBefore time.Duration) (certPEM, keyPEM []byte, err error) {
+	for {
+		ca, bundle, caVersion, err := b.ensureCA(ctx, renewBefore)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if current == nil || time.Until(current.NotAfter) < renewBefore || current.CheckSignatureFrom(ca.Cert) != nil {
+			certPEM, keyPEM, err = b.signServingCert(ca)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := b.WriteTLSSecret(ctx, certPEM, keyPEM, bundle); err != nil {
+				return nil, nil, err
+			}
+			if current, err = certs.ParseCert(certPEM); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		err = b.patchCABundle(ctx, bundle, func(ctx context.Context) error {
+			return b.checkCAVersion(ctx, caVersion)
+		})
+		if k8s_errors.IsConflict(errors.Cause(err)) {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return certPEM, keyPEM, nil
+	}
+}
+
+func (b *CertBootstrapper) signServingCert(ca *certs.KeyPair) (certPEM, keyPEM []byte, err error) {
+	serving, err := ca.SignServingCert(certs.DNSNames(b.opts.ServiceName, b.opts.Namespace), certs.ServingCertValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = serving.KeyPEM()
+	if err != nil {
+		return nil, nil, err
+	}
+	return serving.CertPEM(), keyPEM, nil
+}
+
+// requestServingCert creates a CertificateSigningRequest for a new key, approves it and waits for it to be signed.
+func (b *CertBootstrapper) requestServingCert(ctx context.Context) (certPEM, keyPEM []byte, err error) {
+	key, err := certs.GenerateKey()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error generating serving key")
+	}
+	keyPEM, err = certs.EncodeKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dnsNames := certs.DNSNames(b.opts.ServiceName, b.opts.Namespace)
+	subject := pkix.Name{CommonName: dnsNames[len(dnsNames)-1]}
+	if b.opts.SignerName == KubeletServingSignerName {
+		subject = pkix.Name{CommonName: "system:node:" + subject.CommonName, Organization: []string{"system:nodes"}}
+	}
+	request, err := certs.NewCSR(key, subject, dnsNames)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csrs := b.clientset.CertificatesV1().CertificateSigningRequests()
+	name := fmt.Sprintf("%s.%s", b.opts.ServiceName, b.opts.Namespace)
+	// Delete any previous CSR so we don't leave duplicates behind.
+	if err := csrs.Delete(ctx, name, metav1.DeleteOptions{}); err != nil && !k8s_errors.IsNotFound(err) {
+		return nil, nil, errors.Wrapf(err, "error deleting previous CSR '%s'", name)
+	}
+
+	csr, err := csrs.Create(ctx, &certificatesv1.CertificateSigningRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: certificatesv1.CertificateSigningRequestSpec{
+			Request:    request,
+			SignerName: b.opts.SignerName,
+			Usages: []certificatesv1.KeyUsage{
+				certificatesv1.UsageDigitalSignature,
+				certificatesv1.UsageKeyEncipherment,
+				certificatesv1.UsageServerAuth,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error creating CSR '%s'", name)
+	}
+
+	csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+		Type:    certificatesv1.CertificateApproved,
+		Status:  corev1.ConditionTrue,
+		Reason:  "NewRelicWebhookApprove",
+		Message: "Serving certificate of the New Relic webhook",
+	})
+	if _, err := csrs.UpdateApproval(ctx, name, csr, metav1.UpdateOptions{}); err != nil {
+		return nil, nil, errors.Wrapf(err, "error approving CSR '%s'", name)
+	}
+
+	err = wait.PollUntilContextTimeout(ctx, b.opts.PollInterval, b.opts.Timeout, true, func(ctx context.Context) (bool, error) {
+		csr, err := csrs.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, errors.Wrapf(err, "error getting CSR '%s'", name)
+		}
+		for _, c := range csr.Status.Conditions {
+			if c.Type == certificatesv1.CertificateDenied || c.Type == certificatesv1.CertificateFailed {
+				return false, fmt.Errorf("CSR '%s' was not signed: %s %s", name, c.Reason, c.Message)
+			}
+		}
+		certPEM = csr.Status.Certificate
+		return len(certPEM) > 0, nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error waiting for CSR '%s' to be signed", name)
+	}
+	return certPEM, keyPEM, nil
+}
+
+// clusterCABundle returns the CA bundle of the K8s api server.
+func (b *CertBootstrapper) clusterCABundle(ctx context.Context) ([]byte, error) {
+	cm, err := b.clientset.CoreV1().ConfigMaps(clusterCAConfigMapNamespace).Get(ctx, clusterCAConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting the K8s api CA bundle")
+	}
+	ca := cm.Data[clusterCAConfigMapKey]
+	if ca == "" {
+		return nil, fmt.Errorf("config map '%s/%s' has no '%s' key", clusterCAConfigMapNamespace, clusterCAConfigMapName, clusterCAConfigMapKey)
+	}
+	return []byte(ca), nil
+}
+
+// WriteTLSSecret creates or updates the TLS secret mounted by the webhook.
+func (b *CertBootstrapper) WriteTLSSecret(ctx context.Context, certPEM, keyPEM, caPEM []byte) error {
+	secrets := b.clientset.CoreV1().Secrets(b.opts.Namespace)
+	data := map[string][]byte{
+		corev1.TLSCertKey:       certPEM,
+		corev1.TLSPrivateKeyKey: keyPEM,
+		caCertKey:               caPEM,
+	}
+
+	secret, err := secrets.Get(ctx, b.opts.SecretName, metav1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		_, err = secrets.Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: b.opts.SecretName, Namespace: b.opts.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}, metav1.CreateOptions{})
+	} else if err == nil {
+		secret.Data = data
+		_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error writing TLS secret '%s/%s'", b.opts.Namespace, b.opts.SecretName)
+	}
+	return nil
+}
+
+// PatchCABundle sets the caBundle of all the webhooks of the MutatingWebhookConfiguration, waiting for it to be created,
+// and of the ValidatingWebhookConfiguration when one is set and exists.
+func (b *CertBootstrapper) PatchCABundle(ctx context.Context, caPEM []byte) error {
+	return b.patchCABundle(ctx, caPEM, nil)
+}
+
+// patchCABundle is PatchCABundle, calling precondition before patching each configuration. The patches only apply to
+// the configurations as they were read, and fail with a conflict error otherwise.
+func (b *CertBootstrapper) patchCABundle(ctx context.Context, caPEM []byte, precondition func(context.Context) error) error {
+	configs := b.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+
+	var cfg *admissionregistrationv1.MutatingWebhookConfiguration
+	err := wait.PollUntilContextTimeout(ctx, b.opts.PollInterval, b.opts.Timeout, true, func(ctx context.Context) (bool, error) {
+		var err error
+		cfg, err = configs.Get(ctx, b.opts.WebhookConfigName, metav1.GetOptions{})
+		if k8s_errors.IsNotFound(err) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error getting MutatingWebhookConfiguration '%s'", b.opts.WebhookConfigName)
+	}
+
+	bundles := make([][]byte, 0, len(cfg.Webhooks))
+	for _, wh := range cfg.Webhooks {
+		bundles = append(bundles, wh.ClientConfig.CABundle)
+	}
+	patch, err := caBundlePatch(bundles, caPEM, cfg.ResourceVersion)
+	if err != nil {
+		return err
+	}
+	if patch != nil {
+		if precondition != nil {
+			if err := precondition(ctx); err != nil {
+				return err
+			}
+		}
+		if _, err := configs.Patch(ctx, b.opts.WebhookConfigName, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+			return errors.Wrapf(err, "error patching caBundle of MutatingWebhookConfiguration '%s'", b.opts.WebhookConfigName)
+		}
+	}
+	return b.patchValidatingCABundle(ctx, caPEM, precondition)
+}
+
+// patchValidatingCABundle sets the caBundle of all the webhooks of the ValidatingWebhookConfiguration. The validation
+// webhook is optional, so it is not waited for.
+func (b *CertBootstrapper) patchValidatingCABundle(ctx context.Context, caPEM []byte, precondition func(context.Context) error) error {
+	if b.opts.ValidatingWebhookConfigName == "" {
+		return nil
+	}
+	configs := b.clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+
+	cfg, err := configs.Get(ctx, b.opts.ValidatingWebhookConfigName, metav1.GetOptions{})
+	if k8s_errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error getting ValidatingWebhookConfiguration '%s'", b.opts.ValidatingWebhookConfigName)
+	}
+	bundles := make([][]byte, 0, len(cfg.Webhooks))
+	for _, wh := range cfg.Webhooks {
+		bundles = append(bundles, wh.ClientConfig.CABundle)
+	}
+	patch, err := caBundlePatch(bundles, caPEM, cfg.ResourceVersion)
+	if err != nil || patch == nil {
+		return err
+	}
+	if precondition != nil {
+		if err := precondition(ctx); err != nil {
+			return err
+		}
+	}
+	if _, err := configs.Patch(ctx, b.opts.ValidatingWebhookConfigName, types.JSONPatchType, patch, metav1.PatchOptions{}); err != nil {
+		return errors.Wrapf(err, "error patching caBundle of ValidatingWebhookConfiguration '%s'", b.opts.ValidatingWebhookConfigName)
+	}
+	return nil
+}
+
+// caBundlePatch returns the JSON patch setting the caBundle of the webhooks with the given bundles, or nil if all of
+// them are already in sync. The patch sets the resourceVersion the configuration was read with, so the api server
+// rejects it with a conflict when the configuration changed in the meantime.
+func caBundlePatch(bundles [][]byte, caPEM []byte, resourceVersion string) ([]byte, error) {
+	inSync := true
+	for _, bundle := range bundles {
+		if !bytes.Equal(bundle, caPEM) {
+			inSync = false
+		}
+	}
+	if inSync {
+		return nil, nil
+	}
+
+	// It uses `add` operations to avoid errors in OpenShift.
+	type patchOperation struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value interface{} `json:"value"`
+	}
+	ops := make([]patchOperation, 0, len(bundles)+1)
+	if resourceVersion != "" {
+		ops = append(ops, patchOperation{Op: "add", Path: "/metadata/resourceVersion", Value: resourceVersion})
+	}
+	for i := range bundles {
+		ops = append(ops, patchOperation{Op: "add", Path: fmt.Sprintf("/webhooks/%d/clientConfig/caBundle", i), Value: caPEM})
+	}
+	return json.Marshal(ops)
+}
@@ -0,0 +1,261 @@
+package k8s
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/newrelic/k8s-webhook/src/certs"
+)
+
+var testCertBootstrapOptions = CertBootstrapOptions{
+	ServiceName:       "newrelic-webhook-svc",
+	Namespace:         "default",
+	SecretName:        "newrelic-webhook-secret",
+	WebhookConfigName: "newrelic-webhook-cfg",
+	Timeout:           time.Second,
+	PollInterval:      10 * time.Millisecond,
+}
+
+func testWebhookConfig() *admissionregistrationv1.MutatingWebhookConfiguration {
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "newrelic-webhook-cfg"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "webhook.newrelic.com"}},
+	}
+}
+
+func TestCertBootstrapperSelfSigned(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testWebhookConfig(), &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "newrelic-webhook-validation-cfg"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "validation.webhook.newrelic.com"}},
+	})
+	opts := testCertBootstrapOptions
+	opts.SelfSigned = true
+	opts.ValidatingWebhookConfigName = "newrelic-webhook-validation-cfg"
+
+	require.NoError(t, NewCertBootstrapper(clientset, opts).Run(context.Background()))
+
+	secret, err := clientset.CoreV1().Secrets("default").Get(context.Background(), "newrelic-webhook-secret", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	serving, err := certs.ParseKeyPair(secret.Data["tls.crt"], secret.Data["tls.key"])
+	require.NoError(t, err)
+
+	caSecret, err := clientset.CoreV1().Secrets("default").Get(context.Background(), "newrelic-webhook-secret-ca", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, caSecret.Data["tls.crt"], secret.Data["ca.crt"])
+
+	cfg, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "newrelic-webhook-cfg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, secret.Data["ca.crt"], cfg.Webhooks[0].ClientConfig.CABundle)
+	validatingCfg, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(context.Background(), "newrelic-webhook-validation-cfg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, secret.Data["ca.crt"], validatingCfg.Webhooks[0].ClientConfig.CABundle)
+
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(cfg.Webhooks[0].ClientConfig.CABundle))
+	_, err = serving.Cert.Verify(x509.VerifyOptions{
+		DNSName:   "newrelic-webhook-svc.default.svc",
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	assert.NoError(t, err)
+
+	// A second run reuses the stored CA.
+	require.NoError(t, NewCertBootstrapper(clientset, opts).Run(context.Background()))
+	secret, err = clientset.CoreV1().Secrets("default").Get(context.Background(), "newrelic-webhook-secret", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, caSecret.Data["tls.crt"], secret.Data["ca.crt"])
+}
+
+func TestCertBootstrapperCSR(t *testing.T) {
+	clusterCA, err := certs.NewCA("kubernetes", time.Hour)
+	require.NoError(t, err)
+
+	clientset := fake.NewSimpleClientset(
+		testWebhookConfig(),
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "extension-apiserver-authentication"},
+			Data:       map[string]string{"client-ca-file": string(clusterCA.CertPEM())},
+		},
+		// A CSR left behind by a previous run.
+		&certificatesv1.CertificateSigningRequest{ObjectMeta: metav1.ObjectMeta{Name: "newrelic-webhook-svc.default"}},
+	)
+	// Sign the CSR once it is approved, as the K8s controller manager would do.
+	clientset.PrependReactor("update", "certificatesigningrequests", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "approval" {
+			return false, nil, nil
+		}
+		csr := action.(k8stesting.UpdateAction).GetObject().(*certificatesv1.CertificateSigningRequest)
+		assert.Equal(t, KubeletServingSignerName, csr.Spec.SignerName)
+		block, _ := pem.Decode(csr.Spec.Request)
+		require.NotNil(t, block)
+		request, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		assert.Equal(t, "system:node:newrelic-webhook-svc.default.svc", request.Subject.CommonName)
+
+		signed, err := clusterCA.SignServingCert(request.DNSNames, time.Hour)
+		require.NoError(t, err)
+		csr.Status.Certificate = signed.CertPEM()
+		return false, nil, nil
+	})
+
+	require.NoError(t, NewCertBootstrapper(clientset, testCertBootstrapOptions).Run(context.Background()))
+
+	csr, err := clientset.CertificatesV1().CertificateSigningRequests().Get(context.Background(), "newrelic-webhook-svc.default", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Len(t, csr.Status.Conditions, 1)
+	assert.Equal(t, certificatesv1.CertificateApproved, csr.Status.Conditions[0].Type)
+
+	secret, err := clientset.CoreV1().Secrets("default").Get(context.Background(), "newrelic-webhook-secret", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, csr.Status.Certificate, secret.Data["tls.crt"])
+	assert.Equal(t, clusterCA.CertPEM(), secret.Data["ca.crt"])
+
+	cfg, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), "newrelic-webhook-cfg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, clusterCA.CertPEM(), cfg.Webhooks[0].ClientConfig.CABundle)
+}
+
+func TestCertBootstrapperMissingWebhookConfig(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	opts := testCertBootstrapOptions
+	opts.SelfSigned = true
+
+	assert.Error(t, NewCertBootstrapper(clientset, opts).Run(context.Background()))
+
+	// The ValidatingWebhookConfiguration is optional.
+	clientset = fake.NewSimpleClientset(testWebhookConfig())
+	opts.ValidatingWebhookConfigName = "newrelic-webhook-validation-cfg"
+	assert.NoError(t, NewCertBootstrapper(clientset, opts).Run(context.Background()))
+}
+
+func TestCertBootstrapperRotateServingCert(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testWebhookConfig())
+	opts := testCertBootstrapOptions
+	opts.SelfSigned = true
+	b := NewCertBootstrapper(clientset, opts)
+	ctx := context.Background()
+
+	// Without a certificate a new one is issued.
+	certPEM, _, err := b.RotateServingCert(ctx, nil, 24*time.Hour)
+	require.NoError(t, err)
+	require.NotNil(t, certPEM)
+	current, err := certs.ParseCert(certPEM)
+	require.NoError(t, err)
+
+	// A certificate far from expiry is kept.
+	certPEM, _, err = b.RotateServingCert(ctx, current, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Nil(t, certPEM)
+
+	// A certificate expiring soon is replaced.
+	certPEM, _, err = b.RotateServingCert(ctx, current, 2*certs.ServingCertValidity)
+	require.NoError(t, err)
+	require.NotNil(t, certPEM)
+	secret, err := clientset.CoreV1().Secrets("default").Get(ctx, "newrelic-webhook-secret", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, certPEM, secret.Data["tls.crt"])
+
+	// A certificate not signed by the stored CA is replaced.
+	other, err := certs.NewCA("other", time.Hour)
+	require.NoError(t, err)
+	certPEM, _, err = b.RotateServingCert(ctx, other.Cert, time.Minute)
+	require.NoError(t, err)
+	assert.NotNil(t, certPEM)
+}
+
+func TestCertBootstrapperRenewCA(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testWebhookConfig())
+	opts := testCertBootstrapOptions
+	opts.SelfSigned = true
+	b := NewCertBootstrapper(clientset, opts)
+	ctx := context.Background()
+
+	oldCA, _, err := b.EnsureCA(ctx, 0)
+	require.NoError(t, err)
+
+	// Renewing the CA issues a new serving certificate, and the caBundle trusts both CAs.
+	certPEM, _, err := b.RotateServingCert(ctx, nil, 2*certs.CACertValidity)
+	require.NoError(t, err)
+	serving, err := certs.ParseCert(certPEM)
+	require.NoError(t, err)
+
+	cfg, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "newrelic-webhook-cfg", metav1.GetOptions{})
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(cfg.Webhooks[0].ClientConfig.CABundle))
+	assert.Contains(t, string(cfg.Webhooks[0].ClientConfig.CABundle), string(oldCA.CertPEM()))
+	assert.Error(t, serving.CheckSignatureFrom(oldCA.Cert))
+	_, err = serving.Verify(x509.VerifyOptions{DNSName: "newrelic-webhook-svc.default.svc", Roots: roots})
+	assert.NoError(t, err)
+}
+
+func TestCertBootstrapperRotateConcurrently(t *testing.T) {
+	clientset := fake.NewSimpleClientset(testWebhookConfig())
+	opts := testCertBootstrapOptions
+	opts.SelfSigned = true
+	b := NewCertBootstrapper(clientset, opts)
+	ctx := context.Background()
+
+	_, _, err := b.EnsureCA(ctx, 0)
+	require.NoError(t, err)
+	secretsResource := corev1.SchemeGroupVersion.WithResource("secrets")
+	renewCA := func() *certs.KeyPair {
+		obj, err := clientset.Tracker().Get(secretsResource, "default", "newrelic-webhook-secret-ca")
+		require.NoError(t, err)
+		secret := obj.(*corev1.Secret).DeepCopy()
+		ca, err := certs.NewCA("renewed", certs.CACertValidity)
+		require.NoError(t, err)
+		keyPEM, err := ca.KeyPEM()
+		require.NoError(t, err)
+		secret.Data = map[string][]byte{"tls.crt": ca.CertPEM(), "tls.key": keyPEM}
+		secret.ResourceVersion += "1"
+		require.NoError(t, clientset.Tracker().Update(secretsResource, secret, "default"))
+		return ca
+	}
+
+	// The CA renewed by another replica after it was read is detected.
+	assert.NoError(t, b.checkCAVersion(ctx, ""))
+	renewCA()
+	assert.True(t, k8s_errors.IsConflict(b.checkCAVersion(ctx, "")))
+
+	// Another replica renews the CA and patches the caBundle while this one rotates: the patch conflicts and the
+	// rotation starts over with the renewed CA.
+	var renewed *certs.KeyPair
+	patches := 0
+	clientset.PrependReactor("patch", "mutatingwebhookconfigurations", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches == 1 {
+			renewed = renewCA()
+			return true, nil, k8s_errors.NewConflict(admissionregistrationv1.Resource("mutatingwebhookconfigurations"), "newrelic-webhook-cfg", errors.New("modified"))
+		}
+		return false, nil, nil
+	})
+
+	certPEM, _, err := b.RotateServingCert(ctx, nil, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 2, patches)
+	serving, err := certs.ParseCert(certPEM)
+	require.NoError(t, err)
+	assert.NoError(t, serving.CheckSignatureFrom(renewed.Cert))
+
+	cfg, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "newrelic-webhook-cfg", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, renewed.CertPEM(), cfg.Webhooks[0].ClientConfig.CABundle)
+}
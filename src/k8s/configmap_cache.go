@@ -0,0 +1,117 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigMapCache serves config maps from a local cache that is kept in sync with the K8s api by a shared informer,
+// so reading a config map during an admission review does not hit the api server.
+type ConfigMapCache struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   corev1listers.ConfigMapLister
+
+	mu      sync.Mutex
+	waiters map[string][]chan struct{}
+}
+
+// NewConfigMapCache creates a config map cache watching all the namespaces. It does not start watching until Start
+// is called.
+func NewConfigMapCache(clientset kubernetes.Interface, resync time.Duration) *ConfigMapCache {
+	factory := informers.NewSharedInformerFactory(clientset, resync)
+	cmInformer := factory.Core().V1().ConfigMaps()
+
+	c := &ConfigMapCache{
+		factory:  factory,
+		informer: cmInformer.Informer(),
+		lister:   cmInformer.Lister(),
+		waiters:  map[string][]chan struct{}{},
+	}
+	_, _ = c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.notify,
+		UpdateFunc: func(_, obj interface{}) { c.notify(obj) },
+	})
+	return c
+}
+
+// Start begins watching config maps. The watch is stopped when stopCh is closed.
+func (c *ConfigMapCache) Start(stopCh <-chan struct{}) {
+	c.factory.Start(stopCh)
+}
+
+// HasSynced returns whether the initial list of config maps has been loaded into the cache.
+func (c *ConfigMapCache) HasSynced() bool {
+	return c.informer.HasSynced()
+}
+
+// ConfigMap - retrieve a config map from the local cache
+func (c *ConfigMapCache) ConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
+	cm, err := c.lister.ConfigMaps(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	// Objects returned by the lister are shared with the cache, so they must not be modified by the caller.
+	return cm.DeepCopy(), nil
+}
+
+// WaitForConfigMap blocks until the given config map is present in the cache or the timeout expires. It returns
+// whether the config map is present.
+func (c *ConfigMapCache) WaitForConfigMap(namespace, name string, timeout time.Duration) bool {
+	key := namespace + "/" + name
+	ch := make(chan struct{})
+
+	c.mu.Lock()
+	c.waiters[key] = append(c.waiters[key], ch)
+	c.mu.Unlock()
+	defer c.removeWaiter(key, ch)
+
+	// The config map could have been added before the waiter was registered.
+	if _, err := c.lister.ConfigMaps(namespace).Get(name); err == nil {
+		return true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *ConfigMapCache) notify(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ch := range c.waiters[key] {
+		close(ch)
+	}
+	delete(c.waiters, key)
+}
+
+func (c *ConfigMapCache) removeWaiter(key string, ch chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	waiters := c.waiters[key]
+	for i, w := range waiters {
+		if w == ch {
+			c.waiters[key] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[key]) == 0 {
+		delete(c.waiters, key)
+	}
+}
@@ -0,0 +1,52 @@
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestConfigMapCache(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "present"},
+		Data:       map[string]string{"config.yaml": "integration_name: com.newrelic.nginx"},
+	})
+
+	c := NewConfigMapCache(clientset, 0)
+	assert.False(t, c.HasSynced())
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c.Start(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, c.HasSynced))
+
+	cm, err := c.ConfigMap("default", "present")
+	require.NoError(t, err)
+	assert.Equal(t, "integration_name: com.newrelic.nginx", cm.Data["config.yaml"])
+
+	_, err = c.ConfigMap("default", "missing")
+	assert.True(t, k8s_errors.IsNotFound(err))
+
+	assert.True(t, c.WaitForConfigMap("default", "present", time.Millisecond))
+	assert.False(t, c.WaitForConfigMap("default", "missing", 10*time.Millisecond))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = clientset.CoreV1().ConfigMaps("default").Create(context.Background(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "created-later"},
+		}, metav1.CreateOptions{})
+	}()
+	assert.True(t, c.WaitForConfigMap("default", "created-later", 5*time.Second))
+
+	_, err = c.ConfigMap("default", "created-later")
+	assert.NoError(t, err)
+}
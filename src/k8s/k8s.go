@@ -1,15 +1,22 @@
 package k8s
 
 import (
+	"context"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/version"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 )
 
 // Client wraps a connection to K8s api
 type Client struct {
-	clientset *kubernetes.Clientset
+	clientset kubernetes.Interface
 }
 
 // New create new kubernetes client
@@ -32,5 +39,47 @@ func New() (*Client, error) {
 
 // ConfigMap - retrieve a config map from the K8s api
 func (kc *Client) ConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
-	return kc.clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	return kc.clientset.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+}
+
+// Secret - retrieve a secret from the K8s api
+func (kc *Client) Secret(namespace, name string) (*corev1.Secret, error) {
+	return kc.clientset.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+}
+
+// CreateSecret - create a secret in the K8s api
+func (kc *Client) CreateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	return kc.clientset.CoreV1().Secrets(secret.Namespace).Create(context.Background(), secret, metav1.CreateOptions{})
+}
+
+// UpdateSecret - update a secret in the K8s api
+func (kc *Client) UpdateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	return kc.clientset.CoreV1().Secrets(secret.Namespace).Update(context.Background(), secret, metav1.UpdateOptions{})
+}
+
+// ServerVersion - retrieve the version of the K8s api
+func (kc *Client) ServerVersion() (*version.Info, error) {
+	return kc.clientset.Discovery().ServerVersion()
+}
+
+// ConfigMapCache - create a config map cache sharing the connection to the K8s api
+func (kc *Client) ConfigMapCache(resync time.Duration) *ConfigMapCache {
+	return NewConfigMapCache(kc.clientset, resync)
+}
+
+// OwnerCache - create an owner cache sharing the connection to the K8s api
+func (kc *Client) OwnerCache(resync time.Duration) *OwnerCache {
+	return NewOwnerCache(kc.clientset, resync)
+}
+
+// CertBootstrapper - create a certificate bootstrapper sharing the connection to the K8s api
+func (kc *Client) CertBootstrapper(opts CertBootstrapOptions) *CertBootstrapper {
+	return NewCertBootstrapper(kc.clientset, opts)
+}
+
+// EventRecorder - create a recorder sending Events to the K8s api on behalf of the given component
+func (kc *Client) EventRecorder(component string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kc.clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component})
 }
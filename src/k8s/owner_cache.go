@@ -0,0 +1,67 @@
+package k8s
+
+import (
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1listers "k8s.io/client-go/listers/apps/v1"
+	batchv1listers "k8s.io/client-go/listers/batch/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// OwnerCache resolves the controllers of ReplicaSets and Jobs from a local cache that is kept in sync with the K8s
+// api by shared informers. It is used to walk the owner chain of a pod up to its Deployment or CronJob.
+type OwnerCache struct {
+	factory     informers.SharedInformerFactory
+	rsInformer  cache.SharedIndexInformer
+	jobInformer cache.SharedIndexInformer
+	rsLister    appsv1listers.ReplicaSetLister
+	jobLister   batchv1listers.JobLister
+}
+
+// NewOwnerCache creates an owner cache watching all the namespaces. It does not start watching until Start is called.
+func NewOwnerCache(clientset kubernetes.Interface, resync time.Duration) *OwnerCache {
+	factory := informers.NewSharedInformerFactory(clientset, resync)
+	rsInformer := factory.Apps().V1().ReplicaSets()
+	jobInformer := factory.Batch().V1().Jobs()
+
+	return &OwnerCache{
+		factory:     factory,
+		rsInformer:  rsInformer.Informer(),
+		jobInformer: jobInformer.Informer(),
+		rsLister:    rsInformer.Lister(),
+		jobLister:   jobInformer.Lister(),
+	}
+}
+
+// Start begins watching ReplicaSets and Jobs. The watch is stopped when stopCh is closed.
+func (c *OwnerCache) Start(stopCh <-chan struct{}) {
+	c.factory.Start(stopCh)
+}
+
+// HasSynced returns whether the initial list of ReplicaSets and Jobs has been loaded into the cache.
+func (c *OwnerCache) HasSynced() bool {
+	return c.rsInformer.HasSynced() && c.jobInformer.HasSynced()
+}
+
+// ControllerOf returns the controller of the given object, or nil if it is not controlled by anything. Only the
+// ReplicaSet and Job kinds are supported.
+func (c *OwnerCache) ControllerOf(namespace, kind, name string) (*metav1.OwnerReference, error) {
+	var obj metav1.Object
+	var err error
+	switch kind {
+	case "ReplicaSet":
+		obj, err = c.rsLister.ReplicaSets(namespace).Get(name)
+	case "Job":
+		obj, err = c.jobLister.Jobs(namespace).Get(name)
+	default:
+		return nil, fmt.Errorf("unsupported owner kind '%s'", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metav1.GetControllerOf(obj), nil
+}
@@ -0,0 +1,58 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestOwnerCache(t *testing.T) {
+	controller := true
+	clientset := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "web-6f9c8d7b4",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "web", Controller: &controller}},
+		}},
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "raw-rs"}},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+			Namespace:       "default",
+			Name:            "backup-28311840",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob", Name: "backup", Controller: &controller}},
+		}},
+	)
+
+	c := NewOwnerCache(clientset, 0)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c.Start(stopCh)
+	require.True(t, cache.WaitForCacheSync(stopCh, c.HasSynced))
+
+	owner, err := c.ControllerOf("default", "ReplicaSet", "web-6f9c8d7b4")
+	require.NoError(t, err)
+	assert.Equal(t, "Deployment", owner.Kind)
+	assert.Equal(t, "web", owner.Name)
+
+	owner, err = c.ControllerOf("default", "ReplicaSet", "raw-rs")
+	require.NoError(t, err)
+	assert.Nil(t, owner)
+
+	owner, err = c.ControllerOf("default", "Job", "backup-28311840")
+	require.NoError(t, err)
+	assert.Equal(t, "CronJob", owner.Kind)
+	assert.Equal(t, "backup", owner.Name)
+
+	_, err = c.ControllerOf("other", "Job", "backup-28311840")
+	assert.True(t, k8s_errors.IsNotFound(err))
+
+	_, err = c.ControllerOf("default", "StatefulSet", "db")
+	assert.Error(t, err)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// collisionPrefix is prepended to the names of the sidecar container and volumes already used in the pod.
+const collisionPrefix = "nri-"
+
+// uniqueName returns the name, or a prefixed name when the name is taken, adding a counter until it is free. The
+// result is a DNS label as long as the name is one.
+func uniqueName(name string, taken map[string]bool) string {
+	if !taken[name] {
+		return name
+	}
+	base := collisionPrefix + name
+	candidate := truncateName(base, "")
+	for i := 2; taken[candidate]; i++ {
+		candidate = truncateName(base, "-"+strconv.Itoa(i))
+	}
+	return candidate
+}
+
+// truncateName shortens the name so it fits in a DNS label with the suffix.
+func truncateName(name, suffix string) string {
+	if max := validation.DNS1123LabelMaxLength - len(suffix); len(name) > max {
+		name = strings.TrimRight(name[:max], "-")
+	}
+	return name + suffix
+}
+
+// sidecarContainerName returns a name for the sidecar not used by any container of the pod.
+func sidecarContainerName(pod *corev1.Pod, name string) string {
+	taken := map[string]bool{}
+	for _, c := range pod.Spec.Containers {
+		taken[c.Name] = true
+	}
+	for _, c := range pod.Spec.InitContainers {
+		taken[c.Name] = true
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		taken[c.Name] = true
+	}
+	return uniqueName(name, taken)
+}
+
+// renameSidecarVolumes renames the volumes of the sidecar already used in the pod, and the mounts referencing them.
+// The new names are used neither by the pod nor by the other volumes of the sidecar.
+func renameSidecarVolumes(pod *corev1.Pod, volumes []corev1.Volume, mounts []corev1.VolumeMount) {
+	podVolumes := map[string]bool{}
+	taken := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		podVolumes[v.Name] = true
+		taken[v.Name] = true
+	}
+	for _, v := range volumes {
+		taken[v.Name] = true
+	}
+
+	renamed := map[string]string{}
+	for i, v := range volumes {
+		if !podVolumes[v.Name] {
+			continue
+		}
+		name := uniqueName(v.Name, taken)
+		taken[name] = true
+		renamed[v.Name] = name
+		volumes[i].Name = name
+	}
+	for i, m := range mounts {
+		if name, ok := renamed[m.Name]; ok {
+			mounts[i].Name = name
+		}
+	}
+}
+
+// withoutConflictingMounts drops the volume mounts shared from the target containers that would be mounted at the
+// same path as a mount of the sidecar, or that would hide the agent directory, reporting them as warnings.
+func withoutConflictingMounts(shared, own []corev1.VolumeMount, agentDir string) ([]corev1.VolumeMount, []string) {
+	ownPaths := map[string]string{}
+	for _, m := range own {
+		ownPaths[path.Clean(m.MountPath)] = m.Name
+	}
+	agentDir = path.Clean(agentDir)
+
+	var mounts []corev1.VolumeMount
+	var warnings []string
+	for _, m := range shared {
+		mountPath := path.Clean(m.MountPath)
+		if owner, ok := ownPaths[mountPath]; ok {
+			warnings = append(warnings, fmt.Sprintf("volume %s is not shared, the sidecar mounts %s at %s", m.Name, owner, m.MountPath))
+			continue
+		}
+		if mountPath == agentDir || strings.HasPrefix(agentDir, mountPath+"/") {
+			warnings = append(warnings, fmt.Sprintf("volume %s is not shared, mounting it at %s would hide the agent directory %s",
+				m.Name, m.MountPath, agentDir))
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, warnings
+}
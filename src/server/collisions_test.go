@@ -0,0 +1,90 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestUniqueName(t *testing.T) {
+	long := strings.Repeat("a", 62)
+	cases := []struct {
+		name     string
+		taken    []string
+		expected string
+	}{
+		{name: "free", expected: "free"},
+		{name: "tmpfs-tmp", taken: []string{"tmpfs-tmp"}, expected: "nri-tmpfs-tmp"},
+		{name: "tmpfs-tmp", taken: []string{"tmpfs-tmp", "nri-tmpfs-tmp", "nri-tmpfs-tmp-2"}, expected: "nri-tmpfs-tmp-3"},
+		{name: long, taken: []string{long}, expected: "nri-" + long[:59]},
+		{name: long, taken: []string{long, "nri-" + long[:59]}, expected: "nri-" + long[:57] + "-2"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expected, func(t *testing.T) {
+			taken := map[string]bool{}
+			for _, name := range c.taken {
+				taken[name] = true
+			}
+			name := uniqueName(c.name, taken)
+			assert.Equal(t, c.expected, name)
+			assert.Empty(t, validation.IsDNS1123Label(name))
+		})
+	}
+}
+
+func TestCreateSidecarNameCollisions(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Annotations: map[string]string{annotationIntegrationConfigKey: configName},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "newrelic-sidecar"}},
+			Containers: []corev1.Container{{
+				Name: "app",
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "tmpfs-tmp", MountPath: "/tmp"},
+					{Name: "integration-config", MountPath: "/etc/app"},
+					{Name: "tmpfs-data", MountPath: "/nri-sidecar"},
+				},
+			}},
+			Volumes: []corev1.Volume{{Name: "tmpfs-tmp"}, {Name: "integration-config"}, {Name: "nri-tmpfs-tmp"}, {Name: "tmpfs-data"}},
+		},
+	}
+	clients := K8sClients{ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}}}
+
+	containers, volumes, warnings, err := newSidecarMutatorFromConfig(clusterName, defaultSidecarConfig(), clients).createSidecar(pod)
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+	assert.Equal(t, "nri-newrelic-sidecar", containers[0].Name)
+
+	var names []string
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	assert.Equal(t, []string{"nri-integration-config", "nri-tmpfs-data", "tmpfs-user-data", "nri-tmpfs-tmp-2"}, names)
+
+	mounts := map[string]string{}
+	for _, m := range containers[0].VolumeMounts {
+		assert.NotContains(t, mounts, m.MountPath, "duplicated mount path")
+		mounts[m.MountPath] = m.Name
+	}
+	assert.Equal(t, "nri-tmpfs-tmp-2", mounts["/tmp"])
+	assert.Equal(t, "nri-tmpfs-data", mounts[defaultAgentDirPath+"/data"])
+	assert.Equal(t, "nri-integration-config", mounts[defaultAgentDirPath+"/integrations.d/integration.yaml"])
+	assert.Equal(t, "integration-config", mounts["/etc/app"])
+	assert.NotContains(t, mounts, "/nri-sidecar")
+
+	assert.Equal(t, []string{
+		"container newrelic-sidecar already exists in the pod, the sidecar is named nri-newrelic-sidecar",
+		"volume tmpfs-tmp is not shared, the sidecar mounts nri-tmpfs-tmp-2 at /tmp",
+		"volume tmpfs-data is not shared, mounting it at /nri-sidecar would hide the agent directory /nri-sidecar/newrelic-infra",
+	}, warnings)
+}
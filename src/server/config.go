@@ -0,0 +1,307 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the declarative configuration of the webhook. It can be loaded from a YAML file with LoadConfig and applied
+// at runtime with Webhook.ApplyConfig.
+type Config struct {
+	ClusterName      string           `json:"clusterName"`
+	IgnoreNamespaces []string         `json:"ignoreNamespaces"`
+	EnvVarMutator    EnvVarConfig     `json:"envVarMutator"`
+	SidecarMutator   SidecarConfig    `json:"sidecarMutator"`
+	Validation       ValidationConfig `json:"validation"`
+}
+
+// EnvVarConfig configures the injection of the New Relic metadata env vars into the pod containers.
+type EnvVarConfig struct {
+	Enabled bool `json:"enabled"`
+	// Variables restricts the injected env vars to the given names. All of them are injected when empty.
+	Variables []string `json:"variables,omitempty"`
+	// OptIn only injects the env vars into pods annotated with newrelic.com/inject-metadata: "true". Otherwise, pods
+	// can opt out with newrelic.com/inject-metadata: "false".
+	OptIn bool `json:"optIn"`
+	// InitContainers also injects the env vars into the init containers of the pod.
+	InitContainers bool `json:"initContainers"`
+	// EphemeralContainers also injects the env vars into the ephemeral containers added to running pods. It requires
+	// the webhook to be registered for UPDATE operations on the pods/ephemeralcontainers subresource.
+	EphemeralContainers bool `json:"ephemeralContainers"`
+}
+
+// SidecarConfig configures the injected integrations sidecar.
+type SidecarConfig struct {
+	Enabled bool `json:"enabled"`
+	// Image used when the pod does not set the newrelic.com/integrations-sidecar-imagename annotation.
+	Image string `json:"image"`
+	// AgentDir is the directory of the infrastructure agent inside the sidecar image.
+	AgentDir        string                      `json:"agentDir"`
+	Resources       corev1.ResourceRequirements `json:"resources"`
+	SecurityContext *corev1.SecurityContext     `json:"securityContext,omitempty"`
+	// StrictValidation denies the creation of the pods whose integration config is not valid. Otherwise, the problems
+	// are reported as admission warnings and the sidecar is injected anyway.
+	StrictValidation bool `json:"strictValidation"`
+	// IntegrationBinaryPaths are the path prefixes the commands of the integration definitions can run from. It
+	// defaults to ./bin/ and the integrations bin directories of the agent.
+	IntegrationBinaryPaths []string `json:"integrationBinaryPaths,omitempty"`
+	// ImagePolicy restricts the images the sidecar can be created with and rewrites them.
+	ImagePolicy ImagePolicyConfig `json:"imagePolicy"`
+	// AgentEnv are the env vars of the webhook whose values are copied into the sidecar, e.g. NRIA_VERBOSE. The ones
+	// that are not set in the webhook are ignored. When it is not set, all the env vars starting with NRIA are copied,
+	// and an empty list copies none.
+	AgentEnv []string `json:"agentEnv"`
+	// LicenseKeySecret references NRIA_LICENSE_KEY from a secret instead of copying its value from the webhook.
+	LicenseKeySecret *LicenseKeySecretConfig `json:"licenseKeySecret,omitempty"`
+	// Tmpfs sets the size limits of the memory-backed volumes the agent writes to.
+	Tmpfs TmpfsConfig `json:"tmpfs"`
+	// Template is a Go template of the base container and volumes of the sidecar, rendered for every pod. It replaces
+	// the default container and tmpfs volumes. The image and resources of the template default to the ones above.
+	Template string `json:"template,omitempty"`
+	// JobSidecar tells how the sidecar is injected into the pods of Jobs, so they complete once their containers exit:
+	// auto, native, signal or none.
+	JobSidecar JobSidecarMode `json:"jobSidecar"`
+	// Command runs the agent in the sidecar image. It is only set on the sidecars whose command is wrapped, e.g. to stop
+	// the sidecar of the pods of Jobs once they are done, when the container of the template has no command.
+	Command []string `json:"command,omitempty"`
+}
+
+// TmpfsConfig sets the size limits of the memory-backed volumes mounted on the data and user_data directories of the
+// agent and on /tmp. Their content counts against the memory of the pod.
+type TmpfsConfig struct {
+	DataSizeLimit     *resource.Quantity `json:"dataSizeLimit,omitempty"`
+	UserDataSizeLimit *resource.Quantity `json:"userDataSizeLimit,omitempty"`
+	TmpSizeLimit      *resource.Quantity `json:"tmpSizeLimit,omitempty"`
+}
+
+// DeepCopy returns a copy of the tmpfs settings that does not share any reference with the original ones.
+func (t TmpfsConfig) DeepCopy() TmpfsConfig {
+	copyQuantity := func(q *resource.Quantity) *resource.Quantity {
+		if q == nil {
+			return nil
+		}
+		out := q.DeepCopy()
+		return &out
+	}
+	return TmpfsConfig{
+		DataSizeLimit:     copyQuantity(t.DataSizeLimit),
+		UserDataSizeLimit: copyQuantity(t.UserDataSizeLimit),
+		TmpSizeLimit:      copyQuantity(t.TmpSizeLimit),
+	}
+}
+
+// ValidationConfig configures the validation of the New Relic annotations of the workloads served on /validate.
+type ValidationConfig struct {
+	// Mode is either warn, which admits the workloads with warnings, or enforce, which denies them.
+	Mode ValidationMode `json:"mode"`
+	// Namespaces overrides the mode for the given namespaces.
+	Namespaces map[string]ValidationMode `json:"namespaces,omitempty"`
+}
+
+// ValidationMode tells how the problems found by the validation are reported.
+type ValidationMode string
+
+const (
+	// ValidationWarn admits the workloads, reporting the problems as admission warnings.
+	ValidationWarn ValidationMode = "warn"
+	// ValidationEnforce denies the workloads with problems.
+	ValidationEnforce ValidationMode = "enforce"
+)
+
+// ModeFor returns the validation mode of the namespace.
+func (v ValidationConfig) ModeFor(namespace string) ValidationMode {
+	if mode, ok := v.Namespaces[namespace]; ok {
+		return mode
+	}
+	if v.Mode == "" {
+		return ValidationWarn
+	}
+	return v.Mode
+}
+
+// DefaultConfig returns the configuration used when no configuration file is provided.
+func DefaultConfig() *Config {
+	return &Config{
+		ClusterName:      "cluster",
+		IgnoreNamespaces: []string{},
+		EnvVarMutator: EnvVarConfig{
+			Enabled: true,
+		},
+		SidecarMutator: defaultSidecarConfig(),
+		Validation: ValidationConfig{
+			Mode: ValidationWarn,
+		},
+	}
+}
+
+func defaultSidecarConfig() SidecarConfig {
+	return SidecarConfig{
+		Enabled:    true,
+		Image:      defaultIntegrationImage,
+		AgentDir:   defaultAgentDirPath,
+		JobSidecar: JobSidecarAuto,
+		Command:    []string{defaultAgentCommand},
+		ImagePolicy: ImagePolicyConfig{
+			AllowedRepositories: append([]string(nil), defaultAllowedRepositories...),
+		},
+		Tmpfs: TmpfsConfig{
+			DataSizeLimit:     quantityPointer(resource.MustParse("32Mi")),
+			UserDataSizeLimit: quantityPointer(resource.MustParse("8Mi")),
+			TmpSizeLimit:      quantityPointer(resource.MustParse("16Mi")),
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			AllowPrivilegeEscalation: boolPointer(false),
+			Privileged:               boolPointer(false),
+			RunAsNonRoot:             boolPointer(true),
+			ReadOnlyRootFilesystem:   boolPointer(false),
+			RunAsUser:                int64Pointer(1000),
+		},
+	}
+}
+
+// LoadConfig reads the YAML configuration file at the given path. Settings missing from the file keep the value they
+// have in defaults, which is not modified.
+func LoadConfig(file string, defaults *Config) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading config file '%s'", file)
+	}
+
+	cfg := defaults.DeepCopy()
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, errors.Wrapf(err, "error unmarshaling config file '%s'", file)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid config file '%s'", file)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration can be applied to the webhook.
+func (c *Config) Validate() error {
+	if c.ClusterName == "" {
+		return fmt.Errorf("clusterName is required")
+	}
+	for _, v := range c.EnvVarMutator.Variables {
+		if !isMetadataEnvVar(v) {
+			return fmt.Errorf("envVarMutator.variables: unknown env var '%s'", v)
+		}
+	}
+	if c.SidecarMutator.Image == "" {
+		return fmt.Errorf("sidecarMutator.image is required")
+	}
+	if !path.IsAbs(c.SidecarMutator.AgentDir) {
+		return fmt.Errorf("sidecarMutator.agentDir must be an absolute path, got '%s'", c.SidecarMutator.AgentDir)
+	}
+	if err := validateResources(c.SidecarMutator.Resources); err != nil {
+		return errors.Wrap(err, "sidecarMutator.resources")
+	}
+	if secret := c.SidecarMutator.LicenseKeySecret; secret != nil && (secret.Name == "" || secret.Key == "") {
+		return fmt.Errorf("sidecarMutator.licenseKeySecret: name and key are required")
+	}
+	for name, limit := range map[string]*resource.Quantity{
+		"dataSizeLimit":     c.SidecarMutator.Tmpfs.DataSizeLimit,
+		"userDataSizeLimit": c.SidecarMutator.Tmpfs.UserDataSizeLimit,
+		"tmpSizeLimit":      c.SidecarMutator.Tmpfs.TmpSizeLimit,
+	} {
+		if limit != nil && limit.Sign() <= 0 {
+			return fmt.Errorf("sidecarMutator.tmpfs.%s must be positive, got %s", name, limit.String())
+		}
+	}
+	if !validJobSidecarMode(c.SidecarMutator.JobSidecar) {
+		return fmt.Errorf("sidecarMutator.jobSidecar must be auto, native, signal or none, got '%s'", c.SidecarMutator.JobSidecar)
+	}
+	if c.SidecarMutator.Template != "" {
+		if _, err := parseSidecarTemplate(c.SidecarMutator.Template); err != nil {
+			return errors.Wrap(err, "sidecarMutator.template")
+		}
+	}
+	for _, pattern := range c.SidecarMutator.ImagePolicy.AllowedRepositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("sidecarMutator.imagePolicy.allowedRepositories: invalid pattern '%s'", pattern)
+		}
+	}
+	if ttl := c.SidecarMutator.ImagePolicy.DigestCacheTTL; ttl != nil && ttl.Duration <= 0 {
+		return fmt.Errorf("sidecarMutator.imagePolicy.digestCacheTTL must be positive, got %s", ttl.Duration)
+	}
+	if !validValidationMode(c.Validation.Mode) {
+		return fmt.Errorf("validation.mode: unknown mode '%s'", c.Validation.Mode)
+	}
+	for namespace, mode := range c.Validation.Namespaces {
+		if !validValidationMode(mode) {
+			return fmt.Errorf("validation.namespaces.%s: unknown mode '%s'", namespace, mode)
+		}
+	}
+	return nil
+}
+
+// Warnings returns the settings of a valid configuration that are likely mistakes, to be logged when it is applied.
+func (c *Config) Warnings() []string {
+	if !c.SidecarMutator.Enabled {
+		return nil
+	}
+	return c.SidecarMutator.ImagePolicy.warnings()
+}
+
+func validValidationMode(mode ValidationMode) bool {
+	return mode == "" || mode == ValidationWarn || mode == ValidationEnforce
+}
+
+// validateResources checks that the resources are not negative and that no request is greater than its limit.
+func validateResources(r corev1.ResourceRequirements) error {
+	for name, q := range r.Requests {
+		if q.Sign() < 0 {
+			return fmt.Errorf("%s request must not be negative", name)
+		}
+		if limit, ok := r.Limits[name]; ok && q.Cmp(limit) > 0 {
+			return fmt.Errorf("%s request %s is greater than its limit %s", name, q.String(), limit.String())
+		}
+	}
+	for name, q := range r.Limits {
+		if q.Sign() < 0 {
+			return fmt.Errorf("%s limit must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// DeepCopy returns a copy of the configuration that does not share any reference with the original one.
+func (c *Config) DeepCopy() *Config {
+	out := *c
+	out.IgnoreNamespaces = append([]string{}, c.IgnoreNamespaces...)
+	out.EnvVarMutator.Variables = append([]string(nil), c.EnvVarMutator.Variables...)
+	if c.Validation.Namespaces != nil {
+		out.Validation.Namespaces = make(map[string]ValidationMode, len(c.Validation.Namespaces))
+		for k, v := range c.Validation.Namespaces {
+			out.Validation.Namespaces[k] = v
+		}
+	}
+	out.SidecarMutator.IntegrationBinaryPaths = append([]string(nil), c.SidecarMutator.IntegrationBinaryPaths...)
+	out.SidecarMutator.ImagePolicy = c.SidecarMutator.ImagePolicy.DeepCopy()
+	out.SidecarMutator.Tmpfs = c.SidecarMutator.Tmpfs.DeepCopy()
+	out.SidecarMutator.Command = append([]string(nil), c.SidecarMutator.Command...)
+	if c.SidecarMutator.AgentEnv != nil {
+		out.SidecarMutator.AgentEnv = append([]string{}, c.SidecarMutator.AgentEnv...)
+	}
+	if c.SidecarMutator.LicenseKeySecret != nil {
+		licenseKeySecret := *c.SidecarMutator.LicenseKeySecret
+		out.SidecarMutator.LicenseKeySecret = &licenseKeySecret
+	}
+	out.SidecarMutator.Resources = *c.SidecarMutator.Resources.DeepCopy()
+	if c.SidecarMutator.SecurityContext != nil {
+		out.SidecarMutator.SecurityContext = c.SidecarMutator.SecurityContext.DeepCopy()
+	}
+	return &out
+}
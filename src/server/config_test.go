@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+func TestLoadConfig(t *testing.T) {
+	defaults := DefaultConfig()
+
+	cfg, err := LoadConfig(path.Join("testdata", "config.yaml"), defaults)
+	require.NoError(t, err)
+
+	assert.Equal(t, "production", cfg.ClusterName)
+	assert.Equal(t, []string{"kube-system", "monitoring"}, cfg.IgnoreNamespaces)
+	assert.True(t, cfg.EnvVarMutator.Enabled)
+	assert.Equal(t, []string{"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", "NEW_RELIC_METADATA_KUBERNETES_POD_NAME"}, cfg.EnvVarMutator.Variables)
+	assert.False(t, cfg.SidecarMutator.Enabled)
+	assert.Equal(t, "newrelic/k8s-nri-nginx:1.3.0", cfg.SidecarMutator.Image)
+	// Settings missing from the file keep their default value.
+	assert.Equal(t, defaultAgentDirPath, cfg.SidecarMutator.AgentDir)
+	assert.Equal(t, resource.MustParse("100m"), cfg.SidecarMutator.Resources.Requests[corev1.ResourceCPU])
+	assert.Equal(t, resource.MustParse("128Mi"), cfg.SidecarMutator.Resources.Limits[corev1.ResourceMemory])
+	assert.Equal(t, int64(2000), *cfg.SidecarMutator.SecurityContext.RunAsUser)
+	assert.True(t, *cfg.SidecarMutator.SecurityContext.RunAsNonRoot)
+	// Without agentEnv, all the NRIA env vars are copied into the sidecar.
+	assert.Nil(t, cfg.SidecarMutator.AgentEnv)
+	assert.Equal(t, ValidationWarn, cfg.Validation.ModeFor("default"))
+	assert.Equal(t, ValidationEnforce, cfg.Validation.ModeFor("production"))
+
+	// The defaults are not modified.
+	assert.Equal(t, DefaultConfig(), defaults)
+}
+
+func TestConfigDeepCopyKeepsEmptyAgentEnv(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SidecarMutator.AgentEnv = []string{}
+	// An empty list copies no env var, unlike an unset one.
+	assert.Equal(t, []string{}, cfg.DeepCopy().SidecarMutator.AgentEnv)
+	assert.Nil(t, DefaultConfig().DeepCopy().SidecarMutator.AgentEnv)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "unknown field",
+			config: "clusterName: foo\nunknown: true",
+		},
+		{
+			name:   "empty cluster name",
+			config: "clusterName: \"\"",
+		},
+		{
+			name:   "unknown env var",
+			config: "envVarMutator:\n  variables: [FOO]",
+		},
+		{
+			name:   "invalid resource quantity",
+			config: "sidecarMutator:\n  resources:\n    requests:\n      cpu: lots",
+		},
+		{
+			name:   "request greater than limit",
+			config: "sidecarMutator:\n  resources:\n    requests:\n      cpu: 200m\n    limits:\n      cpu: 100m",
+		},
+		{
+			name:   "relative agent dir",
+			config: "sidecarMutator:\n  agentDir: newrelic-infra",
+		},
+		{
+			name:   "invalid image pattern",
+			config: "sidecarMutator:\n  imagePolicy:\n    allowedRepositories: [\"newrelic/[\"]",
+		},
+		{
+			name:   "negative digest cache ttl",
+			config: "sidecarMutator:\n  imagePolicy:\n    digestCacheTTL: -1m",
+		},
+		{
+			name:   "invalid sidecar template",
+			config: "sidecarMutator:\n  template: |\n    container:\n      name: {{ .Pod.Name",
+		},
+		{
+			name:   "zero tmpfs size limit",
+			config: "sidecarMutator:\n  tmpfs:\n    tmpSizeLimit: 0",
+		},
+		{
+			name:   "unknown job sidecar mode",
+			config: "sidecarMutator:\n  jobSidecar: kill",
+		},
+		{
+			name:   "unknown validation mode",
+			config: "validation:\n  mode: block",
+		},
+		{
+			name:   "unknown namespace validation mode",
+			config: "validation:\n  namespaces:\n    production: block",
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "webhook-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			file := path.Join(dir, "config.yaml")
+			require.NoError(t, ioutil.WriteFile(file, []byte(c.config), 0600))
+
+			_, err := LoadConfig(file, DefaultConfig())
+			assert.Error(t, err)
+		})
+	}
+
+	_, err = LoadConfig(path.Join(dir, "missing.yaml"), DefaultConfig())
+	assert.Error(t, err)
+}
+
+func TestApplyConfig(t *testing.T) {
+	whsvr := &Webhook{
+		Server: &http.Server{},
+	}
+	clients := K8sClients{ConfigMaps: makeConfigMapRetriever("default", configName, map[string]string{"config.yaml": integrationConfig})}
+
+	cfg := DefaultConfig()
+	cfg.ClusterName = clusterName
+	require.NoError(t, whsvr.ApplyConfig(cfg, clients))
+	assert.Len(t, whsvr.Mutators, 2)
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	cfg, err := LoadConfig(path.Join("testdata", "config.yaml"), DefaultConfig())
+	require.NoError(t, err)
+	require.NoError(t, whsvr.ApplyConfig(cfg, clients))
+	assert.Equal(t, "production", whsvr.ClusterName)
+	assert.Len(t, whsvr.Mutators, 1)
+
+	resp, err := http.Post(server.URL, "application/json",
+		bytes.NewReader(makeTestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": configName})))
+	require.NoError(t, err)
+	gotBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	var gotReview struct {
+		Response struct {
+			Patch []byte `json:"patch"`
+		} `json:"response"`
+	}
+	require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+	var patches []PatchOperation
+	require.NoError(t, json.Unmarshal(gotReview.Response.Patch, &patches))
+	// Only the 2 configured env vars are injected into each of the 2 containers, and the sidecar is disabled.
+	assert.Len(t, patches, 4)
+	for _, p := range patches {
+		assert.Contains(t, p.Path, "/env")
+	}
+
+	invalid := DefaultConfig()
+	invalid.ClusterName = ""
+	assert.Error(t, whsvr.ApplyConfig(invalid, clients))
+	assert.Equal(t, "production", whsvr.ClusterName)
+}
@@ -2,11 +2,27 @@ package server
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// annotationInjectMetadata opts a pod in ("true") or out ("false") of the metadata env vars injection.
+	annotationInjectMetadata = "newrelic.com/inject-metadata"
+	// annotationInjectMetadataContainers restricts the metadata env vars injection to a comma-separated list of
+	// container names.
+	annotationInjectMetadataContainers = "newrelic.com/inject-metadata-containers"
+)
+
+// cronJobNameRegexp matches the names of the jobs created by a CronJob, which end in their scheduled time in minutes
+// since the epoch.
+var cronJobNameRegexp = regexp.MustCompile(`^(.+)-[0-9]{8,}$`)
+
 func createEnvVarFromFieldPath(envVarName, fieldPath string) corev1.EnvVar {
 	return corev1.EnvVar{Name: envVarName, ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath}}}
 }
@@ -15,8 +31,46 @@ func createEnvVarFromString(envVarName, envVarValue string) corev1.EnvVar {
 	return corev1.EnvVar{Name: envVarName, Value: envVarValue}
 }
 
+// metadataEnvVarNames contains all the env vars that can be generated by metadataEnvGenerator.
+var metadataEnvVarNames = []string{
+	"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_NODE_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_NAMESPACE_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_POD_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_IMAGE_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_STATEFULSET_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_DAEMONSET_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME",
+	"NEW_RELIC_METADATA_KUBERNETES_CRONJOB_NAME",
+	"NRIA_DISPLAY_NAME",
+}
+
+func isMetadataEnvVar(name string) bool {
+	for _, n := range metadataEnvVarNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type ownerRetriever interface {
+	ControllerOf(namespace, kind, name string) (*metav1.OwnerReference, error)
+}
+
+// syncedCache is implemented by the retrievers backed by a local cache, whose lookups miss objects until it is synced.
+type syncedCache interface {
+	HasSynced() bool
+}
+
 type metadataEnvGenerator struct {
 	clusterName string
+	// ownerRtrv is used to walk the owner chain of the pod. When it is nil or the lookup fails, the name of the
+	// Deployment is guessed from the name of the pod. The name of the CronJob is only guessed when the Job is not
+	// found, as the Jobs created by hand are not told apart from the ones of CronJobs by their name.
+	ownerRtrv ownerRetriever
 }
 
 func (m *metadataEnvGenerator) getVars(pod *corev1.Pod, container *corev1.Container) []corev1.EnvVar {
@@ -30,47 +84,105 @@ func (m *metadataEnvGenerator) getVars(pod *corev1.Pod, container *corev1.Contai
 		createEnvVarFromFieldPath("NRIA_DISPLAY_NAME", "spec.nodeName"),
 	}
 
-	if len(pod.OwnerReferences) == 1 {
-		var ownerName, envName string
-		switch pod.OwnerReferences[0].Kind {
-		case "ReplicaSet":
+	owner := podOwner(pod)
+	if owner == nil {
+		return vars
+	}
+
+	switch owner.Kind {
+	case "ReplicaSet":
+		controller, err := m.controllerOf(pod.Namespace, owner)
+		if err != nil {
 			// Guess the name of the deployment. We check whether the Pod is Owned by a ReplicaSet and confirms with the
 			// naming convention for a Deployment. This can give a false positive if the user uses ReplicaSets directly.
 			podParts := strings.Split(pod.GenerateName, "-")
 			if len(podParts) >= 3 {
-				ownerName = strings.Join(podParts[:len(podParts)-2], "-")
-				envName = "NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME"
+				vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME",
+					strings.Join(podParts[:len(podParts)-2], "-")))
 			}
-		case "StatefulSet":
-			ownerName = pod.OwnerReferences[0].Name
-			envName = "NEW_RELIC_METADATA_KUBERNETES_STATEFULSET_NAME"
-		case "DaemonSet":
-			ownerName = pod.OwnerReferences[0].Name
-			envName = "NEW_RELIC_METADATA_KUBERNETES_DAEMONSET_NAME"
+		} else if controller != nil && controller.Kind == "Deployment" {
+			vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME", controller.Name))
 		}
-		if len(envName) > 0 {
-			vars = append(vars, createEnvVarFromString(envName, ownerName))
+	case "Job":
+		vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_JOB_NAME", owner.Name))
+		controller, err := m.controllerOf(pod.Namespace, owner)
+		if k8s_errors.IsNotFound(err) {
+			// Guess the name of the cron job when the job is not in the cache yet. The CronJob controller names its jobs
+			// after the cron job and their scheduled time. This can give a false positive if the user names jobs the same
+			// way.
+			if match := cronJobNameRegexp.FindStringSubmatch(owner.Name); match != nil {
+				vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CRONJOB_NAME", match[1]))
+			}
+		} else if controller != nil && controller.Kind == "CronJob" {
+			vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CRONJOB_NAME", controller.Name))
 		}
+	case "StatefulSet":
+		vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_STATEFULSET_NAME", owner.Name))
+	case "DaemonSet":
+		vars = append(vars, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_DAEMONSET_NAME", owner.Name))
 	}
 
 	return vars
 }
 
+// controllerOf returns the controller of the given owner of the pod, or an error if it could not be looked up.
+func (m *metadataEnvGenerator) controllerOf(namespace string, owner *metav1.OwnerReference) (*metav1.OwnerReference, error) {
+	if m.ownerRtrv == nil {
+		return nil, fmt.Errorf("owner lookup not available")
+	}
+	return m.ownerRtrv.ControllerOf(namespace, owner.Kind, owner.Name)
+}
+
+// podOwner returns the controller of the pod. Pods with a single owner that is not flagged as controller are also
+// considered to be controlled by it.
+func podOwner(pod *corev1.Pod) *metav1.OwnerReference {
+	if owner := metav1.GetControllerOfNoCopy(pod); owner != nil {
+		return owner
+	}
+	if len(pod.OwnerReferences) == 1 {
+		return &pod.OwnerReferences[0]
+	}
+	return nil
+}
+
 // EnvVarMutator - injects NewRelic metadata env vars into pods
 type EnvVarMutator struct {
 	envGenerator *metadataEnvGenerator
+	// variables restricts the injected env vars. All of them are injected when empty.
+	variables map[string]bool
+	// optIn only injects the env vars into pods annotated with newrelic.com/inject-metadata: "true".
+	optIn bool
+	// initContainers also injects the env vars into the init containers.
+	initContainers bool
+	// ephemeralContainers also injects the env vars into the ephemeral containers added to running pods.
+	ephemeralContainers bool
 }
 
 // NewEnvVarMutator - return new env var pod mutator
 func NewEnvVarMutator(clusterName string) *EnvVarMutator {
-	return &EnvVarMutator{
+	return newEnvVarMutatorFromConfig(clusterName, EnvVarConfig{Enabled: true}, nil)
+}
+
+func newEnvVarMutatorFromConfig(clusterName string, cfg EnvVarConfig, ownerRtrv ownerRetriever) *EnvVarMutator {
+	evm := &EnvVarMutator{
 		envGenerator: &metadataEnvGenerator{
 			clusterName: clusterName,
+			ownerRtrv:   ownerRtrv,
 		},
+		variables:           map[string]bool{},
+		optIn:               cfg.OptIn,
+		initContainers:      cfg.InitContainers,
+		ephemeralContainers: cfg.EphemeralContainers,
+	}
+	for _, v := range cfg.Variables {
+		evm.variables[v] = true
 	}
+	return evm
 }
 
-func (evm *EnvVarMutator) updateContainer(pod *corev1.Pod, index int, container *corev1.Container) (patch []PatchOperation) {
+// updateContainer creates the patch adding the missing env vars to the container at the given index of the container
+// list in basePath, e.g. /spec/initContainers.
+func (evm *EnvVarMutator) updateContainer(pod *corev1.Pod, basePath string, index int, container *corev1.Container) (patch []PatchOperation) {
 	// Create map with all environment variable names
 	envVarMap := map[string]bool{}
 	for _, envVar := range container.Env {
@@ -80,12 +192,15 @@ func (evm *EnvVarMutator) updateContainer(pod *corev1.Pod, index int, container
 	// Create a patch for each EnvVar in toInject (if they are not yet defined on the container)
 	first := len(envVarMap) == 0
 	var value interface{}
-	basePath := fmt.Sprintf("/spec/containers/%d/env", index)
+	envPath := fmt.Sprintf("%s/%d/env", basePath, index)
 
 	for _, inject := range evm.envGenerator.getVars(pod, container) {
+		if len(evm.variables) > 0 && !evm.variables[inject.Name] {
+			continue
+		}
 		if _, present := envVarMap[inject.Name]; !present {
 			value = inject
-			path := basePath
+			path := envPath
 
 			if first {
 				// For the first element we have to create the list
@@ -106,12 +221,79 @@ func (evm *EnvVarMutator) updateContainer(pod *corev1.Pod, index int, container
 	return patch
 }
 
+// Check whether the metadata env vars have to be injected into the pod, based on its annotations and the opt-in mode.
+func (evm *EnvVarMutator) mutationRequired(pod *corev1.Pod) bool {
+	if inject, err := strconv.ParseBool(pod.GetAnnotations()[annotationInjectMetadata]); err == nil {
+		return inject
+	}
+	return !evm.optIn
+}
+
+// selectedContainers returns the names of the containers listed in the newrelic.com/inject-metadata-containers
+// annotation, or nil if all the containers are selected.
+func selectedContainers(pod *corev1.Pod) map[string]bool {
+	value := strings.TrimSpace(pod.GetAnnotations()[annotationInjectMetadataContainers])
+	if value == "" {
+		return nil
+	}
+	selected := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selected[name] = true
+		}
+	}
+	return selected
+}
+
 // Mutate - update the env vars for each container in pod
 func (evm *EnvVarMutator) Mutate(pod *corev1.Pod) ([]PatchOperation, error) {
 	var patch []PatchOperation
 
+	if !evm.mutationRequired(pod) {
+		return patch, nil
+	}
+
+	selected := selectedContainers(pod)
 	for i, container := range pod.Spec.Containers {
-		patch = append(patch, evm.updateContainer(pod, i, &container)...)
+		if selected != nil && !selected[container.Name] {
+			continue
+		}
+		patch = append(patch, evm.updateContainer(pod, "/spec/containers", i, &container)...)
+	}
+
+	if evm.initContainers {
+		for i, container := range pod.Spec.InitContainers {
+			if selected != nil && !selected[container.Name] {
+				continue
+			}
+			patch = append(patch, evm.updateContainer(pod, "/spec/initContainers", i, &container)...)
+		}
+	}
+
+	return patch, nil
+}
+
+// MutateUpdate - update the env vars for the ephemeral containers added to the pod. The ones that were already present
+// in the previous version of the pod are left untouched, since their spec cannot be changed.
+func (evm *EnvVarMutator) MutateUpdate(oldPod, pod *corev1.Pod) ([]PatchOperation, error) {
+	var patch []PatchOperation
+
+	if !evm.ephemeralContainers || !evm.mutationRequired(pod) {
+		return patch, nil
+	}
+
+	existing := map[string]bool{}
+	for _, container := range oldPod.Spec.EphemeralContainers {
+		existing[container.Name] = true
+	}
+
+	selected := selectedContainers(pod)
+	for i, ephemeral := range pod.Spec.EphemeralContainers {
+		if existing[ephemeral.Name] || (selected != nil && !selected[ephemeral.Name]) {
+			continue
+		}
+		container := corev1.Container(ephemeral.EphemeralContainerCommon)
+		patch = append(patch, evm.updateContainer(pod, "/spec/ephemeralContainers", i, &container)...)
 	}
 
 	return patch, nil
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestEnvVarMutatorAnnotations(t *testing.T) {
+	cases := []struct {
+		name               string
+		optIn              bool
+		annotations        map[string]string
+		expectedContainers []string
+	}{
+		{
+			name:               "injected by default",
+			expectedContainers: []string{"c1", "c2"},
+		},
+		{
+			name:        "pod opted out",
+			annotations: map[string]string{"newrelic.com/inject-metadata": "false"},
+		},
+		{
+			name:               "invalid annotation value is ignored",
+			annotations:        map[string]string{"newrelic.com/inject-metadata": "maybe"},
+			expectedContainers: []string{"c1", "c2"},
+		},
+		{
+			name:  "opt-in mode without annotation",
+			optIn: true,
+		},
+		{
+			name:               "opt-in mode with pod opted in",
+			optIn:              true,
+			annotations:        map[string]string{"newrelic.com/inject-metadata": "true"},
+			expectedContainers: []string{"c1", "c2"},
+		},
+		{
+			name:               "selected containers",
+			annotations:        map[string]string{"newrelic.com/inject-metadata-containers": " c2 ,unknown"},
+			expectedContainers: []string{"c2"},
+		},
+		{
+			name: "selected containers of an opted out pod",
+			annotations: map[string]string{
+				"newrelic.com/inject-metadata":            "false",
+				"newrelic.com/inject-metadata-containers": "c2",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", Annotations: c.annotations},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "c1"}, {Name: "c2"}},
+				},
+			}
+			evm := newEnvVarMutatorFromConfig(clusterName, EnvVarConfig{Enabled: true, OptIn: c.optIn}, nil)
+
+			patch, err := evm.Mutate(pod)
+			require.NoError(t, err)
+
+			mutated := map[string]bool{}
+			for _, p := range patch {
+				switch {
+				case p.Path == "/spec/containers/0/env" || p.Path == "/spec/containers/0/env/-":
+					mutated["c1"] = true
+				case p.Path == "/spec/containers/1/env" || p.Path == "/spec/containers/1/env/-":
+					mutated["c2"] = true
+				}
+			}
+			var containers []string
+			for _, name := range []string{"c1", "c2"} {
+				if mutated[name] {
+					containers = append(containers, name)
+				}
+			}
+			assert.Equal(t, c.expectedContainers, containers)
+		})
+	}
+}
+
+func TestEnvVarMutatorInitContainers(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "migrations", Env: []corev1.EnvVar{{Name: "NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", Value: "other"}}},
+				{Name: "bootstrap"},
+			},
+			Containers: []corev1.Container{{Name: "c1"}},
+		},
+	}
+
+	evm := newEnvVarMutatorFromConfig(clusterName, EnvVarConfig{Enabled: true, Variables: []string{
+		"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+		"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME",
+	}}, nil)
+	patch, err := evm.Mutate(pod)
+	require.NoError(t, err)
+	assert.Len(t, patch, 2, "init containers are not injected by default")
+
+	evm = newEnvVarMutatorFromConfig(clusterName, EnvVarConfig{Enabled: true, InitContainers: true, Variables: []string{
+		"NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME",
+		"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME",
+	}}, nil)
+	patch, err = evm.Mutate(pod)
+	require.NoError(t, err)
+
+	expected := []PatchOperation{
+		{Op: "add", Path: "/spec/containers/0/env", Value: []corev1.EnvVar{createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", clusterName)}},
+		{Op: "add", Path: "/spec/containers/0/env/-", Value: createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", "c1")},
+		// The env list of the first init container already exists and the cluster name is not overridden.
+		{Op: "add", Path: "/spec/initContainers/0/env/-", Value: createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", "migrations")},
+		{Op: "add", Path: "/spec/initContainers/1/env", Value: []corev1.EnvVar{createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CLUSTER_NAME", clusterName)}},
+		{Op: "add", Path: "/spec/initContainers/1/env/-", Value: createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", "bootstrap")},
+	}
+	assert.Equal(t, expected, patch)
+}
+
+func TestEnvVarMutatorMutateUpdate(t *testing.T) {
+	debugger := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"}}
+	oldPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers:          []corev1.Container{{Name: "c1"}},
+			EphemeralContainers: []corev1.EphemeralContainer{debugger},
+		},
+	}
+	pod := oldPod.DeepCopy()
+	pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers,
+		corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger-2", Image: "busybox"}})
+
+	cfg := EnvVarConfig{Enabled: true, Variables: []string{"NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME"}}
+	patch, err := newEnvVarMutatorFromConfig(clusterName, cfg, nil).MutateUpdate(oldPod, pod)
+	require.NoError(t, err)
+	assert.Empty(t, patch, "ephemeral containers are not injected by default")
+
+	cfg.EphemeralContainers = true
+	patch, err = newEnvVarMutatorFromConfig(clusterName, cfg, nil).MutateUpdate(oldPod, pod)
+	require.NoError(t, err)
+	assert.Equal(t, []PatchOperation{{
+		Op:    "add",
+		Path:  "/spec/ephemeralContainers/1/env",
+		Value: []corev1.EnvVar{createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_CONTAINER_NAME", "debugger-2")},
+	}}, patch)
+}
+
+type dummyOwnerRetriever struct {
+	controllers map[string]*metav1.OwnerReference
+}
+
+func (dor *dummyOwnerRetriever) ControllerOf(namespace, kind, name string) (*metav1.OwnerReference, error) {
+	controller, ok := dor.controllers[namespace+"/"+kind+"/"+name]
+	if !ok {
+		return nil, k8s_errors.NewNotFound(schema.GroupResource{}, name)
+	}
+	return controller, nil
+}
+
+func TestMetadataEnvGeneratorOwners(t *testing.T) {
+	ownerRtrv := &dummyOwnerRetriever{controllers: map[string]*metav1.OwnerReference{
+		"default/ReplicaSet/web-6f9c8d7b4": {Kind: "Deployment", Name: "web"},
+		"default/ReplicaSet/raw-rs":        nil,
+		"default/Job/backup-28311840":      {Kind: "CronJob", Name: "backup"},
+		"default/Job/migration":            nil,
+	}}
+
+	controller := true
+	cases := []struct {
+		name         string
+		generateName string
+		owners       []metav1.OwnerReference
+		ownerRtrv    ownerRetriever
+		expected     map[string]string
+	}{
+		{
+			name:         "deployment resolved through the replica set",
+			generateName: "web-6f9c8d7b4-",
+			owners:       []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-6f9c8d7b4", Controller: &controller}},
+			ownerRtrv:    ownerRtrv,
+			expected:     map[string]string{"NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME": "web"},
+		},
+		{
+			name:         "replica set without deployment",
+			generateName: "raw-rs-",
+			owners:       []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "raw-rs"}},
+			ownerRtrv:    ownerRtrv,
+			expected:     map[string]string{},
+		},
+		{
+			name:         "deployment guessed when the replica set is not found",
+			generateName: "unknown-6f9c8d7b4-",
+			owners:       []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "unknown-6f9c8d7b4"}},
+			ownerRtrv:    ownerRtrv,
+			expected:     map[string]string{"NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME": "unknown"},
+		},
+		{
+			name:         "deployment guessed without owner lookup",
+			generateName: "web-6f9c8d7b4-",
+			owners:       []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "web-6f9c8d7b4"}},
+			expected:     map[string]string{"NEW_RELIC_METADATA_KUBERNETES_DEPLOYMENT_NAME": "web"},
+		},
+		{
+			name:      "cron job resolved through the job",
+			owners:    []metav1.OwnerReference{{Kind: "Job", Name: "backup-28311840", Controller: &controller}},
+			ownerRtrv: ownerRtrv,
+			expected: map[string]string{
+				"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME":     "backup-28311840",
+				"NEW_RELIC_METADATA_KUBERNETES_CRONJOB_NAME": "backup",
+			},
+		},
+		{
+			name:      "job without cron job",
+			owners:    []metav1.OwnerReference{{Kind: "Job", Name: "migration"}},
+			ownerRtrv: ownerRtrv,
+			expected:  map[string]string{"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME": "migration"},
+		},
+		{
+			name:      "cron job guessed when the job is not found",
+			owners:    []metav1.OwnerReference{{Kind: "Job", Name: "report-28311845", Controller: &controller}},
+			ownerRtrv: ownerRtrv,
+			expected: map[string]string{
+				"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME":     "report-28311845",
+				"NEW_RELIC_METADATA_KUBERNETES_CRONJOB_NAME": "report",
+			},
+		},
+		{
+			name:     "cron job not guessed without owner lookup",
+			owners:   []metav1.OwnerReference{{Kind: "Job", Name: "backup-28311840", Controller: &controller}},
+			expected: map[string]string{"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME": "backup-28311840"},
+		},
+		{
+			name:      "job not found with a short numeric suffix",
+			owners:    []metav1.OwnerReference{{Kind: "Job", Name: "migrate-2024"}},
+			ownerRtrv: ownerRtrv,
+			expected:  map[string]string{"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME": "migrate-2024"},
+		},
+		{
+			name:      "job not found without scheduled time",
+			owners:    []metav1.OwnerReference{{Kind: "Job", Name: "adhoc-run"}},
+			ownerRtrv: ownerRtrv,
+			expected:  map[string]string{"NEW_RELIC_METADATA_KUBERNETES_JOB_NAME": "adhoc-run"},
+		},
+		{
+			name: "controller picked among several owners",
+			owners: []metav1.OwnerReference{
+				{Kind: "ConfigMap", Name: "foo"},
+				{Kind: "StatefulSet", Name: "db", Controller: &controller},
+			},
+			expected: map[string]string{"NEW_RELIC_METADATA_KUBERNETES_STATEFULSET_NAME": "db"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", GenerateName: c.generateName, OwnerReferences: c.owners},
+			}
+			generator := &metadataEnvGenerator{clusterName: clusterName, ownerRtrv: c.ownerRtrv}
+
+			got := map[string]string{}
+			for _, v := range generator.getVars(pod, &corev1.Container{Name: "c1"}) {
+				if strings.HasSuffix(v.Name, "DEPLOYMENT_NAME") || strings.HasSuffix(v.Name, "JOB_NAME") ||
+					strings.HasSuffix(v.Name, "STATEFULSET_NAME") || strings.HasSuffix(v.Name, "DAEMONSET_NAME") {
+					got[v.Name] = v.Value
+				}
+			}
+			assert.Equal(t, c.expected, got)
+		})
+	}
+}
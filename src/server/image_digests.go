@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDigestCacheTTL is how long the resolved digests are cached by default.
+	defaultDigestCacheTTL = 10 * time.Minute
+	// digestRetryInterval is how long a digest that could not be resolved is not asked again to the registry.
+	digestRetryInterval = time.Minute
+	// digestResolveTimeout bounds the requests to the registry, which are made while the pod is admitted.
+	digestResolveTimeout = 3 * time.Second
+	// dockerHubRegistryHost is the host serving the registry API of Docker Hub.
+	dockerHubRegistryHost = "registry-1.docker.io"
+)
+
+// manifestMediaTypes are the manifests the registry can answer with. The digest of a multi-arch image is the one of its
+// index, so it is pulled for the architecture of the node.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var (
+	digestRegexp         = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+	challengeParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// digestResolver resolves the tags of the images to the digest of their manifest with a HEAD request to their
+// registry, as the container runtimes do before pulling them. Registries asking for a bearer token are sent an
+// anonymous one, so only public images are resolved. The digests are cached, as well as the failures for a shorter
+// time, so the registry is not asked for every pod.
+type digestResolver struct {
+	client *http.Client
+	ttl    time.Duration
+	now    func() time.Time
+	// scheme of the registry API, only changed by the tests.
+	scheme string
+
+	sync.Mutex
+	cache map[string]resolvedDigest
+}
+
+type resolvedDigest struct {
+	digest  string
+	err     error
+	expires time.Time
+}
+
+func newDigestResolver(ttl time.Duration) *digestResolver {
+	return &digestResolver{
+		client: &http.Client{Timeout: digestResolveTimeout},
+		ttl:    ttl,
+		now:    time.Now,
+		scheme: "https",
+		cache:  map[string]resolvedDigest{},
+	}
+}
+
+// resolve returns the digest the tag of the image points to. Images without a tag are resolved as latest.
+func (r *digestResolver) resolve(ref imageRef) (string, error) {
+	if ref.tag == "" {
+		ref.tag = "latest"
+	}
+	ref.digest = ""
+	key := ref.String()
+
+	r.Lock()
+	cached, ok := r.cache[key]
+	r.Unlock()
+	if ok && r.now().Before(cached.expires) {
+		return cached.digest, cached.err
+	}
+
+	digest, err := r.fetch(ref)
+	cached = resolvedDigest{digest: digest, err: err, expires: r.now().Add(r.ttl)}
+	if err != nil && r.ttl > digestRetryInterval {
+		cached.expires = r.now().Add(digestRetryInterval)
+	}
+	r.Lock()
+	r.cache[key] = cached
+	r.Unlock()
+	return digest, err
+}
+
+// fetch asks the digest of the manifest of the image to its registry.
+func (r *digestResolver) fetch(ref imageRef) (string, error) {
+	host := ref.registry
+	if host == dockerHubRegistry {
+		host = dockerHubRegistryHost
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", r.scheme, host, ref.repository, ref.tag)
+
+	resp, err := r.headManifest(manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := r.token(resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+		if resp, err = r.headManifest(manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry answered %s", resp.Status)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !digestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("registry answered an invalid digest '%s'", digest)
+	}
+	return digest, nil
+}
+
+func (r *digestResolver) headManifest(manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, mediaType := range manifestMediaTypes {
+		req.Header.Add("Accept", mediaType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return resp, nil
+}
+
+// token returns an anonymous token from the authorization server of the bearer challenge of the registry.
+func (r *digestResolver) token(challenge string) (string, error) {
+	params := map[string]string{}
+	for _, match := range challengeParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry asked for credentials")
+	}
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm '%s': %v", params["realm"], err)
+	}
+	query := tokenURL.Query()
+	for _, name := range []string{"service", "scope"} {
+		if params[name] != "" {
+			query.Set(name, params[name])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	resp, err := r.client.Get(tokenURL.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server answered %s", resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("token server answered without a token")
+}
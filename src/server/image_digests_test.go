@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDigest = "sha256:2cd1d93b0d3c6d8f7dc3e8b1e0d4b4f1f6c0a1b3e5d7f9a1b3c5d7e9f1a3b5c7"
+
+// fakeRegistry serves the manifest of newrelic/nri-redis:1.2.0 to the clients presenting the token of its token server.
+func fakeRegistry(t *testing.T) (*httptest.Server, *int32) {
+	var manifestRequests int32
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			assert.Equal(t, "registry.test", r.URL.Query().Get("service"))
+			assert.Equal(t, "repository:newrelic/nri-redis:pull", r.URL.Query().Get("scope"))
+			_, _ = fmt.Fprint(w, `{"token":"anonymous"}`)
+		case strings.HasPrefix(r.URL.Path, "/v2/"):
+			atomic.AddInt32(&manifestRequests, 1)
+			assert.Equal(t, http.MethodHead, r.Method)
+			assert.Contains(t, r.Header.Values("Accept"), "application/vnd.oci.image.index.v1+json")
+			if r.Header.Get("Authorization") != "Bearer anonymous" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry.test",scope="repository:newrelic/nri-redis:pull"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Path != "/v2/newrelic/nri-redis/manifests/1.2.0" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", testDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &manifestRequests
+}
+
+func testDigestResolver(server *httptest.Server, now *time.Time) *digestResolver {
+	r := newDigestResolver(10 * time.Minute)
+	r.client = server.Client()
+	r.now = func() time.Time { return *now }
+	return r
+}
+
+func TestDigestResolverResolve(t *testing.T) {
+	server, manifestRequests := fakeRegistry(t)
+	now := time.Now()
+	r := testDigestResolver(server, &now)
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	digest, err := r.resolve(parseImage(registry + "/newrelic/nri-redis:1.2.0"))
+	require.NoError(t, err)
+	assert.Equal(t, testDigest, digest)
+	// Anonymous request and retry with the token.
+	assert.Equal(t, int32(2), atomic.LoadInt32(manifestRequests))
+
+	_, err = r.resolve(parseImage(registry + "/newrelic/nri-redis:1.1.0"))
+	assert.EqualError(t, err, "registry answered 404 Not Found")
+}
+
+func TestDigestResolverCache(t *testing.T) {
+	server, manifestRequests := fakeRegistry(t)
+	now := time.Now()
+	r := testDigestResolver(server, &now)
+	image := parseImage(strings.TrimPrefix(server.URL, "https://") + "/newrelic/nri-redis:1.2.0")
+
+	_, err := r.resolve(image)
+	require.NoError(t, err)
+	now = now.Add(9 * time.Minute)
+	digest, err := r.resolve(image)
+	require.NoError(t, err)
+	assert.Equal(t, testDigest, digest)
+	assert.Equal(t, int32(2), atomic.LoadInt32(manifestRequests), "cached digest asked again")
+
+	now = now.Add(2 * time.Minute)
+	_, err = r.resolve(image)
+	require.NoError(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(manifestRequests), "expired digest not asked again")
+
+	// Failures are retried sooner.
+	missing := parseImage(strings.TrimPrefix(server.URL, "https://") + "/newrelic/nri-redis:1.1.0")
+	_, err = r.resolve(missing)
+	require.Error(t, err)
+	_, err = r.resolve(missing)
+	require.Error(t, err)
+	assert.Equal(t, int32(6), atomic.LoadInt32(manifestRequests), "failure asked again right away")
+	now = now.Add(digestRetryInterval)
+	_, err = r.resolve(missing)
+	require.Error(t, err)
+	assert.Equal(t, int32(8), atomic.LoadInt32(manifestRequests), "failure not retried")
+}
+
+func TestResolveImageDigest(t *testing.T) {
+	server, _ := fakeRegistry(t)
+	now := time.Now()
+	r := testDigestResolver(server, &now)
+	registry := strings.TrimPrefix(server.URL, "https://")
+
+	policy := ImagePolicyConfig{
+		AllowedRepositories: []string{"newrelic/*"},
+		PinnedTags:          map[string]string{"newrelic/nri-redis": "1.2.0"},
+		RegistryMirrors:     map[string]string{"docker.io": registry},
+	}
+
+	image, warning, err := policy.resolve("newrelic/nri-redis", r)
+	require.NoError(t, err)
+	assert.Empty(t, warning)
+	assert.Equal(t, registry+"/newrelic/nri-redis:1.2.0@"+testDigest, image)
+
+	// The pinned digest wins over the resolved one.
+	policy.PinnedDigests = map[string]string{"newrelic/nri-redis:1.2.0": "sha256:abc"}
+	image, warning, err = policy.resolve("newrelic/nri-redis", r)
+	require.NoError(t, err)
+	assert.Empty(t, warning)
+	assert.Equal(t, registry+"/newrelic/nri-redis:1.2.0@sha256:abc", image)
+
+	// Images whose digest cannot be resolved are pulled by tag.
+	image, warning, err = policy.resolve("newrelic/nri-redis:1.1.0", r)
+	require.NoError(t, err)
+	assert.Equal(t, registry+"/newrelic/nri-redis:1.1.0", image)
+	assert.Equal(t, "digest of image '"+registry+"/newrelic/nri-redis:1.1.0' not resolved, it is pulled by tag: registry answered 404 Not Found", warning)
+}
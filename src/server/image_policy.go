@@ -0,0 +1,259 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const dockerHubRegistry = "docker.io"
+
+// defaultAllowedRepositories are the repositories the sidecar images can come from by default.
+var defaultAllowedRepositories = []string{"newrelic/*"}
+
+// ImagePolicyConfig restricts and rewrites the images of the injected sidecars.
+type ImagePolicyConfig struct {
+	// AllowedRepositories are the repositories the sidecar images can come from, as path patterns such as
+	// docker.io/newrelic/* or newrelic/nri-*. A pattern ending in /* matches any repository under that path, and * any
+	// repository. Images from other repositories are not injected. It defaults to the New Relic repositories. The
+	// repositories of the configured images, i.e. the image of the sidecar and the integration images, are always
+	// allowed.
+	AllowedRepositories []string `json:"allowedRepositories"`
+	// IntegrationImages maps the integration_name of the integration config to the image used when the pod does not set
+	// the newrelic.com/integrations-sidecar-imagename annotation.
+	IntegrationImages map[string]string `json:"integrationImages,omitempty"`
+	// PinnedTags maps repositories to the tag used for images without a tag or with the latest tag.
+	PinnedTags map[string]string `json:"pinnedTags,omitempty"`
+	// PinnedDigests maps images, as repository:tag, to the digest they are pulled by. They win over the resolved
+	// digests, and have to be updated with the tags they belong to.
+	PinnedDigests map[string]string `json:"pinnedDigests,omitempty"`
+	// ResolveDigests pulls the images by the digest their tag points to when the sidecar is injected, as answered by
+	// their registry, so the tag cannot be moved to another image afterwards. When the registry cannot be reached, the
+	// image is pulled by tag with a warning.
+	ResolveDigests bool `json:"resolveDigests"`
+	// DigestCacheTTL is how long the resolved digests are cached. Defaults to 10m.
+	DigestCacheTTL *metav1.Duration `json:"digestCacheTTL,omitempty"`
+	// RegistryMirrors maps registries, e.g. docker.io, to the registry or path prefix the images are pulled from
+	// instead, e.g. for air-gapped clusters.
+	RegistryMirrors map[string]string `json:"registryMirrors,omitempty"`
+}
+
+// DeepCopy returns a copy of the image policy that does not share any reference with the original one.
+func (p ImagePolicyConfig) DeepCopy() ImagePolicyConfig {
+	out := ImagePolicyConfig{AllowedRepositories: append([]string(nil), p.AllowedRepositories...)}
+	out.IntegrationImages = copyStringMap(p.IntegrationImages)
+	out.PinnedTags = copyStringMap(p.PinnedTags)
+	out.PinnedDigests = copyStringMap(p.PinnedDigests)
+	out.RegistryMirrors = copyStringMap(p.RegistryMirrors)
+	out.ResolveDigests = p.ResolveDigests
+	if p.DigestCacheTTL != nil {
+		ttl := *p.DigestCacheTTL
+		out.DigestCacheTTL = &ttl
+	}
+	return out
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// ImageNotAllowedErr is returned when the sidecar image does not match the allowed repositories.
+type ImageNotAllowedErr struct {
+	image string
+}
+
+// Error returns the error message.
+func (e ImageNotAllowedErr) Error() string {
+	return fmt.Sprintf("image '%s' is not allowed", e.image)
+}
+
+// Image returns the image that is not allowed.
+func (e ImageNotAllowedErr) Image() string {
+	return e.image
+}
+
+// imageRef is a parsed container image reference.
+type imageRef struct {
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// parseImage parses an image reference, normalizing Docker Hub images the way the container runtimes do, e.g. nginx
+// is docker.io/library/nginx.
+func parseImage(image string) imageRef {
+	var ref imageRef
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.tag = name[:i], name[i+1:]
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.registry, ref.repository = parts[0], parts[1]
+	} else {
+		ref.registry, ref.repository = dockerHubRegistry, name
+	}
+	if ref.registry == dockerHubRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	return ref
+}
+
+// name returns the repository of the image including its registry.
+func (r imageRef) name() string {
+	return r.registry + "/" + r.repository
+}
+
+// String returns the full image reference.
+func (r imageRef) String() string {
+	s := r.name()
+	if r.tag != "" {
+		s += ":" + r.tag
+	}
+	if r.digest != "" {
+		s += "@" + r.digest
+	}
+	return s
+}
+
+// allowed returns whether the repository of the image matches one of the patterns. Patterns without a registry match
+// Docker Hub images, as image references do, and * matches any image.
+func (r imageRef) allowed(patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+		p := parseImage(pattern)
+		full := p.name()
+		if strings.HasSuffix(full, "/*") {
+			if strings.HasPrefix(r.name(), strings.TrimSuffix(full, "*")) {
+				return true
+			}
+			continue
+		}
+		if ok, err := path.Match(full, r.name()); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pinnedTag returns the tag the repository of the image is pinned to. Repositories can be written with or without the
+// registry and the library/ prefix of Docker Hub images.
+func (p ImagePolicyConfig) pinnedTag(ref imageRef) (string, bool) {
+	for repository, tag := range p.PinnedTags {
+		if parseImage(repository).name() == ref.name() {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+// pinnedDigest returns the digest the image is pinned to.
+func (p ImagePolicyConfig) pinnedDigest(ref imageRef) (string, bool) {
+	for image, digest := range p.PinnedDigests {
+		if key := parseImage(image); key.name() == ref.name() && key.tag == ref.tag {
+			return digest, true
+		}
+	}
+	return "", false
+}
+
+// warnings returns the pinned tags without a pinned digest when the digests are not resolved. They are pulled by tag,
+// which can be moved to another image, or were updated without updating their digest.
+func (p ImagePolicyConfig) warnings() []string {
+	if p.ResolveDigests {
+		return nil
+	}
+	var warnings []string
+	for repository, tag := range p.PinnedTags {
+		ref := parseImage(repository)
+		ref.tag = tag
+		if _, ok := p.pinnedDigest(ref); !ok {
+			warnings = append(warnings, fmt.Sprintf("sidecarMutator.imagePolicy.pinnedTags: %s:%s has no pinned digest, it is pulled by tag", repository, tag))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// integrationImage returns the default image of the first integration that has one.
+func (p ImagePolicyConfig) integrationImage(integrationNames []string) string {
+	for _, name := range integrationNames {
+		if image, ok := p.IntegrationImages[name]; ok {
+			return image
+		}
+	}
+	return ""
+}
+
+// withImages returns a copy of the policy allowing the repositories of the given images as well.
+func (p ImagePolicyConfig) withImages(images ...string) ImagePolicyConfig {
+	out := p.DeepCopy()
+	for _, image := range images {
+		if image != "" {
+			out.AllowedRepositories = append(out.AllowedRepositories, parseImage(image).name())
+		}
+	}
+	return out
+}
+
+// resolve checks that the image is allowed and returns the reference the sidecar should be created with: its tag is
+// pinned when it is missing or latest, its digest is set if pinned or resolved with the digests resolver, when not nil,
+// and its registry is replaced by its mirror. The warning tells why the digest could not be resolved.
+func (p ImagePolicyConfig) resolve(image string, digests *digestResolver) (string, string, error) {
+	ref := parseImage(image)
+	if !ref.allowed(p.AllowedRepositories) {
+		return "", "", &ImageNotAllowedErr{image: image}
+	}
+	if ref.digest == "" && (ref.tag == "" || ref.tag == "latest") {
+		if tag, ok := p.pinnedTag(ref); ok {
+			ref.tag = tag
+		}
+	}
+	if ref.digest == "" && ref.tag != "" {
+		if digest, ok := p.pinnedDigest(ref); ok {
+			ref.digest = digest
+		}
+	}
+
+	mirror, mirrored := p.RegistryMirrors[ref.registry]
+	mirror = strings.TrimSuffix(mirror, "/")
+	var warning string
+	if ref.digest == "" && digests != nil {
+		// The digest is asked to the registry the image is pulled from.
+		pulled := ref
+		if mirrored {
+			pulled = parseImage(mirror + "/" + strings.TrimPrefix(ref.String(), ref.registry+"/"))
+		}
+		digest, err := digests.resolve(pulled)
+		if err != nil {
+			warning = fmt.Sprintf("digest of image '%s' not resolved, it is pulled by tag: %v", pulled.String(), err)
+		}
+		ref.digest = digest
+	}
+
+	if mirrored {
+		return mirror + "/" + strings.TrimPrefix(ref.String(), ref.registry+"/"), warning, nil
+	}
+	if parseImage(image) == ref {
+		// Keep the image as written when nothing changed, e.g. nginx instead of docker.io/library/nginx.
+		return image, warning, nil
+	}
+	return ref.String(), warning, nil
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseImage(t *testing.T) {
+	cases := []struct {
+		image    string
+		expected imageRef
+	}{
+		{"nginx", imageRef{registry: "docker.io", repository: "library/nginx"}},
+		{"newrelic/nri-redis:1.2.0", imageRef{registry: "docker.io", repository: "newrelic/nri-redis", tag: "1.2.0"}},
+		{"quay.io/newrelic/nri-redis@sha256:abc", imageRef{registry: "quay.io", repository: "newrelic/nri-redis", digest: "sha256:abc"}},
+		{"localhost:5000/nri-redis:1.2.0", imageRef{registry: "localhost:5000", repository: "nri-redis", tag: "1.2.0"}},
+		{"localhost/nri-redis", imageRef{registry: "localhost", repository: "nri-redis"}},
+		{"docker.io/nginx:1.19@sha256:abc", imageRef{registry: "docker.io", repository: "library/nginx", tag: "1.19", digest: "sha256:abc"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.image, func(t *testing.T) {
+			assert.Equal(t, c.expected, parseImage(c.image))
+		})
+	}
+}
+
+func TestImageAllowed(t *testing.T) {
+	patterns := []string{"newrelic/*", "quay.io/newrelic/nri-*", "nginx"}
+
+	cases := []struct {
+		image   string
+		allowed bool
+	}{
+		{"newrelic/nri-redis:1.2.0", true},
+		{"docker.io/newrelic/infrastructure-k8s", true},
+		{"quay.io/newrelic/nri-redis", true},
+		{"quay.io/newrelic/infrastructure", false},
+		{"nginx:latest", true},
+		{"evil/newrelic", false},
+		{"newrelic-evil/nri-redis", false},
+		{"registry.example.com/newrelic/nri-redis", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.image, func(t *testing.T) {
+			assert.Equal(t, c.allowed, parseImage(c.image).allowed(patterns))
+		})
+	}
+	assert.False(t, parseImage("evil/newrelic").allowed(nil))
+	assert.True(t, parseImage("evil/newrelic").allowed([]string{"*"}))
+}
+
+func TestResolveImage(t *testing.T) {
+	policy := ImagePolicyConfig{
+		AllowedRepositories: []string{"newrelic/*"},
+		PinnedTags: map[string]string{
+			"newrelic/nri-redis": "1.2.0",
+		},
+		PinnedDigests: map[string]string{
+			"docker.io/newrelic/nri-redis:1.2.0": "sha256:abc",
+		},
+	}
+
+	cases := []struct {
+		desc     string
+		mirrors  map[string]string
+		image    string
+		expected string
+	}{
+		{
+			desc:     "unchanged",
+			image:    "newrelic/nri-nginx:1.3.0",
+			expected: "newrelic/nri-nginx:1.3.0",
+		},
+		{
+			desc:     "missing tag is pinned",
+			image:    "newrelic/nri-redis",
+			expected: "docker.io/newrelic/nri-redis:1.2.0@sha256:abc",
+		},
+		{
+			desc:     "latest tag is pinned",
+			image:    "newrelic/nri-redis:latest",
+			expected: "docker.io/newrelic/nri-redis:1.2.0@sha256:abc",
+		},
+		{
+			desc:     "explicit tag is kept",
+			image:    "newrelic/nri-redis:1.1.0",
+			expected: "newrelic/nri-redis:1.1.0",
+		},
+		{
+			desc:     "explicit digest is kept",
+			image:    "newrelic/nri-redis@sha256:def",
+			expected: "newrelic/nri-redis@sha256:def",
+		},
+		{
+			desc:     "registry mirror",
+			mirrors:  map[string]string{"docker.io": "registry.example.com/mirror/"},
+			image:    "newrelic/nri-nginx:1.3.0",
+			expected: "registry.example.com/mirror/newrelic/nri-nginx:1.3.0",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			p := policy.DeepCopy()
+			p.RegistryMirrors = c.mirrors
+			image, warning, err := p.resolve(c.image, nil)
+			require.NoError(t, err)
+			assert.Empty(t, warning)
+			assert.Equal(t, c.expected, image)
+		})
+	}
+
+	_, _, err := policy.resolve("evil/nri-redis", nil)
+	nErr, ok := err.(*ImageNotAllowedErr)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.Equal(t, "evil/nri-redis", nErr.Image())
+}
+
+func TestImagePolicyWarnings(t *testing.T) {
+	policy := ImagePolicyConfig{
+		PinnedTags: map[string]string{
+			"newrelic/nri-redis": "1.2.0",
+			"newrelic/nri-nginx": "1.4.0",
+		},
+		PinnedDigests: map[string]string{
+			"docker.io/newrelic/nri-redis:1.2.0": "sha256:abc",
+			"newrelic/nri-nginx:1.3.0":           "sha256:def",
+		},
+	}
+	assert.Equal(t, []string{
+		"sidecarMutator.imagePolicy.pinnedTags: newrelic/nri-nginx:1.4.0 has no pinned digest, it is pulled by tag",
+	}, policy.warnings())
+
+	cfg := DefaultConfig()
+	cfg.SidecarMutator.ImagePolicy = policy
+	assert.Len(t, cfg.Warnings(), 1)
+	cfg.SidecarMutator.Enabled = false
+	assert.Empty(t, cfg.Warnings())
+}
+
+func TestCreateSidecarIntegrationImage(t *testing.T) {
+	cfg := defaultSidecarConfig()
+	cfg.Image = "newrelic/nri-default:1.0.0"
+	cfg.ImagePolicy = ImagePolicyConfig{
+		AllowedRepositories: []string{"newrelic/custom"},
+		IntegrationImages:   map[string]string{"com.newrelic.nginx": "newrelic/nri-nginx:1.3.0"},
+	}
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{
+		ConfigMaps: configMapsRetriever{
+			configName: {configKey: integrationConfig},
+			"other":    {configKey: "integration_name: com.newrelic.other\ninstances:\n  - name: other\n    command: metrics"},
+		},
+	})
+
+	cases := []struct {
+		desc        string
+		annotations map[string]string
+		expected    string
+	}{
+		{
+			desc:        "integration image",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName},
+			expected:    "newrelic/nri-nginx:1.3.0",
+		},
+		{
+			desc:        "annotation wins",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName, annotationIntegrationImage: "newrelic/custom:2.0.0"},
+			expected:    "newrelic/custom:2.0.0",
+		},
+		{
+			desc:        "configured image",
+			annotations: map[string]string{annotationIntegrationConfigKey: "other"},
+			expected:    "newrelic/nri-default:1.0.0",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Annotations: c.annotations},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			}
+			containers, _, _, err := sm.createSidecar(pod)
+			require.NoError(t, err)
+			require.Len(t, containers, 1)
+			assert.Equal(t, c.expected, containers[0].Image)
+		})
+	}
+}
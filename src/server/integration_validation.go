@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultIntegrationsBinDir is where the integrations binaries are installed in the infrastructure agent images.
+const defaultIntegrationsBinDir = "/var/db/newrelic-infra/newrelic-integrations/bin/"
+
+// IntegrationConfigInvalidErr is returned in strict validation mode when the integration config of a pod is not valid.
+type IntegrationConfigInvalidErr struct {
+	source   string
+	problems []string
+}
+
+// Error returns the error message.
+func (e IntegrationConfigInvalidErr) Error() string {
+	return fmt.Sprintf("invalid integration config %s: %s", e.source, strings.Join(e.problems, "; "))
+}
+
+// Problems returns the validation problems found in the integration config.
+func (e IntegrationConfigInvalidErr) Problems() []string {
+	return e.problems
+}
+
+// integrationConfigFile is the config.yaml file of an integration, in either the legacy format, with the
+// integration_name and its instances, or the format of the integrations run with exec.
+type integrationConfigFile struct {
+	IntegrationName string `yaml:"integration_name"`
+	Instances       []struct {
+		Name    string `yaml:"name"`
+		Command string `yaml:"command"`
+	} `yaml:"instances"`
+	Integrations []struct {
+		Name     string      `yaml:"name"`
+		Exec     interface{} `yaml:"exec"`
+		Interval interface{} `yaml:"interval"`
+	} `yaml:"integrations"`
+}
+
+// integrationDefinitionFile is the definition.yaml file of an integration.
+type integrationDefinitionFile struct {
+	Name     string `yaml:"name"`
+	Commands map[string]struct {
+		Command  []string    `yaml:"command"`
+		Interval interface{} `yaml:"interval"`
+	} `yaml:"commands"`
+}
+
+// integrationBinaryPrefixes returns the path prefixes the integration commands are allowed to run from: the bin
+// directory next to the definition, and the integrations bin directories of the agent.
+func integrationBinaryPrefixes(agentDir string, configured []string) []string {
+	if len(configured) > 0 {
+		return configured
+	}
+	return []string{"./bin/", defaultIntegrationsBinDir, path.Join(agentDir, "newrelic-integrations", "bin") + "/"}
+}
+
+// validateIntegrationConfig checks the config.yaml and definition.yaml files of an integration, returning the
+// problems found. The definition is optional, as the sidecar image can provide it.
+func validateIntegrationConfig(data map[string]string, binaryPrefixes []string) []string {
+	var problems []string
+
+	var cfg integrationConfigFile
+	if err := yaml.Unmarshal([]byte(data[configKey]), &cfg); err != nil {
+		return []string{fmt.Sprintf("%s: %v", configKey, err)}
+	}
+
+	if len(cfg.Integrations) > 0 {
+		for i, integration := range cfg.Integrations {
+			if integration.Name == "" && integration.Exec == nil {
+				problems = append(problems, fmt.Sprintf("%s: integrations[%d] requires a name or exec", configKey, i))
+			}
+			if integration.Interval != nil && !validInterval(integration.Interval, true) {
+				problems = append(problems, fmt.Sprintf("%s: integrations[%d].interval must be a duration, got %v",
+					configKey, i, integration.Interval))
+			}
+		}
+		return problems
+	}
+
+	if cfg.IntegrationName == "" {
+		problems = append(problems, fmt.Sprintf("%s: integration_name is required", configKey))
+	}
+	if len(cfg.Instances) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: at least one instance is required", configKey))
+	}
+	for i, inst := range cfg.Instances {
+		if inst.Name == "" {
+			problems = append(problems, fmt.Sprintf("%s: instances[%d].name is required", configKey, i))
+		}
+		if inst.Command == "" {
+			problems = append(problems, fmt.Sprintf("%s: instances[%d].command is required", configKey, i))
+		}
+	}
+
+	definition, ok := data[definitionKey]
+	if !ok {
+		return problems
+	}
+	var def integrationDefinitionFile
+	if err := yaml.Unmarshal([]byte(definition), &def); err != nil {
+		return append(problems, fmt.Sprintf("%s: %v", definitionKey, err))
+	}
+
+	if def.Name == "" {
+		problems = append(problems, fmt.Sprintf("%s: name is required", definitionKey))
+	} else if cfg.IntegrationName != "" && def.Name != cfg.IntegrationName {
+		problems = append(problems, fmt.Sprintf("%s: name %s does not match integration_name %s",
+			definitionKey, def.Name, cfg.IntegrationName))
+	}
+	if len(def.Commands) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: at least one command is required", definitionKey))
+	}
+	commands := make([]string, 0, len(def.Commands))
+	for name := range def.Commands {
+		commands = append(commands, name)
+	}
+	sort.Strings(commands)
+	for _, name := range commands {
+		cmd := def.Commands[name]
+		if len(cmd.Command) == 0 {
+			problems = append(problems, fmt.Sprintf("%s: commands.%s.command is required", definitionKey, name))
+		} else if !hasAnyPrefix(cmd.Command[0], binaryPrefixes) {
+			problems = append(problems, fmt.Sprintf("%s: commands.%s runs %s, which is not under %s",
+				definitionKey, name, cmd.Command[0], strings.Join(binaryPrefixes, ", ")))
+		}
+		if cmd.Interval != nil && !validInterval(cmd.Interval, false) {
+			problems = append(problems, fmt.Sprintf("%s: commands.%s.interval must be a number of seconds, got %v",
+				definitionKey, name, cmd.Interval))
+		}
+	}
+	for i, inst := range cfg.Instances {
+		if _, ok := def.Commands[inst.Command]; inst.Command != "" && len(def.Commands) > 0 && !ok {
+			problems = append(problems, fmt.Sprintf("%s: instances[%d].command %s is not defined in %s",
+				configKey, i, inst.Command, definitionKey))
+		}
+	}
+	return problems
+}
+
+// validInterval returns whether the interval is a positive number of seconds or, if durations are allowed, a positive
+// duration string.
+func validInterval(interval interface{}, durations bool) bool {
+	switch v := interval.(type) {
+	case int:
+		return v > 0
+	case string:
+		if !durations {
+			return false
+		}
+		d, err := time.ParseDuration(v)
+		return err == nil && d > 0
+	}
+	return false
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
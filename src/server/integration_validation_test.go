@@ -0,0 +1,106 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateIntegrationConfig(t *testing.T) {
+	const nginxConfig = `integration_name: com.newrelic.nginx
+instances:
+  - name: nginx-server-metrics
+    command: metrics
+    arguments:
+      status_url: http://127.0.0.1/status`
+
+	cases := []struct {
+		desc         string
+		data         map[string]string
+		wantProblems []string
+	}{
+		{
+			desc: "valid config without definition",
+			data: map[string]string{configKey: nginxConfig},
+		},
+		{
+			desc: "valid config and definition",
+			data: map[string]string{
+				configKey: nginxConfig,
+				definitionKey: `name: com.newrelic.nginx
+commands:
+  metrics:
+    command: [./bin/nri-nginx, --metrics]
+    interval: 15`,
+			},
+		},
+		{
+			desc: "missing integration name and command",
+			data: map[string]string{configKey: "instances:\n  - name: nginx"},
+			wantProblems: []string{
+				"config.yaml: integration_name is required",
+				"config.yaml: instances[0].command is required",
+			},
+		},
+		{
+			desc:         "no instances",
+			data:         map[string]string{configKey: "integration_name: com.newrelic.nginx"},
+			wantProblems: []string{"config.yaml: at least one instance is required"},
+		},
+		{
+			desc: "definition not matching the config",
+			data: map[string]string{
+				configKey: nginxConfig,
+				definitionKey: `name: com.newrelic.redis
+commands:
+  inventory:
+    command: [/usr/bin/nri-nginx]
+    interval: 15s`,
+			},
+			wantProblems: []string{
+				"definition.yaml: name com.newrelic.redis does not match integration_name com.newrelic.nginx",
+				"definition.yaml: commands.inventory runs /usr/bin/nri-nginx, which is not under ./bin/",
+				"definition.yaml: commands.inventory.interval must be a number of seconds, got 15s",
+				"config.yaml: instances[0].command metrics is not defined in definition.yaml",
+			},
+		},
+		{
+			desc: "definition without commands",
+			data: map[string]string{configKey: nginxConfig, definitionKey: "name: com.newrelic.nginx"},
+			wantProblems: []string{
+				"definition.yaml: at least one command is required",
+			},
+		},
+		{
+			desc: "exec integrations",
+			data: map[string]string{configKey: `integrations:
+  - name: nri-nginx
+    interval: 15s
+  - exec: /usr/bin/nri-redis
+    interval: 0
+  - interval: 30s`},
+			wantProblems: []string{
+				"config.yaml: integrations[1].interval must be a duration, got 0",
+				"config.yaml: integrations[2] requires a name or exec",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			assert.Equal(t, c.wantProblems, validateIntegrationConfig(c.data, []string{"./bin/"}))
+		})
+	}
+
+	problems := validateIntegrationConfig(map[string]string{configKey: "instances: nginx"}, nil)
+	require.Len(t, problems, 1)
+	assert.True(t, strings.HasPrefix(problems[0], "config.yaml: yaml: unmarshal errors"), problems[0])
+}
+
+func TestIntegrationBinaryPrefixes(t *testing.T) {
+	assert.Equal(t, []string{"./bin/", defaultIntegrationsBinDir, "/nri-sidecar/newrelic-infra/newrelic-integrations/bin/"},
+		integrationBinaryPrefixes("/nri-sidecar/newrelic-infra", nil))
+	assert.Equal(t, []string{"/opt/"}, integrationBinaryPrefixes("/nri-sidecar/newrelic-infra", []string{"/opt/"}))
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/version"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+)
+
+const (
+	terminationVolumeName = "sidecar-termination"
+	// terminationDir is mounted in the sidecar and in the target containers of the pods of Jobs. The Job signals the
+	// sidecar to exit by creating terminationFile in it.
+	terminationDir        = "/nri-lifecycle"
+	terminationFile       = terminationDir + "/terminated"
+	terminationFileEnvVar = "NRI_SIDECAR_TERMINATION_FILE"
+	// terminationWatcher runs the command of the sidecar given as arguments, and stops it once the termination file
+	// exists, exiting successfully so the Job completes. The exit code of the agent is kept when it exits on its own.
+	// It is run with /bin/sh, which the sidecar image must provide.
+	terminationWatcher = `"$@" &
+agent=$!
+trap 'kill -TERM "$agent" 2>/dev/null' TERM INT
+while kill -0 "$agent" 2>/dev/null; do
+  if [ -e "$` + terminationFileEnvVar + `" ]; then
+    kill -TERM "$agent" 2>/dev/null
+    wait "$agent"
+    exit 0
+  fi
+  sleep 1
+done
+wait "$agent"
+`
+)
+
+// nativeSidecarsVersion is the first Kubernetes version enabling native sidecar containers by default.
+var nativeSidecarsVersion = version.MajorMinor(1, 29)
+
+// JobSidecarMode tells how the sidecar is injected into the pods of Jobs, so it does not keep them from completing.
+type JobSidecarMode string
+
+const (
+	// JobSidecarAuto uses native sidecars when the apiserver supports them, and the termination signal otherwise.
+	JobSidecarAuto JobSidecarMode = "auto"
+	// JobSidecarNative injects the sidecar as an init container with restartPolicy: Always, which is stopped once the
+	// other containers of the pod exit.
+	JobSidecarNative JobSidecarMode = "native"
+	// JobSidecarSignal shares a volume between the sidecar and the target containers, where the Job creates a file
+	// telling the entrypoint of the sidecar to exit.
+	JobSidecarSignal JobSidecarMode = "signal"
+	// JobSidecarNone injects the sidecar as a regular container, as for any other pod.
+	JobSidecarNone JobSidecarMode = "none"
+)
+
+func validJobSidecarMode(mode JobSidecarMode) bool {
+	switch mode {
+	case JobSidecarAuto, JobSidecarNative, JobSidecarSignal, JobSidecarNone:
+		return true
+	}
+	return false
+}
+
+// resolveJobSidecarMode replaces the auto mode with the native or the signal one, depending on the version of the
+// apiserver. The signal mode is used when the version is not known.
+func resolveJobSidecarMode(mode JobSidecarMode, serverVersion *k8sversion.Info) JobSidecarMode {
+	if mode != JobSidecarAuto && mode != "" {
+		return mode
+	}
+	if serverVersion == nil {
+		return JobSidecarSignal
+	}
+	v, err := version.ParseGeneric(serverVersion.GitVersion)
+	if err != nil || !v.AtLeast(nativeSidecarsVersion) {
+		return JobSidecarSignal
+	}
+	return JobSidecarNative
+}
+
+// isJobPod tells whether the pod is run by a Job, including the ones created by CronJobs.
+func isJobPod(pod *corev1.Pod) bool {
+	owner := podOwner(pod)
+	return owner != nil && owner.Kind == "Job"
+}
+
+// terminationSignal mounts the termination volume in the sidecar and in the target containers of the pod, and wraps the
+// command of the sidecar, or the given one when the sidecar has none, in a watcher stopping it once the termination
+// file exists. It returns the volumes of the sidecar with the termination volume and the patch adding the volume mount
+// to the target containers. When a target container already uses the mount path, or the command of the sidecar is not
+// known, the sidecar is left as it is and a warning is returned. The file is created by the Job, which the webhook
+// cannot do for it: the commands of the images are not known. A warning reminds it when no target container mentions
+// the file in its command.
+func terminationSignal(pod *corev1.Pod, sidecar *corev1.Container, volumes []corev1.Volume, command []string) ([]corev1.Volume, []PatchOperation, []string) {
+	if len(sidecar.Command) > 0 {
+		command = sidecar.Command
+	}
+	if len(command) == 0 {
+		return volumes, nil, []string{"sidecar termination signal not set up, the command of the sidecar is not known"}
+	}
+	targets, _ := targetContainers(pod)
+	for _, target := range targets {
+		for _, m := range target.VolumeMounts {
+			if path.Clean(m.MountPath) == terminationDir {
+				return volumes, nil, []string{fmt.Sprintf("sidecar termination signal not set up, container %s already mounts %s at %s",
+					target.Name, m.Name, terminationDir)}
+			}
+		}
+	}
+
+	taken := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		taken[v.Name] = true
+	}
+	for _, v := range volumes {
+		taken[v.Name] = true
+	}
+	volume := corev1.Volume{
+		Name: uniqueName(terminationVolumeName, taken),
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory, SizeLimit: quantityPointer(resource.MustParse("1Mi"))},
+		},
+	}
+	mount := corev1.VolumeMount{Name: volume.Name, MountPath: terminationDir}
+
+	readOnly := mount
+	readOnly.ReadOnly = true
+	sidecar.VolumeMounts = append(sidecar.VolumeMounts, readOnly)
+	sidecar.Env = append(sidecar.Env, corev1.EnvVar{Name: terminationFileEnvVar, Value: terminationFile})
+	sidecar.Args = append(append([]string{}, command...), sidecar.Args...)
+	sidecar.Command = []string{"/bin/sh", "-c", terminationWatcher, sidecar.Name}
+
+	var patch []PatchOperation
+	for _, target := range targets {
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].Name != target.Name {
+				continue
+			}
+			mountsPath := fmt.Sprintf("/spec/containers/%d/volumeMounts", i)
+			if len(target.VolumeMounts) == 0 {
+				patch = append(patch, PatchOperation{Op: "add", Path: mountsPath, Value: []corev1.VolumeMount{mount}})
+			} else {
+				patch = append(patch, PatchOperation{Op: "add", Path: mountsPath + "/-", Value: mount})
+			}
+		}
+	}
+	var warnings []string
+	if !createsTerminationFile(targets) {
+		warnings = append(warnings, fmt.Sprintf("the Job must create %s when its work is over, otherwise the "+
+			"integrations sidecar keeps running and the Job never completes", terminationFile))
+	}
+	return append(volumes, volume), patch, warnings
+}
+
+// createsTerminationFile tells whether the command of one of the target containers mentions the termination file.
+func createsTerminationFile(targets []*corev1.Container) bool {
+	for _, target := range targets {
+		for _, arg := range append(append([]string{}, target.Command...), target.Args...) {
+			if strings.Contains(arg, terminationFile) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sversion "k8s.io/apimachinery/pkg/version"
+)
+
+func TestResolveJobSidecarMode(t *testing.T) {
+	cases := []struct {
+		name          string
+		mode          JobSidecarMode
+		serverVersion *k8sversion.Info
+		expected      JobSidecarMode
+	}{
+		{name: "native supported", mode: JobSidecarAuto, serverVersion: &k8sversion.Info{GitVersion: "v1.29.3-eks-adc7111"}, expected: JobSidecarNative},
+		{name: "native not supported", mode: JobSidecarAuto, serverVersion: &k8sversion.Info{GitVersion: "v1.28.9"}, expected: JobSidecarSignal},
+		{name: "invalid version", mode: JobSidecarAuto, serverVersion: &k8sversion.Info{GitVersion: "unknown"}, expected: JobSidecarSignal},
+		{name: "unknown version", mode: JobSidecarAuto, expected: JobSidecarSignal},
+		{name: "forced native", mode: JobSidecarNative, serverVersion: &k8sversion.Info{GitVersion: "v1.28.9"}, expected: JobSidecarNative},
+		{name: "none", mode: JobSidecarNone, serverVersion: &k8sversion.Info{GitVersion: "v1.30.0"}, expected: JobSidecarNone},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, resolveJobSidecarMode(c.mode, c.serverVersion))
+		})
+	}
+}
+
+func TestMutateJobPod(t *testing.T) {
+	jobPod := func(mounts ...corev1.VolumeMount) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Annotations: map[string]string{annotationIntegrationConfigKey: configName},
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "batch/v1", Kind: "Job", Name: "backup", Controller: boolPointer(true)},
+				},
+			},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init"}},
+				Containers: []corev1.Container{{
+					Name:         "app",
+					Command:      []string{"sh", "-c", "backup; touch " + terminationFile},
+					VolumeMounts: mounts,
+				}},
+			},
+		}
+	}
+	clients := K8sClients{ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}}}
+
+	paths := func(patch []PatchOperation) map[string]interface{} {
+		values := map[string]interface{}{}
+		for _, op := range patch {
+			values[op.Path] = op.Value
+		}
+		return values
+	}
+
+	t.Run("native", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarNative
+		patch, warnings, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(jobPod())
+		require.NoError(t, err)
+		assert.Empty(t, warnings)
+		values := paths(patch)
+		assert.NotContains(t, values, "/spec/containers/-")
+		require.Contains(t, values, "/spec/initContainers/-")
+		sidecar := values["/spec/initContainers/-"].(corev1.Container)
+		assert.Equal(t, "newrelic-sidecar", sidecar.Name)
+		require.NotNil(t, sidecar.RestartPolicy)
+		assert.Equal(t, corev1.ContainerRestartPolicyAlways, *sidecar.RestartPolicy)
+	})
+
+	t.Run("signal", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarSignal
+		patch, warnings, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(jobPod())
+		require.NoError(t, err)
+		assert.Empty(t, warnings)
+		values := paths(patch)
+		assert.NotContains(t, values, "/spec/initContainers/-")
+		sidecar := values["/spec/containers/-"].(corev1.Container)
+		assert.Nil(t, sidecar.RestartPolicy)
+		assert.Equal(t, terminationFile, containerEnv(sidecar)[terminationFileEnvVar].Value)
+		assert.Contains(t, sidecar.VolumeMounts, corev1.VolumeMount{Name: terminationVolumeName, MountPath: terminationDir, ReadOnly: true})
+		assert.Equal(t, []corev1.VolumeMount{{Name: terminationVolumeName, MountPath: terminationDir}}, values["/spec/containers/0/volumeMounts"])
+		assert.Equal(t, []string{"/bin/sh", "-c", terminationWatcher, "newrelic-sidecar"}, sidecar.Command)
+		assert.Equal(t, []string{defaultAgentCommand}, sidecar.Args)
+
+		var volumes []string
+		for _, op := range patch {
+			if op.Path == "/spec/volumes" {
+				for _, v := range op.Value.([]corev1.Volume) {
+					volumes = append(volumes, v.Name)
+				}
+			} else if op.Path == "/spec/volumes/-" {
+				volumes = append(volumes, op.Value.(corev1.Volume).Name)
+			}
+		}
+		assert.Contains(t, volumes, terminationVolumeName)
+	})
+
+	t.Run("signal without termination file", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarSignal
+		pod := jobPod()
+		pod.Spec.Containers[0].Command = []string{"backup"}
+		patch, warnings, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(pod)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"the Job must create /nri-lifecycle/terminated when its work is over, otherwise the " +
+			"integrations sidecar keeps running and the Job never completes"}, warnings)
+		sidecar := paths(patch)["/spec/containers/-"].(corev1.Container)
+		assert.Equal(t, terminationFile, containerEnv(sidecar)[terminationFileEnvVar].Value)
+	})
+
+	t.Run("signal wraps the command of the template", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarSignal
+		cfg.Template = "container:\n  name: newrelic-sidecar\n  command: [/opt/agent]\n  args: [--verbose]\n"
+		patch, warnings, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(jobPod())
+		require.NoError(t, err)
+		assert.Empty(t, warnings)
+		sidecar := paths(patch)["/spec/containers/-"].(corev1.Container)
+		assert.Equal(t, []string{"/bin/sh", "-c", terminationWatcher, "newrelic-sidecar"}, sidecar.Command)
+		assert.Equal(t, []string{"/opt/agent", "--verbose"}, sidecar.Args)
+	})
+
+	t.Run("signal without command", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarSignal
+		cfg.Command = nil
+		patch, warnings, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(jobPod())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"sidecar termination signal not set up, the command of the sidecar is not known"}, warnings)
+		sidecar := paths(patch)["/spec/containers/-"].(corev1.Container)
+		assert.Empty(t, sidecar.Command)
+		assert.NotContains(t, paths(patch), "/spec/containers/0/volumeMounts")
+	})
+
+	t.Run("signal path already mounted", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarSignal
+		pod := jobPod(corev1.VolumeMount{Name: "lifecycle", MountPath: "/nri-lifecycle/"})
+		patch, warnings, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(pod)
+		require.NoError(t, err)
+		assert.Contains(t, warnings, "sidecar termination signal not set up, container app already mounts lifecycle at /nri-lifecycle")
+		sidecar := paths(patch)["/spec/containers/-"].(corev1.Container)
+		assert.NotContains(t, containerEnv(sidecar), terminationFileEnvVar)
+	})
+
+	t.Run("not a job", func(t *testing.T) {
+		cfg := defaultSidecarConfig()
+		cfg.JobSidecar = JobSidecarNative
+		pod := jobPod()
+		pod.OwnerReferences[0].Kind = "ReplicaSet"
+		patch, _, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).MutateWithWarnings(pod)
+		require.NoError(t, err)
+		values := paths(patch)
+		assert.Contains(t, values, "/spec/containers/-")
+		assert.NotContains(t, values, "/spec/initContainers/-")
+	})
+}
+
+func TestTerminationWatcher(t *testing.T) {
+	if _, err := exec.LookPath("/bin/sh"); err != nil {
+		t.Skip("/bin/sh not available")
+	}
+	run := func(t *testing.T, terminationFile string, command ...string) *exec.Cmd {
+		cmd := exec.Command("/bin/sh", append([]string{"-c", terminationWatcher, "newrelic-sidecar"}, command...)...)
+		cmd.Env = append(os.Environ(), terminationFileEnvVar+"="+terminationFile)
+		require.NoError(t, cmd.Start())
+		return cmd
+	}
+	wait := func(t *testing.T, cmd *exec.Cmd) error {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(10 * time.Second):
+			_ = cmd.Process.Kill()
+			t.Fatal("watcher did not exit")
+			return nil
+		}
+	}
+
+	t.Run("stops the agent once the file exists", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "terminated")
+		cmd := run(t, file, "sleep", "60")
+		time.Sleep(500 * time.Millisecond)
+		require.NoError(t, os.WriteFile(file, nil, 0600))
+		assert.NoError(t, wait(t, cmd))
+	})
+
+	t.Run("keeps the exit code of the agent", func(t *testing.T) {
+		cmd := run(t, filepath.Join(t.TempDir(), "terminated"), "sh", "-c", "exit 3")
+		var exitErr *exec.ExitError
+		require.ErrorAs(t, wait(t, cmd), &exitErr)
+		assert.Equal(t, 3, exitErr.ExitCode())
+	})
+
+	t.Run("forwards the termination signal", func(t *testing.T) {
+		cmd := run(t, filepath.Join(t.TempDir(), "terminated"), "sleep", "60")
+		time.Sleep(500 * time.Millisecond)
+		require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+		// The exit code is the one of the agent killed by the signal.
+		var exitErr *exec.ExitError
+		require.ErrorAs(t, wait(t, cmd), &exitErr)
+		assert.NotEqual(t, 0, exitErr.ExitCode())
+	})
+}
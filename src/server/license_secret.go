@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	licenseKeyEnvVar = "NRIA_LICENSE_KEY"
+	// labelManagedBy marks the secrets replicated by the webhook, which are the only ones it updates.
+	labelManagedBy   = "app.kubernetes.io/managed-by"
+	managedByWebhook = "newrelic-webhook"
+	// licenseKeyCacheTTL is how long the license key of the source secret, and the namespaces already holding it, are
+	// remembered, so the pods created in a burst do not read the secrets on every admission.
+	licenseKeyCacheTTL = time.Minute
+)
+
+// LicenseKeySecretConfig references the license key of the sidecar from a secret in the namespace of the pod, so it
+// is not written as plain text in the pod spec.
+type LicenseKeySecretConfig struct {
+	// Name of the secret holding the license key.
+	Name string `json:"name"`
+	// Key of the license key in the secret.
+	Key string `json:"key"`
+	// SourceNamespace is the namespace the secret is replicated from into the namespaces of the injected pods. When
+	// empty, the secret must already exist in every namespace.
+	SourceNamespace string `json:"sourceNamespace,omitempty"`
+}
+
+type secretWriter interface {
+	CreateSecret(secret *corev1.Secret) (*corev1.Secret, error)
+	UpdateSecret(secret *corev1.Secret) (*corev1.Secret, error)
+}
+
+// licenseKeyCache remembers the license key read from the source secret and the namespaces it was replicated into.
+// The namespaces are forgotten when the license key changes.
+type licenseKeyCache struct {
+	sync.Mutex
+	ttl        time.Duration
+	now        func() time.Time
+	licenseKey []byte
+	readAt     time.Time
+	replicated map[string]time.Time
+}
+
+func newLicenseKeyCache(ttl time.Duration) *licenseKeyCache {
+	return &licenseKeyCache{ttl: ttl, now: time.Now, replicated: map[string]time.Time{}}
+}
+
+// get returns the cached license key, or false if it has expired.
+func (c *licenseKeyCache) get() ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.licenseKey == nil || c.now().Sub(c.readAt) >= c.ttl {
+		return nil, false
+	}
+	return c.licenseKey, true
+}
+
+// set caches the license key read from the source secret.
+func (c *licenseKeyCache) set(licenseKey []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if !bytes.Equal(c.licenseKey, licenseKey) {
+		c.replicated = map[string]time.Time{}
+	}
+	c.licenseKey = licenseKey
+	c.readAt = c.now()
+}
+
+// isReplicated returns whether the namespace was recently checked to hold the license key.
+func (c *licenseKeyCache) isReplicated(namespace string, licenseKey []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+	checkedAt, ok := c.replicated[namespace]
+	return ok && bytes.Equal(c.licenseKey, licenseKey) && c.now().Sub(checkedAt) < c.ttl
+}
+
+// setReplicated records that the namespace holds the license key.
+func (c *licenseKeyCache) setReplicated(namespace string, licenseKey []byte) {
+	c.Lock()
+	defer c.Unlock()
+	if bytes.Equal(c.licenseKey, licenseKey) {
+		c.replicated[namespace] = c.now()
+	}
+}
+
+// licenseKeyEnvVarFromSecret returns the NRIA_LICENSE_KEY env var of the sidecar, referencing the license key secret.
+func licenseKeyEnvVarFromSecret(cfg *LicenseKeySecretConfig) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: licenseKeyEnvVar,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: cfg.Name},
+				Key:                  cfg.Key,
+			},
+		},
+	}
+}
+
+// ApplySideEffects replicates the license key secret into the namespace of the pod the sidecar was injected in. It
+// returns a warning when the secret could not be replicated, as the sidecar would not start without it.
+func (sm *SidecarMutator) ApplySideEffects(pod *corev1.Pod) []string {
+	cfg := sm.licenseKeySecret
+	if cfg == nil || cfg.SourceNamespace == "" || cfg.SourceNamespace == pod.Namespace || sm.secretRtrv == nil || sm.secretWriter == nil {
+		return nil
+	}
+	if err := sm.replicateLicenseKeySecret(pod.Namespace); err != nil {
+		return []string{fmt.Sprintf("license key secret '%s' not replicated into namespace '%s': %v", cfg.Name, pod.Namespace, err)}
+	}
+	return nil
+}
+
+// replicateLicenseKeySecret creates the license key secret in the namespace, with the license key of the secret in the
+// source namespace. Secrets previously replicated are updated when the license key changes, other secrets with the
+// same name are left alone. The secrets are only read again once the cache has expired.
+func (sm *SidecarMutator) replicateLicenseKeySecret(namespace string) error {
+	cfg := sm.licenseKeySecret
+	licenseKey, err := sm.sourceLicenseKey()
+	if err != nil {
+		return err
+	}
+	if sm.licenseKeys.isReplicated(namespace, licenseKey) {
+		return nil
+	}
+
+	existing, err := sm.secretRtrv.Secret(namespace, cfg.Name)
+	switch {
+	case k8s_errors.IsNotFound(err):
+		_, err = sm.secretWriter.CreateSecret(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      cfg.Name,
+				Namespace: namespace,
+				Labels:    map[string]string{labelManagedBy: managedByWebhook},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{cfg.Key: licenseKey},
+		})
+		// Another replica of the webhook may have created it in the meantime.
+		if k8s_errors.IsAlreadyExists(err) {
+			err = nil
+		}
+	case err != nil:
+		return err
+	case existing.Labels[labelManagedBy] != managedByWebhook || bytes.Equal(existing.Data[cfg.Key], licenseKey):
+	default:
+		updated := existing.DeepCopy()
+		if updated.Data == nil {
+			updated.Data = map[string][]byte{}
+		}
+		updated.Data[cfg.Key] = licenseKey
+		_, err = sm.secretWriter.UpdateSecret(updated)
+	}
+	if err != nil {
+		return err
+	}
+	sm.licenseKeys.setReplicated(namespace, licenseKey)
+	return nil
+}
+
+// sourceLicenseKey returns the license key of the secret in the source namespace, read at most once per cache TTL.
+func (sm *SidecarMutator) sourceLicenseKey() ([]byte, error) {
+	if licenseKey, ok := sm.licenseKeys.get(); ok {
+		return licenseKey, nil
+	}
+	cfg := sm.licenseKeySecret
+	source, err := sm.secretRtrv.Secret(cfg.SourceNamespace, cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("reading secret '%s' in namespace '%s': %v", cfg.Name, cfg.SourceNamespace, err)
+	}
+	licenseKey, ok := source.Data[cfg.Key]
+	if !ok {
+		return nil, fmt.Errorf("secret '%s' in namespace '%s' has no key %s", cfg.Name, cfg.SourceNamespace, cfg.Key)
+	}
+	sm.licenseKeys.set(licenseKey)
+	return licenseKey, nil
+}
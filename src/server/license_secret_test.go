@@ -0,0 +1,283 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSidecarAgentEnv(t *testing.T) {
+	t.Setenv(licenseKeyEnvVar, "plain-license")
+	t.Setenv("NRIA_VERBOSE", "1")
+	t.Setenv("NRIA_NOT_LISTED", "1")
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Annotations: map[string]string{annotationIntegrationConfigKey: configName},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	clients := K8sClients{ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}}}
+
+	// Without a list, all the NRIA env vars are copied.
+	cfg := defaultSidecarConfig()
+	containers, _, _, err := newSidecarMutatorFromConfig(clusterName, cfg, clients).createSidecar(pod)
+	require.NoError(t, err)
+	env := containerEnv(containers[0])
+	assert.Equal(t, corev1.EnvVar{Name: licenseKeyEnvVar, Value: "plain-license"}, env[licenseKeyEnvVar])
+	assert.Equal(t, corev1.EnvVar{Name: "NRIA_NOT_LISTED", Value: "1"}, env["NRIA_NOT_LISTED"])
+
+	cfg.AgentEnv = []string{licenseKeyEnvVar, "NRIA_VERBOSE", "NRIA_UNSET"}
+	containers, _, _, err = newSidecarMutatorFromConfig(clusterName, cfg, clients).createSidecar(pod)
+	require.NoError(t, err)
+	env = containerEnv(containers[0])
+	assert.Equal(t, corev1.EnvVar{Name: licenseKeyEnvVar, Value: "plain-license"}, env[licenseKeyEnvVar])
+	assert.Equal(t, corev1.EnvVar{Name: "NRIA_VERBOSE", Value: "1"}, env["NRIA_VERBOSE"])
+	assert.NotContains(t, env, "NRIA_NOT_LISTED")
+	assert.NotContains(t, env, "NRIA_UNSET")
+
+	cfg.AgentEnv = []string{}
+	containers, _, _, err = newSidecarMutatorFromConfig(clusterName, cfg, clients).createSidecar(pod)
+	require.NoError(t, err)
+	env = containerEnv(containers[0])
+	assert.NotContains(t, env, licenseKeyEnvVar)
+	assert.NotContains(t, env, "NRIA_VERBOSE")
+
+	cfg.AgentEnv = nil
+	cfg.LicenseKeySecret = &LicenseKeySecretConfig{Name: "newrelic-license", Key: "license"}
+	containers, _, _, err = newSidecarMutatorFromConfig(clusterName, cfg, clients).createSidecar(pod)
+	require.NoError(t, err)
+	env = containerEnv(containers[0])
+	require.NotNil(t, env[licenseKeyEnvVar].ValueFrom)
+	assert.Empty(t, env[licenseKeyEnvVar].Value)
+	assert.Equal(t, &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "newrelic-license"},
+		Key:                  "license",
+	}, env[licenseKeyEnvVar].ValueFrom.SecretKeyRef)
+	assert.Equal(t, "1", env["NRIA_VERBOSE"].Value)
+}
+
+func TestApplySideEffectsReplicatesLicenseKeySecret(t *testing.T) {
+	source := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "newrelic", Name: "newrelic-license"},
+		Data:       map[string][]byte{"license": []byte("s3cr3t"), "other": []byte("not copied")},
+	}
+
+	cases := []struct {
+		name         string
+		existing     *corev1.Secret
+		namespace    string
+		expectedData map[string][]byte
+	}{
+		{
+			name:         "created",
+			namespace:    "default",
+			expectedData: map[string][]byte{"license": []byte("s3cr3t")},
+		},
+		{
+			name:      "managed secret updated",
+			namespace: "default",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "newrelic-license", Labels: map[string]string{labelManagedBy: managedByWebhook}},
+				Data:       map[string][]byte{"license": []byte("old")},
+			},
+			expectedData: map[string][]byte{"license": []byte("s3cr3t")},
+		},
+		{
+			name:      "user secret kept",
+			namespace: "default",
+			existing: &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "newrelic-license"},
+				Data:       map[string][]byte{"license": []byte("mine")},
+			},
+			expectedData: map[string][]byte{"license": []byte("mine")},
+		},
+		{
+			name:      "source namespace",
+			namespace: "newrelic",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			secrets := fakeSecrets{"newrelic/newrelic-license": source}
+			if c.existing != nil {
+				secrets[c.existing.Namespace+"/"+c.existing.Name] = c.existing
+			}
+			cfg := defaultSidecarConfig()
+			cfg.LicenseKeySecret = &LicenseKeySecretConfig{Name: "newrelic-license", Key: "license", SourceNamespace: "newrelic"}
+			sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{Secrets: secrets, SecretWriter: secrets})
+
+			warnings := sm.ApplySideEffects(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: c.namespace}})
+			assert.Empty(t, warnings)
+			if c.expectedData == nil {
+				assert.Len(t, secrets, 1)
+				return
+			}
+			replicated := secrets[c.namespace+"/newrelic-license"]
+			require.NotNil(t, replicated)
+			assert.Equal(t, c.expectedData, replicated.Data)
+		})
+	}
+}
+
+func TestApplySideEffectsWarnings(t *testing.T) {
+	cfg := defaultSidecarConfig()
+	cfg.LicenseKeySecret = &LicenseKeySecretConfig{Name: "newrelic-license", Key: "license", SourceNamespace: "newrelic"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+
+	secrets := fakeSecrets{}
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{Secrets: secrets, SecretWriter: secrets})
+	assert.Equal(t, []string{
+		"license key secret 'newrelic-license' not replicated into namespace 'default': reading secret 'newrelic-license' " +
+			"in namespace 'newrelic': secrets \"newrelic-license\" not found",
+	}, sm.ApplySideEffects(pod))
+
+	secrets["newrelic/newrelic-license"] = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "newrelic", Name: "newrelic-license"},
+		Data:       map[string][]byte{"other": []byte("s3cr3t")},
+	}
+	assert.Len(t, sm.ApplySideEffects(pod), 1)
+	assert.NotContains(t, secrets, "default/newrelic-license")
+
+	// Without a source namespace, the secret is expected to exist in every namespace.
+	cfg.LicenseKeySecret.SourceNamespace = ""
+	sm = newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{Secrets: secrets, SecretWriter: secrets})
+	assert.Empty(t, sm.ApplySideEffects(pod))
+}
+
+func TestApplySideEffectsCachesLicenseKeySecret(t *testing.T) {
+	secrets := &countingSecrets{fakeSecrets: fakeSecrets{"newrelic/newrelic-license": {
+		ObjectMeta: metav1.ObjectMeta{Namespace: "newrelic", Name: "newrelic-license"},
+		Data:       map[string][]byte{"license": []byte("s3cr3t")},
+	}}}
+	cfg := defaultSidecarConfig()
+	cfg.LicenseKeySecret = &LicenseKeySecretConfig{Name: "newrelic-license", Key: "license", SourceNamespace: "newrelic"}
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{Secrets: secrets, SecretWriter: secrets})
+	now := time.Now()
+	sm.licenseKeys.now = func() time.Time { return now }
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+
+	// The pods created together only read the secrets once.
+	for i := 0; i < 3; i++ {
+		assert.Empty(t, sm.ApplySideEffects(pod))
+	}
+	assert.Equal(t, 2, secrets.reads)
+	assert.Equal(t, 1, secrets.writes)
+
+	// Once the cache expires, the secrets are read again, and the replicated secret is not written when it is in sync.
+	now = now.Add(licenseKeyCacheTTL)
+	assert.Empty(t, sm.ApplySideEffects(pod))
+	assert.Equal(t, 4, secrets.reads)
+	assert.Equal(t, 1, secrets.writes)
+
+	// A new license key is replicated once it is read.
+	secrets.fakeSecrets["newrelic/newrelic-license"].Data["license"] = []byte("n3w")
+	now = now.Add(licenseKeyCacheTTL)
+	assert.Empty(t, sm.ApplySideEffects(pod))
+	assert.Equal(t, 2, secrets.writes)
+	assert.Equal(t, []byte("n3w"), secrets.fakeSecrets["default/newrelic-license"].Data["license"])
+}
+
+func TestServeHTTPReplicatesLicenseKeySecret(t *testing.T) {
+	for _, dryRun := range []bool{true, false} {
+		secrets := fakeSecrets{"newrelic/newrelic-license": {
+			ObjectMeta: metav1.ObjectMeta{Namespace: "newrelic", Name: "newrelic-license"},
+			Data:       map[string][]byte{"license": []byte("s3cr3t")},
+		}}
+		cfg := defaultSidecarConfig()
+		cfg.LicenseKeySecret = &LicenseKeySecretConfig{Name: "newrelic-license", Key: "license", SourceNamespace: "newrelic"}
+		whsvr := &Webhook{
+			ClusterName: clusterName,
+			Server:      &http.Server{},
+			Mutators: []podMutator{
+				newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{
+					ConfigMaps:   makeConfigMapRetriever("default", configName, map[string]string{configKey: integrationConfig}),
+					Secrets:      secrets,
+					SecretWriter: secrets,
+				}),
+			},
+		}
+		server := httptest.NewServer(whsvr)
+
+		var review admissionv1.AdmissionReview
+		require.NoError(t, json.Unmarshal(makeV1TestData(t, "default", map[string]string{annotationIntegrationConfigKey: configName}), &review))
+		review.Request.DryRun = &dryRun
+		body, err := json.Marshal(review)
+		require.NoError(t, err)
+
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		_, replicated := secrets["default/newrelic-license"]
+		assert.Equal(t, !dryRun, replicated, "dry-run: %v", dryRun)
+		server.Close()
+	}
+}
+
+// fakeSecrets stores secrets by namespace/name.
+type fakeSecrets map[string]*corev1.Secret
+
+func (fs fakeSecrets) Secret(namespace, name string) (*corev1.Secret, error) {
+	secret, ok := fs[namespace+"/"+name]
+	if !ok {
+		return nil, k8s_errors.NewNotFound(schema.GroupResource{Resource: "secrets"}, name)
+	}
+	return secret.DeepCopy(), nil
+}
+
+func (fs fakeSecrets) CreateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	key := secret.Namespace + "/" + secret.Name
+	if _, ok := fs[key]; ok {
+		return nil, k8s_errors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, secret.Name)
+	}
+	fs[key] = secret.DeepCopy()
+	return secret, nil
+}
+
+func (fs fakeSecrets) UpdateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	fs[secret.Namespace+"/"+secret.Name] = secret.DeepCopy()
+	return secret, nil
+}
+
+// countingSecrets counts the reads and writes of the secrets.
+type countingSecrets struct {
+	fakeSecrets
+	reads, writes int
+}
+
+func (cs *countingSecrets) Secret(namespace, name string) (*corev1.Secret, error) {
+	cs.reads++
+	return cs.fakeSecrets.Secret(namespace, name)
+}
+
+func (cs *countingSecrets) CreateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	cs.writes++
+	return cs.fakeSecrets.CreateSecret(secret)
+}
+
+func (cs *countingSecrets) UpdateSecret(secret *corev1.Secret) (*corev1.Secret, error) {
+	cs.writes++
+	return cs.fakeSecrets.UpdateSecret(secret)
+}
+
+func containerEnv(c corev1.Container) map[string]corev1.EnvVar {
+	env := map[string]corev1.EnvVar{}
+	for _, e := range c.Env {
+		env[e.Name] = e
+	}
+	return env
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "newrelic_webhook"
+
+	resultMutated = "mutated"
+	resultSkipped = "skipped"
+	resultError   = "error"
+	resultDenied  = "denied"
+	resultAllowed = "allowed"
+	resultWarned  = "warned"
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+var (
+	admissionRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "admission_requests_total",
+		Help:      "Admission reviews handled by the webhook, partitioned by result (mutated, skipped, denied or error).",
+	}, []string{"result"})
+
+	validationRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "validation_requests_total",
+		Help:      "Workload reviews handled on /validate, partitioned by result (allowed, warned, denied or error).",
+	}, []string{"result"})
+
+	mutatorDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "mutator_duration_seconds",
+		Help:      "Time spent by each pod mutator computing its patch.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"mutator"})
+
+	patchOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_operations_total",
+		Help:      "JSON patch operations generated by each pod mutator.",
+	}, []string{"mutator"})
+
+	configMapRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "configmap_retries_total",
+		Help:      "Mutation retries caused by a config map that was not found.",
+	})
+
+	certReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_reloads_total",
+		Help:      "Certificate reloads triggered by changes on disk, partitioned by result (success or failure).",
+	}, []string{"result"})
+
+	configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Configuration file reloads triggered by changes on disk, partitioned by result (success or failure).",
+	}, []string{"result"})
+
+	sidecarSkipsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sidecar_skips_total",
+		Help:      "Pods asking for the integrations sidecar that did not get it, partitioned by reason.",
+	}, []string{"reason"})
+
+	certExpiryTimestampSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_expiry_timestamp_seconds",
+		Help:      "Expiry of the serving certificate, in seconds since the Unix epoch.",
+	})
+
+	certRenewalDue = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_renewal_due",
+		Help:      "Whether the serving certificate expires within its renewal window and was not rotated (1) or not (0).",
+	})
+
+	certRotationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cert_rotations_total",
+		Help:      "Serving certificates issued by the self-managed CA, partitioned by result (success or failure).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		admissionRequestsTotal,
+		validationRequestsTotal,
+		mutatorDurationSeconds,
+		patchOperationsTotal,
+		configMapRetriesTotal,
+		certReloadsTotal,
+		configReloadsTotal,
+		sidecarSkipsTotal,
+		certExpiryTimestampSeconds,
+		certRenewalDue,
+		certRotationsTotal,
+	)
+}
+
+// MetricsHandler returns the handler exposing the webhook metrics in the Prometheus format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RecordCertReload accounts for a certificate reload attempt that finished with the given error.
+func RecordCertReload(err error) {
+	if err != nil {
+		certReloadsTotal.WithLabelValues(resultFailure).Inc()
+		return
+	}
+	certReloadsTotal.WithLabelValues(resultSuccess).Inc()
+}
+
+// RecordConfigReload accounts for a configuration reload attempt that finished with the given error.
+func RecordConfigReload(err error) {
+	if err != nil {
+		configReloadsTotal.WithLabelValues(resultFailure).Inc()
+		return
+	}
+	configReloadsTotal.WithLabelValues(resultSuccess).Inc()
+}
+
+// RecordCertRotation accounts for a certificate rotation attempt that finished with the given error.
+func RecordCertRotation(err error) {
+	if err != nil {
+		certRotationsTotal.WithLabelValues(resultFailure).Inc()
+		return
+	}
+	certRotationsTotal.WithLabelValues(resultSuccess).Inc()
+}
+
+// mutatorName returns the name used to identify a mutator in the metrics, e.g. "EnvVarMutator".
+func mutatorName(m podMutator) string {
+	return reflect.Indirect(reflect.ValueOf(m)).Type().Name()
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/newrelic/k8s-webhook/src/certs"
+)
+
+func TestServeHTTPMetrics(t *testing.T) {
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewEnvVarMutator(clusterName),
+		},
+		IgnoreNamespaces: []string{metav1.NamespaceSystem},
+	}
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	mutated := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues(resultMutated))
+	skipped := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues(resultSkipped))
+	failed := testutil.ToFloat64(admissionRequestsTotal.WithLabelValues(resultError))
+	patches := testutil.ToFloat64(patchOperationsTotal.WithLabelValues("EnvVarMutator"))
+
+	for _, body := range [][]byte{makeTestData(t, "default", nil), makeTestData(t, "kube-system", nil), {}} {
+		resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	assert.Equal(t, mutated+1, testutil.ToFloat64(admissionRequestsTotal.WithLabelValues(resultMutated)))
+	assert.Equal(t, skipped+1, testutil.ToFloat64(admissionRequestsTotal.WithLabelValues(resultSkipped)))
+	assert.Equal(t, failed+1, testutil.ToFloat64(admissionRequestsTotal.WithLabelValues(resultError)))
+	// The test pod gets the 8 metadata env vars injected into each of its 2 containers.
+	assert.Equal(t, patches+16, testutil.ToFloat64(patchOperationsTotal.WithLabelValues("EnvVarMutator")))
+}
+
+func TestSetCertRecordsExpiry(t *testing.T) {
+	ca, err := certs.NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	keyPEM, err := ca.KeyPEM()
+	require.NoError(t, err)
+	pair, err := tls.X509KeyPair(ca.CertPEM(), keyPEM)
+	require.NoError(t, err)
+	pair.Leaf = nil
+
+	whsvr := &Webhook{}
+	require.NoError(t, whsvr.SetCert(&pair))
+
+	require.NotNil(t, whsvr.Cert.Leaf)
+	assert.Equal(t, float64(ca.Cert.NotAfter.Unix()), testutil.ToFloat64(certExpiryTimestampSeconds))
+}
+
+func TestCheckCertRenewal(t *testing.T) {
+	ca, err := certs.NewCA("test CA", time.Hour)
+	require.NoError(t, err)
+	keyPEM, err := ca.KeyPEM()
+	require.NoError(t, err)
+	pair, err := tls.X509KeyPair(ca.CertPEM(), keyPEM)
+	require.NoError(t, err)
+
+	whsvr := &Webhook{Logger: zap.NewNop().Sugar()}
+	assert.False(t, whsvr.CheckCertRenewal(2*time.Hour), "missing certificate due")
+	require.NoError(t, whsvr.SetCert(&pair))
+
+	assert.True(t, whsvr.CheckCertRenewal(2*time.Hour))
+	assert.Equal(t, float64(1), testutil.ToFloat64(certRenewalDue))
+	assert.False(t, whsvr.CheckCertRenewal(30*time.Minute))
+	assert.Equal(t, float64(0), testutil.ToFloat64(certRenewalDue))
+}
+
+func TestRecordCertRotation(t *testing.T) {
+	success := testutil.ToFloat64(certRotationsTotal.WithLabelValues(resultSuccess))
+	failure := testutil.ToFloat64(certRotationsTotal.WithLabelValues(resultFailure))
+
+	RecordCertRotation(nil)
+	RecordCertRotation(errors.New("cannot write secret"))
+
+	assert.Equal(t, success+1, testutil.ToFloat64(certRotationsTotal.WithLabelValues(resultSuccess)))
+	assert.Equal(t, failure+1, testutil.ToFloat64(certRotationsTotal.WithLabelValues(resultFailure)))
+}
+
+func TestRecordCertReload(t *testing.T) {
+	success := testutil.ToFloat64(certReloadsTotal.WithLabelValues(resultSuccess))
+	failure := testutil.ToFloat64(certReloadsTotal.WithLabelValues(resultFailure))
+
+	RecordCertReload(nil)
+	RecordCertReload(errors.New("cannot load key pair"))
+	RecordCertReload(errors.New("cannot load key pair"))
+
+	assert.Equal(t, success+1, testutil.ToFloat64(certReloadsTotal.WithLabelValues(resultSuccess)))
+	assert.Equal(t, failure+2, testutil.ToFloat64(certReloadsTotal.WithLabelValues(resultFailure)))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	RecordCertReload(nil)
+
+	server := httptest.NewServer(MetricsHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close() // nolint: errcheck
+
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, strings.Contains(buf.String(), "newrelic_webhook_cert_reloads_total"))
+}
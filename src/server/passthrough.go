@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const annotationTargetContainer = "newrelic.com/integrations-sidecar-target-container"
+
+// targetContainers returns the containers monitored by the sidecar, listed in the
+// newrelic.com/integrations-sidecar-target-container annotation, or the first container of the pod by default.
+// Unknown containers are reported as warnings.
+func targetContainers(pod *corev1.Pod) ([]*corev1.Container, []string) {
+	names := splitNames(pod.GetAnnotations()[annotationTargetContainer])
+	if len(names) == 0 {
+		if len(pod.Spec.Containers) == 0 {
+			return nil, nil
+		}
+		return []*corev1.Container{&pod.Spec.Containers[0]}, nil
+	}
+
+	var targets []*corev1.Container
+	var warnings []string
+	for _, name := range names {
+		found := false
+		for i := range pod.Spec.Containers {
+			if pod.Spec.Containers[i].Name == name {
+				targets = append(targets, &pod.Spec.Containers[i])
+				found = true
+				break
+			}
+		}
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("target container %s not found in the pod", name))
+		}
+	}
+	if len(targets) == 0 && len(pod.Spec.Containers) > 0 {
+		warnings = append(warnings, fmt.Sprintf("no target container found, using %s", pod.Spec.Containers[0].Name))
+		targets = append(targets, &pod.Spec.Containers[0])
+	}
+	return targets, warnings
+}
+
+// passthroughEnv returns the env vars of the sidecar passing the env vars of the target containers through to the
+// arguments of the integrations, as mapped by envToArgs. Env vars explicitly set in a container take precedence over the
+// ones loaded with envFrom, and earlier targets over later ones. Values loaded with envFrom are not copied, the sidecar
+// references the same key of the ConfigMap or Secret instead. Env vars that cannot be resolved are reported as warnings.
+func (sm *SidecarMutator) passthroughEnv(namespace string, targets []*corev1.Container, envToArgs map[string]string) ([]corev1.EnvVar, []string) {
+	var passthrough []corev1.EnvVar
+	var warnings []string
+	for _, name := range sortedKeys(envToArgs) {
+		found := false
+		for _, container := range targets {
+			env, warning := sm.containerEnv(namespace, container, name)
+			if warning != "" {
+				warnings = append(warnings, warning)
+			}
+			if env != nil {
+				env.Name = envToArgs[name]
+				passthrough = append(passthrough, *env)
+				found = true
+				break
+			}
+		}
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("$%s is not defined in the target containers, it is not passed through to the integrations", name))
+		}
+	}
+	return passthrough, warnings
+}
+
+// containerEnv returns a copy of the env var of the container with the given name, or nil when the container does not
+// define it, along with a warning when its value may not be resolved.
+func (sm *SidecarMutator) containerEnv(namespace string, container *corev1.Container, name string) (*corev1.EnvVar, string) {
+	// As in K8s, the last definition of a variable wins.
+	for i := len(container.Env) - 1; i >= 0; i-- {
+		if container.Env[i].Name == name {
+			return container.Env[i].DeepCopy(), sm.checkEnvSource(namespace, container.Env[i])
+		}
+	}
+
+	// Sources that cannot be read are referenced as optional, so the sidecar still starts when they lack the key. Later
+	// sources take precedence, as in K8s.
+	var unverified *corev1.EnvVar
+	for i := len(container.EnvFrom) - 1; i >= 0; i-- {
+		env, readable := sm.envFromSource(namespace, container.EnvFrom[i], name)
+		if env != nil {
+			return env, ""
+		}
+		if !readable && unverified == nil && strings.HasPrefix(name, container.EnvFrom[i].Prefix) {
+			unverified = envFromReference(container.EnvFrom[i], name, true)
+		}
+	}
+	if unverified != nil {
+		return unverified, fmt.Sprintf("$%s could not be looked up in the envFrom sources of container %s, it is passed through as optional",
+			name, container.Name)
+	}
+	return nil, ""
+}
+
+// envFromSource returns an env var referencing the key of the envFrom source that defines the given variable, or nil
+// when the source does not define it. The second value is false when the source could not be read.
+func (sm *SidecarMutator) envFromSource(namespace string, source corev1.EnvFromSource, name string) (*corev1.EnvVar, bool) {
+	if !strings.HasPrefix(name, source.Prefix) {
+		return nil, true
+	}
+	key := strings.TrimPrefix(name, source.Prefix)
+
+	var found bool
+	var err error
+	switch {
+	case source.ConfigMapRef != nil:
+		found, err = sm.configMapHasKey(namespace, source.ConfigMapRef.Name, key)
+	case source.SecretRef != nil:
+		found, err = sm.secretHasKey(namespace, source.SecretRef.Name, key)
+	}
+	if err != nil {
+		// A missing source does not define the variable, as K8s would not start the container without it unless optional.
+		return nil, k8s_errors.IsNotFound(err)
+	}
+	if !found {
+		return nil, true
+	}
+	return envFromReference(source, name, false), true
+}
+
+// envFromReference returns an env var referencing the key of the envFrom source holding the given variable.
+func envFromReference(source corev1.EnvFromSource, name string, optional bool) *corev1.EnvVar {
+	key := strings.TrimPrefix(name, source.Prefix)
+	var opt *bool
+	if optional {
+		opt = &optional
+	}
+	if source.ConfigMapRef != nil {
+		return &corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: source.ConfigMapRef.LocalObjectReference, Key: key, Optional: opt},
+		}}
+	}
+	return &corev1.EnvVar{Name: name, ValueFrom: &corev1.EnvVarSource{
+		SecretKeyRef: &corev1.SecretKeySelector{LocalObjectReference: source.SecretRef.LocalObjectReference, Key: key, Optional: opt},
+	}}
+}
+
+// checkEnvSource returns a warning when the env var references a key of a ConfigMap or Secret that does not exist and
+// is not optional.
+func (sm *SidecarMutator) checkEnvSource(namespace string, env corev1.EnvVar) string {
+	if env.ValueFrom == nil {
+		return ""
+	}
+
+	var kind, name, key string
+	var optional *bool
+	var found bool
+	var err error
+	switch ref := env.ValueFrom; {
+	case ref.ConfigMapKeyRef != nil:
+		kind, name, key, optional = "config map", ref.ConfigMapKeyRef.Name, ref.ConfigMapKeyRef.Key, ref.ConfigMapKeyRef.Optional
+		found, err = sm.configMapHasKey(namespace, name, key)
+	case ref.SecretKeyRef != nil:
+		kind, name, key, optional = "secret", ref.SecretKeyRef.Name, ref.SecretKeyRef.Key, ref.SecretKeyRef.Optional
+		found, err = sm.secretHasKey(namespace, name, key)
+	default:
+		return ""
+	}
+	if found || (optional != nil && *optional) || (err != nil && !k8s_errors.IsNotFound(err)) {
+		return ""
+	}
+	return fmt.Sprintf("$%s references key %s of %s %s, which does not exist", env.Name, key, kind, name)
+}
+
+func (sm *SidecarMutator) configMapHasKey(namespace, name, key string) (bool, error) {
+	if sm.cfgMapRtrv == nil {
+		return false, errors.New("config maps are not available to the sidecar mutator")
+	}
+	cfgMap, err := sm.cfgMapRtrv.ConfigMap(namespace, name)
+	if err != nil {
+		return false, err
+	}
+	_, ok := cfgMap.Data[key]
+	if !ok {
+		_, ok = cfgMap.BinaryData[key]
+	}
+	return ok, nil
+}
+
+func (sm *SidecarMutator) secretHasKey(namespace, name, key string) (bool, error) {
+	if sm.secretRtrv == nil {
+		return false, errors.New("secrets are not available to the sidecar mutator")
+	}
+	secret, err := sm.secretRtrv.Secret(namespace, name)
+	if err != nil {
+		return false, err
+	}
+	_, ok := secret.Data[key]
+	return ok, nil
+}
+
+// sharedVolumeMounts returns read-only copies of the volume mounts of the target containers. A path mounted by several
+// targets is only shared from the first one, and reported as a warning when it mounts a different volume.
+func sharedVolumeMounts(targets []*corev1.Container) ([]corev1.VolumeMount, []string) {
+	var mounts []corev1.VolumeMount
+	var warnings []string
+	mounted := map[string]corev1.VolumeMount{}
+	for _, container := range targets {
+		for _, vol := range container.VolumeMounts {
+			if prev, ok := mounted[vol.MountPath]; ok {
+				if prev.Name != vol.Name || prev.SubPath != vol.SubPath {
+					warnings = append(warnings, fmt.Sprintf("volume %s of container %s is not shared, %s is already mounted at %s",
+						vol.Name, container.Name, prev.Name, vol.MountPath))
+				}
+				continue
+			}
+			mounted[vol.MountPath] = vol
+			volCp := vol.DeepCopy()
+			volCp.ReadOnly = true
+			mounts = append(mounts, *volCp)
+		}
+	}
+	return mounts, warnings
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTargetContainers(t *testing.T) {
+	containers := []corev1.Container{{Name: "istio-proxy"}, {Name: "app"}, {Name: "cache"}}
+	cases := []struct {
+		desc         string
+		annotation   string
+		containers   []corev1.Container
+		wantTargets  []string
+		wantWarnings int
+	}{
+		{
+			desc:        "first container by default",
+			containers:  containers,
+			wantTargets: []string{"istio-proxy"},
+		},
+		{
+			desc:        "no containers",
+			wantTargets: nil,
+		},
+		{
+			desc:        "annotated container",
+			annotation:  "app",
+			containers:  containers,
+			wantTargets: []string{"app"},
+		},
+		{
+			desc:        "several containers",
+			annotation:  "cache, app",
+			containers:  containers,
+			wantTargets: []string{"cache", "app"},
+		},
+		{
+			desc:         "unknown container is ignored",
+			annotation:   "app,db",
+			containers:   containers,
+			wantTargets:  []string{"app"},
+			wantWarnings: 1,
+		},
+		{
+			desc:         "no known container falls back to the first one",
+			annotation:   "db",
+			containers:   containers,
+			wantTargets:  []string{"istio-proxy"},
+			wantWarnings: 2,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{annotationTargetContainer: c.annotation}},
+				Spec:       corev1.PodSpec{Containers: c.containers},
+			}
+
+			targets, warnings := targetContainers(pod)
+
+			var names []string
+			for _, target := range targets {
+				names = append(names, target.Name)
+			}
+			assert.Equal(t, c.wantTargets, names)
+			assert.Len(t, warnings, c.wantWarnings)
+		})
+	}
+}
+
+func TestPassthroughEnv(t *testing.T) {
+	sm := newSidecarMutatorFromConfig(clusterName, defaultSidecarConfig(), K8sClients{
+		ConfigMaps: configMapsRetriever{"app-env": {"STATUS_URL": "http://127.0.0.1/status", "USER": "admin"}},
+		Secrets: &dummySecretRetriever{
+			namespace: "default",
+			name:      "db-credentials",
+			data:      map[string][]byte{"PASSWORD": []byte("s3cr3t")},
+		},
+	})
+	targets := []*corev1.Container{
+		{
+			Name: "app",
+			Env:  []corev1.EnvVar{{Name: "USER", Value: "root"}},
+			EnvFrom: []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"}}},
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}}},
+			},
+		},
+		{
+			Name: "db",
+			Env:  []corev1.EnvVar{{Name: "USER", Value: "db"}},
+			EnvFrom: []corev1.EnvFromSource{
+				{Prefix: "DB_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"}}},
+			},
+		},
+	}
+
+	env, warnings := sm.passthroughEnv("default", targets, map[string]string{
+		"USER":        "USERNAME",
+		"STATUS_URL":  "STATUS_URL",
+		"DB_PASSWORD": "PASSWORD",
+		"UNDEFINED":   "UNDEFINED",
+	})
+
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"},
+			Key:                  "PASSWORD",
+		}}},
+		{Name: "STATUS_URL", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "app-env"},
+			Key:                  "STATUS_URL",
+		}}},
+		{Name: "USERNAME", Value: "root"},
+	}, env)
+	assert.Equal(t, []string{"$UNDEFINED is not defined in the target containers, it is not passed through to the integrations"}, warnings)
+}
+
+func TestPassthroughEnvUnresolved(t *testing.T) {
+	optional := true
+	targets := []*corev1.Container{{
+		Name: "app",
+		Env: []corev1.EnvVar{
+			{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"},
+				Key:                  "pass",
+			}}},
+			{Name: "TOKEN", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "db-credentials"},
+				Key:                  "token",
+				Optional:             &optional,
+			}}},
+		},
+		EnvFrom: []corev1.EnvFromSource{
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "api-credentials"}}},
+		},
+	}}
+	envToArgs := map[string]string{"PASSWORD": "PASSWORD", "TOKEN": "TOKEN", "API_KEY": "API_KEY"}
+
+	// Without access to the secrets, envFrom variables are referenced as optional.
+	sm := NewSidecarMutator(clusterName, configMapsRetriever{})
+	env, warnings := sm.passthroughEnv("default", targets, envToArgs)
+	assert.Len(t, env, 3)
+	assert.Equal(t, corev1.EnvVar{Name: "API_KEY", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "api-credentials"},
+		Key:                  "API_KEY",
+		Optional:             &optional,
+	}}}, env[0])
+	assert.Equal(t, []string{"$API_KEY could not be looked up in the envFrom sources of container app, it is passed through as optional"}, warnings)
+
+	// With access to the secrets, missing keys are reported.
+	sm = newSidecarMutatorFromConfig(clusterName, defaultSidecarConfig(), K8sClients{
+		Secrets: &dummySecretRetriever{namespace: "default", name: "db-credentials", data: map[string][]byte{}},
+	})
+	env, warnings = sm.passthroughEnv("default", targets, envToArgs)
+	assert.Len(t, env, 2)
+	assert.Equal(t, []string{
+		"$API_KEY is not defined in the target containers, it is not passed through to the integrations",
+		"$PASSWORD references key pass of secret db-credentials, which does not exist",
+	}, warnings)
+}
+
+func TestSharedVolumeMounts(t *testing.T) {
+	targets := []*corev1.Container{
+		{Name: "app", VolumeMounts: []corev1.VolumeMount{
+			{Name: "logs", MountPath: "/var/log/app"},
+			{Name: "certs", MountPath: "/etc/certs"},
+		}},
+		{Name: "cache", VolumeMounts: []corev1.VolumeMount{
+			{Name: "logs", MountPath: "/var/log/app"},
+			{Name: "cache-certs", MountPath: "/etc/certs"},
+			{Name: "cache-data", MountPath: "/data", ReadOnly: false},
+		}},
+	}
+
+	mounts, warnings := sharedVolumeMounts(targets)
+
+	assert.Equal(t, []corev1.VolumeMount{
+		{Name: "logs", MountPath: "/var/log/app", ReadOnly: true},
+		{Name: "certs", MountPath: "/etc/certs", ReadOnly: true},
+		{Name: "cache-data", MountPath: "/data", ReadOnly: true},
+	}, mounts)
+	assert.Len(t, warnings, 1)
+	// The mounts of the pod are not modified.
+	assert.False(t, targets[0].VolumeMounts[0].ReadOnly)
+}
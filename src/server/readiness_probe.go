@@ -1,14 +1,28 @@
 package server
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 // TLSReadyReadinessProbe defines a readiness check for a Webhook struct based on the presence of its TLS certificate and key.
 // It requires the whole webhook as parameter to be able to RLock on the certificate for the presence confirmation.
+// The probe also fails when the certificate has expired, when the webhook is draining, and, when the webhook uses a
+// config map cache or an owner cache, until the cache is synced.
 func TLSReadyReadinessProbe(webhook *Webhook) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		webhook.RLock()
 		defer webhook.RUnlock()
 
+		if webhook.draining {
+			response := "Shutting down"
+			w.WriteHeader(503)
+			if _, err := w.Write([]byte(response)); err != nil {
+				webhook.Logger.Errorw("can't write response", "err", err, "response", response)
+			}
+			return
+		}
+
 		if webhook.Cert == nil {
 			response := "Certificate not present"
 			w.WriteHeader(503)
@@ -18,6 +32,33 @@ func TLSReadyReadinessProbe(webhook *Webhook) http.HandlerFunc {
 			return
 		}
 
+		if webhook.Cert.Leaf != nil && time.Now().After(webhook.Cert.Leaf.NotAfter) {
+			response := "Certificate expired"
+			w.WriteHeader(503)
+			if _, err := w.Write([]byte(response)); err != nil {
+				webhook.Logger.Errorw("can't write response", "err", err, "response", response)
+			}
+			return
+		}
+
+		if webhook.ConfigMapCache != nil && !webhook.ConfigMapCache.HasSynced() {
+			response := "ConfigMap cache not synced"
+			w.WriteHeader(503)
+			if _, err := w.Write([]byte(response)); err != nil {
+				webhook.Logger.Errorw("can't write response", "err", err, "response", response)
+			}
+			return
+		}
+
+		if owners, ok := webhook.Owners.(syncedCache); ok && !owners.HasSynced() {
+			response := "Owner cache not synced"
+			w.WriteHeader(503)
+			if _, err := w.Write([]byte(response)); err != nil {
+				webhook.Logger.Errorw("can't write response", "err", err, "response", response)
+			}
+			return
+		}
+
 		okResponse := "OK"
 		if _, err := w.Write([]byte(okResponse)); err != nil {
 			webhook.Logger.Errorw("can't write response", "err", err, "response", okResponse)
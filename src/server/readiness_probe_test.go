@@ -2,11 +2,14 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTLSReadyReadinessProbe(t *testing.T) {
@@ -42,3 +45,114 @@ func TestTLSReadyReadinessProbe(t *testing.T) {
 		})
 	}
 }
+
+type dummyConfigMapCache struct {
+	synced bool
+}
+
+func (d *dummyConfigMapCache) HasSynced() bool {
+	return d.synced
+}
+
+func (d *dummyConfigMapCache) WaitForConfigMap(namespace, name string, timeout time.Duration) bool {
+	return false
+}
+
+func TestTLSReadyReadinessProbeConfigMapCache(t *testing.T) {
+	cases := []struct {
+		desc         string
+		synced       bool
+		responseCode int
+	}{
+		{
+			desc:         "config map cache not synced (bad health)",
+			synced:       false,
+			responseCode: 503,
+		},
+		{
+			desc:         "config map cache synced (good health)",
+			synced:       true,
+			responseCode: 200,
+		},
+	}
+
+	webhook := Webhook{Cert: &tls.Certificate{}}
+	healthCheck := http.HandlerFunc(TLSReadyReadinessProbe(&webhook))
+	server := httptest.NewServer(healthCheck)
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			webhook.ConfigMapCache = &dummyConfigMapCache{synced: c.synced}
+
+			resp, err := http.Get(server.URL)
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.responseCode, resp.StatusCode)
+		})
+	}
+}
+
+type dummyOwnerCache struct {
+	dummyOwnerRetriever
+	synced bool
+}
+
+func (d *dummyOwnerCache) HasSynced() bool {
+	return d.synced
+}
+
+func TestTLSReadyReadinessProbeOwnerCache(t *testing.T) {
+	webhook := Webhook{Cert: &tls.Certificate{}}
+	server := httptest.NewServer(http.HandlerFunc(TLSReadyReadinessProbe(&webhook)))
+	defer server.Close()
+
+	// Owner lookups without a cache are always ready.
+	webhook.Owners = &dummyOwnerRetriever{}
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	webhook.Owners = &dummyOwnerCache{synced: false}
+	resp, err = http.Get(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+
+	webhook.Owners = &dummyOwnerCache{synced: true}
+	resp, err = http.Get(server.URL)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestTLSReadyReadinessProbeCertExpiry(t *testing.T) {
+	cases := []struct {
+		desc         string
+		notAfter     time.Time
+		responseCode int
+	}{
+		{
+			desc:         "certificate expired (bad health)",
+			notAfter:     time.Now().Add(-time.Minute),
+			responseCode: 503,
+		},
+		{
+			desc:         "certificate valid (good health)",
+			notAfter:     time.Now().Add(time.Hour),
+			responseCode: 200,
+		},
+	}
+
+	webhook := Webhook{}
+	healthCheck := http.HandlerFunc(TLSReadyReadinessProbe(&webhook))
+	server := httptest.NewServer(healthCheck)
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			webhook.Cert = &tls.Certificate{Leaf: &x509.Certificate{NotAfter: c.notAfter}}
+
+			resp, err := http.Get(server.URL)
+
+			assert.NoError(t, err)
+			assert.Equal(t, c.responseCode, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ListenAndServeTLS runs the webhook server until it is shut down. An unexpected error is kept so the liveness probe
+// fails and the pod is restarted.
+func (whsvr *Webhook) ListenAndServeTLS() error {
+	err := whsvr.Server.ListenAndServeTLS("", "")
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	whsvr.Lock()
+	whsvr.serveErr = err
+	whsvr.Unlock()
+	return err
+}
+
+// Shutdown drains the webhook before stopping its server. The readiness probe fails right away, so the pod is removed
+// from the endpoints of the service, and requests keep being served during the grace period, while the API servers
+// catch up. The server is then shut down, waiting for the ongoing requests until the timeout.
+func (whsvr *Webhook) Shutdown(gracePeriod, timeout time.Duration) error {
+	whsvr.Lock()
+	whsvr.draining = true
+	whsvr.Unlock()
+
+	whsvr.Logger.Infow("draining webhook server", "gracePeriod", gracePeriod, "timeout", timeout)
+	time.Sleep(gracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return whsvr.Server.Shutdown(ctx)
+}
+
+// LivenessProbe defines a liveness check that only fails when the webhook server stopped unexpectedly. Unlike the
+// readiness probe, it keeps succeeding while the certificate is missing or the webhook is draining, so the pod is not
+// restarted in those cases.
+func LivenessProbe(webhook *Webhook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhook.RLock()
+		serveErr := webhook.serveErr
+		webhook.RUnlock()
+
+		response := "OK"
+		if serveErr != nil {
+			response = "Webhook server stopped: " + serveErr.Error()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if _, err := w.Write([]byte(response)); err != nil {
+			webhook.Logger.Errorw("can't write response", "err", err, "response", response)
+		}
+	}
+}
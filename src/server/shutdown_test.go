@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestShutdownDrains(t *testing.T) {
+	whsvr := &Webhook{
+		Cert:   &tls.Certificate{},
+		Server: &http.Server{},
+		Logger: zap.NewNop().Sugar(),
+	}
+	readiness := httptest.NewServer(TLSReadyReadinessProbe(whsvr))
+	defer readiness.Close()
+	liveness := httptest.NewServer(LivenessProbe(whsvr))
+	defer liveness.Close()
+
+	resp, err := http.Get(readiness.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	done := make(chan error)
+	go func() { done <- whsvr.Shutdown(200*time.Millisecond, time.Second) }()
+
+	// The webhook is taken out of the endpoints during the grace period, but it is still alive.
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get(readiness.URL)
+		return err == nil && resp.StatusCode == http.StatusServiceUnavailable
+	}, 100*time.Millisecond, 10*time.Millisecond)
+	resp, err = http.Get(liveness.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned before the grace period: %v", err)
+	default:
+	}
+	assert.NoError(t, <-done)
+}
+
+func TestLivenessProbeServeError(t *testing.T) {
+	whsvr := &Webhook{
+		Server: &http.Server{Addr: "invalid address"},
+		Logger: zap.NewNop().Sugar(),
+	}
+	liveness := httptest.NewServer(LivenessProbe(whsvr))
+	defer liveness.Close()
+
+	// A missing certificate makes the webhook unready, but not dead.
+	resp, err := http.Get(liveness.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Error(t, whsvr.ListenAndServeTLS())
+	resp, err = http.Get(liveness.URL)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestListenAndServeTLSShutdown(t *testing.T) {
+	whsvr := &Webhook{
+		Server: &http.Server{Addr: "127.0.0.1:0"},
+		Logger: zap.NewNop().Sugar(),
+	}
+	whsvr.Server.TLSConfig = &tls.Config{GetCertificate: whsvr.GetCert}
+	done := make(chan error)
+	go func() { done <- whsvr.ListenAndServeTLS() }()
+	time.Sleep(50 * time.Millisecond)
+
+	require.NoError(t, whsvr.Shutdown(0, time.Second))
+	assert.NoError(t, <-done)
+	assert.Nil(t, whsvr.serveErr)
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -16,8 +18,14 @@ import (
 
 const (
 	annotationIntegrationConfigKey = "newrelic.com/integrations-sidecar-configmap"
+	annotationIntegrationSecretKey = "newrelic.com/integrations-sidecar-secret"
 	annotationIntegrationImage     = "newrelic.com/integrations-sidecar-imagename"
 	annotationStatusKey            = "newrelic.com/integrations-sidecar-injector-status"
+	annotationCPURequest           = "newrelic.com/integrations-sidecar-cpu-request"
+	annotationCPULimit             = "newrelic.com/integrations-sidecar-cpu-limit"
+	annotationMemoryRequest        = "newrelic.com/integrations-sidecar-memory-request"
+	annotationMemoryLimit          = "newrelic.com/integrations-sidecar-memory-limit"
+	annotationReadOnlyRootFS       = "newrelic.com/integrations-sidecar-read-only-root-filesystem"
 	integrationConfigVolumeName    = "integration-config"
 	tmpfsDataVolumeName            = "tmpfs-data"
 	tmpfsUserDataVolumeName        = "tmpfs-user-data"
@@ -27,9 +35,32 @@ const (
 	definitionKey                  = "definition.yaml"
 	injected                       = "injected"
 	defaultAgentDirPath            = "/nri-sidecar/newrelic-infra"
+	agentEnvPrefix                 = "NRIA"
+	defaultAgentCommand            = "/usr/bin/newrelic-infra"
 	maxLabelsCount                 = 50
 )
 
+// SecretForbiddenErr secret cannot be read by the webhook
+type SecretForbiddenErr struct {
+	namespace  string
+	secretName string
+}
+
+// Error returns the error message.
+func (e SecretForbiddenErr) Error() string {
+	return "secret cannot be read"
+}
+
+// SecretName returns secret name.
+func (e SecretForbiddenErr) SecretName() string {
+	return e.secretName
+}
+
+// Namespace returns the namespace of the secret.
+func (e SecretForbiddenErr) Namespace() string {
+	return e.namespace
+}
+
 var (
 	// (https://github.com/kubernetes/kubernetes/issues/57982)
 	defaulter = runtime.ObjectDefaulter(runtimeScheme)
@@ -41,13 +72,41 @@ type SidecarMutator struct {
 	containerDefinition *corev1.Container
 	envGenerator        *metadataEnvGenerator
 	cfgMapRtrv          configMapRetriever
-	nriaEnvVars         map[string]string
+	secretRtrv          secretRetriever
+	agentEnv            map[string]string
+	licenseKeySecret    *LicenseKeySecretConfig
+	licenseKeys         *licenseKeyCache
+	secretWriter        secretWriter
+	agentDir            string
+	strictValidation    bool
+	binaryPrefixes      []string
+	imagePolicy         ImagePolicyConfig
+	digests             *digestResolver
+	tmpfs               TmpfsConfig
+	jobSidecar          JobSidecarMode
+	command             []string
+	template            *sidecarTemplate
+	templateErr         error
 }
 
 type configMapRetriever interface {
 	ConfigMap(namespace, name string) (*corev1.ConfigMap, error)
 }
 
+type secretRetriever interface {
+	Secret(namespace, name string) (*corev1.Secret, error)
+}
+
+// sortedKeys returns the keys of the map in order, so the generated patches are the same for the same pod.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func boolPointer(b bool) *bool {
 	return &b
 }
@@ -56,48 +115,90 @@ func int64Pointer(i int64) *int64 {
 	return &i
 }
 
+func quantityPointer(q resource.Quantity) *resource.Quantity {
+	return &q
+}
+
 // NewSidecarMutator - create new sidecar mutator instance
 func NewSidecarMutator(clusterName string, cfgMapRtrv configMapRetriever) *SidecarMutator {
+	return newSidecarMutatorFromConfig(clusterName, defaultSidecarConfig(), K8sClients{ConfigMaps: cfgMapRtrv})
+}
+
+// configuredImages returns the images set in the configuration, whose repositories are allowed by the image policy, as
+// they do not come from the pods.
+func configuredImages(cfg SidecarConfig) []string {
+	images := []string{cfg.Image}
+	for _, name := range sortedKeys(cfg.ImagePolicy.IntegrationImages) {
+		images = append(images, cfg.ImagePolicy.IntegrationImages[name])
+	}
+	return images
+}
+
+func newSidecarMutatorFromConfig(clusterName string, cfg SidecarConfig, clients K8sClients) *SidecarMutator {
 	sm := &SidecarMutator{
 		clusterName: clusterName,
 		containerDefinition: &corev1.Container{
 			Name:            "newrelic-sidecar",
 			ImagePullPolicy: corev1.PullIfNotPresent,
-			Image:           defaultIntegrationImage,
-			SecurityContext: &corev1.SecurityContext{
-				AllowPrivilegeEscalation: boolPointer(false),
-				Privileged:               boolPointer(false),
-				RunAsNonRoot:             boolPointer(true),
-				ReadOnlyRootFilesystem:   boolPointer(false),
-				RunAsUser:                int64Pointer(1000),
-			},
-			Resources: corev1.ResourceRequirements{
-				Requests: corev1.ResourceList{
-					corev1.ResourceCPU:    resource.MustParse("100m"),
-					corev1.ResourceMemory: resource.MustParse("64Mi"),
-				},
-			},
+			Image:           cfg.Image,
+			SecurityContext: cfg.SecurityContext.DeepCopy(),
+			Resources:       *cfg.Resources.DeepCopy(),
 		},
 		envGenerator: &metadataEnvGenerator{
 			clusterName: clusterName,
+			ownerRtrv:   clients.Owners,
 		},
-		cfgMapRtrv:  cfgMapRtrv,
-		nriaEnvVars: map[string]string{},
-	}
-	// pass all env vars starting with NRIA in the injector to the sidecar (line the license)
-	for _, e := range os.Environ() {
-		if strings.HasPrefix(e, "NRIA") {
-			splits := strings.SplitN(e, "=", 2)
-			if len(splits) == 2 && splits[1] != "" {
-				sm.nriaEnvVars[splits[0]] = splits[1]
+		cfgMapRtrv:       clients.ConfigMaps,
+		secretRtrv:       clients.Secrets,
+		agentEnv:         map[string]string{},
+		agentDir:         cfg.AgentDir,
+		strictValidation: cfg.StrictValidation,
+		binaryPrefixes:   integrationBinaryPrefixes(cfg.AgentDir, cfg.IntegrationBinaryPaths),
+		imagePolicy:      cfg.ImagePolicy.withImages(configuredImages(cfg)...),
+		tmpfs:            cfg.Tmpfs.DeepCopy(),
+		secretWriter:     clients.SecretWriter,
+		jobSidecar:       resolveJobSidecarMode(cfg.JobSidecar, clients.ServerVersion),
+		command:          append([]string(nil), cfg.Command...),
+	}
+	if cfg.Template != "" {
+		sm.template, sm.templateErr = parseSidecarTemplate(cfg.Template)
+	}
+	if cfg.ImagePolicy.ResolveDigests {
+		ttl := defaultDigestCacheTTL
+		if cfg.ImagePolicy.DigestCacheTTL != nil {
+			ttl = cfg.ImagePolicy.DigestCacheTTL.Duration
+		}
+		sm.digests = newDigestResolver(ttl)
+	}
+	if cfg.LicenseKeySecret != nil {
+		licenseKeySecret := *cfg.LicenseKeySecret
+		sm.licenseKeySecret = &licenseKeySecret
+		sm.licenseKeys = newLicenseKeyCache(licenseKeyCacheTTL)
+	}
+	// pass the configured env vars of the injector to the sidecar, or all the ones starting with NRIA when none are
+	// configured, except the license when it comes from a secret
+	names := cfg.AgentEnv
+	if names == nil {
+		for _, e := range os.Environ() {
+			if strings.HasPrefix(e, agentEnvPrefix) {
+				names = append(names, strings.SplitN(e, "=", 2)[0])
 			}
 		}
 	}
+	for _, name := range names {
+		if name == licenseKeyEnvVar && sm.licenseKeySecret != nil {
+			continue
+		}
+		if value := os.Getenv(name); value != "" {
+			sm.agentEnv[name] = value
+		}
+	}
 	return sm
 }
 
 // ConfigMapNotFoundErr config map was not found
 type ConfigMapNotFoundErr struct {
+	namespace     string
 	configMapName string
 }
 
@@ -111,12 +212,39 @@ func (e ConfigMapNotFoundErr) ConfigMapName() string {
 	return e.configMapName
 }
 
+// Namespace returns the namespace where the config map was looked for.
+func (e ConfigMapNotFoundErr) Namespace() string {
+	return e.namespace
+}
+
+// SecretNotFoundErr secret was not found
+type SecretNotFoundErr struct {
+	namespace  string
+	secretName string
+}
+
+// Error returns the error message.
+func (e SecretNotFoundErr) Error() string {
+	return "secret not found"
+}
+
+// SecretName returns secret name.
+func (e SecretNotFoundErr) SecretName() string {
+	return e.secretName
+}
+
+// Namespace returns the namespace where the secret was looked for.
+func (e SecretNotFoundErr) Namespace() string {
+	return e.namespace
+}
+
 // (https://github.com/kubernetes/kubernetes/issues/57982)
-func applyDefaultsWorkaround(containers []corev1.Container, volumes []corev1.Volume) {
+func applyDefaultsWorkaround(initContainers, containers []corev1.Container, volumes []corev1.Volume) {
 	defaulter.Default(&corev1.Pod{
 		Spec: corev1.PodSpec{
-			Containers: containers,
-			Volumes:    volumes,
+			InitContainers: initContainers,
+			Containers:     containers,
+			Volumes:        volumes,
 		},
 	})
 }
@@ -125,8 +253,7 @@ func applyDefaultsWorkaround(containers []corev1.Container, volumes []corev1.Vol
 func (sm *SidecarMutator) mutationRequired(pod *corev1.Pod) bool {
 	annotations := pod.GetAnnotations()
 
-	return strings.ToLower(annotations[annotationStatusKey]) != injected &&
-		annotations[annotationIntegrationConfigKey] != ""
+	return strings.ToLower(annotations[annotationStatusKey]) != injected && sidecarRequested(pod)
 }
 
 func addContainer(target, added []corev1.Container, basePath string) (patch []PatchOperation) {
@@ -172,7 +299,8 @@ func addVolume(target, added []corev1.Volume, basePath string) (patch []PatchOpe
 }
 
 func updateAnnotation(target map[string]string, added map[string]string) (patch []PatchOperation) {
-	for key, value := range added {
+	for _, key := range sortedKeys(added) {
+		value := added[key]
 		if target == nil || target[key] == "" {
 			target = map[string]string{}
 			patch = append(patch, PatchOperation{
@@ -193,26 +321,55 @@ func updateAnnotation(target map[string]string, added map[string]string) (patch
 
 // Mutate - inject the sidecar into the pod
 func (sm *SidecarMutator) Mutate(pod *corev1.Pod) ([]PatchOperation, error) {
+	patch, _, err := sm.MutateWithWarnings(pod)
+	return patch, err
+}
+
+// MutateWithWarnings - inject the sidecar into the pod, explaining the settings of the pod that were ignored
+func (sm *SidecarMutator) MutateWithWarnings(pod *corev1.Pod) ([]PatchOperation, []string, error) {
 	// determine whether to perform mutation
 	if !sm.mutationRequired(pod) {
-		return nil, nil
+		if sidecarRequested(pod) {
+			// The pod is being resubmitted, e.g. with kubectl apply, after the sidecar was injected.
+			return nil, []string{"integrations sidecar already injected"}, nil
+		}
+		return nil, nil, nil
 	}
 
-	containers, volumes, err := sm.createSidecar(pod)
+	containers, volumes, warnings, err := sm.createSidecar(pod)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	// The sidecar would keep running after the Job is done, so it is either stopped by the kubelet as a native sidecar,
+	// or told to exit by the Job.
+	var initContainers []corev1.Container
+	var targetPatch []PatchOperation
+	if isJobPod(pod) {
+		switch sm.jobSidecar {
+		case JobSidecarNative:
+			restartPolicy := corev1.ContainerRestartPolicyAlways
+			containers[0].RestartPolicy = &restartPolicy
+			initContainers, containers = containers, nil
+		case JobSidecarSignal:
+			var signalWarnings []string
+			volumes, targetPatch, signalWarnings = terminationSignal(pod, &containers[0], volumes, sm.command)
+			warnings = append(warnings, signalWarnings...)
+		}
 	}
 
 	// Workaround: https://github.com/kubernetes/kubernetes/issues/57982
-	applyDefaultsWorkaround(containers, volumes)
+	applyDefaultsWorkaround(initContainers, containers, volumes)
 
-	return sm.createPatch(pod, containers, volumes, map[string]string{annotationStatusKey: injected})
+	patch, err := sm.createPatch(pod, initContainers, containers, volumes, map[string]string{annotationStatusKey: injected})
+	return append(patch, targetPatch...), warnings, err
 }
 
 // create mutation patch for resoures
-func (sm *SidecarMutator) createPatch(pod *corev1.Pod, containers []corev1.Container, volumes []corev1.Volume, annotations map[string]string) ([]PatchOperation, error) {
+func (sm *SidecarMutator) createPatch(pod *corev1.Pod, initContainers, containers []corev1.Container, volumes []corev1.Volume, annotations map[string]string) ([]PatchOperation, error) {
 	var patch []PatchOperation
 
+	patch = append(patch, addContainer(pod.Spec.InitContainers, initContainers, "/spec/initContainers")...)
 	patch = append(patch, addContainer(pod.Spec.Containers, containers, "/spec/containers")...)
 	patch = append(patch, addVolume(pod.Spec.Volumes, volumes, "/spec/volumes")...)
 	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
@@ -220,8 +377,13 @@ func (sm *SidecarMutator) createPatch(pod *corev1.Pod, containers []corev1.Conta
 	return patch, nil
 }
 
-func (sm *SidecarMutator) addEnvVars(pod *corev1.Pod, sidecar *corev1.Container, envToArgs map[string]string) {
-	sidecar.Env = sm.envGenerator.getVars(pod, &pod.Spec.Containers[0])
+func (sm *SidecarMutator) addEnvVars(pod *corev1.Pod, sidecar *corev1.Container, targets []*corev1.Container, envToArgs map[string]string) []string {
+	metadataContainer := &corev1.Container{}
+	if len(targets) > 0 {
+		metadataContainer = targets[0]
+	}
+	// The env vars of the template come first.
+	sidecar.Env = append(sidecar.Env, sm.envGenerator.getVars(pod, metadataContainer)...)
 
 	sidecar.Env = append(sidecar.Env, []corev1.EnvVar{
 		createEnvVarFromString("NRIA_IS_FORWARD_ONLY", "true"),
@@ -229,17 +391,20 @@ func (sm *SidecarMutator) addEnvVars(pod *corev1.Pod, sidecar *corev1.Container,
 		createEnvVarFromString("K8S_INTEGRATION", "true"),
 	}...)
 
-	for k, v := range sm.nriaEnvVars {
+	for _, k := range sortedKeys(sm.agentEnv) {
 		sidecar.Env = append(sidecar.Env, corev1.EnvVar{
 			Name:  k,
-			Value: v,
+			Value: sm.agentEnv[k],
 		})
 	}
+	if sm.licenseKeySecret != nil {
+		sidecar.Env = append(sidecar.Env, licenseKeyEnvVarFromSecret(sm.licenseKeySecret))
+	}
 
 	labels := ""
 	i := 0
-	for k, v := range pod.Labels {
-		labels += fmt.Sprintf("%s=%s,", k, v)
+	for _, k := range sortedKeys(pod.Labels) {
+		labels += fmt.Sprintf("%s=%s,", k, pod.Labels[k])
 		i++
 		// limit number of labels
 		if i > maxLabelsCount {
@@ -250,135 +415,423 @@ func (sm *SidecarMutator) addEnvVars(pod *corev1.Pod, sidecar *corev1.Container,
 		sidecar.Env = append(sidecar.Env, createEnvVarFromString("NEW_RELIC_METADATA_KUBERNETES_LABELS", labels[:len(labels)-1]))
 	}
 
-	if len(pod.Spec.Containers) > 0 {
-		for _, env := range pod.Spec.Containers[0].Env {
-			if arg := envToArgs[env.Name]; arg != "" {
-				e := env.DeepCopy()
-				e.Name = arg
-				sidecar.Env = append(sidecar.Env, *e)
-			}
-		}
-	}
+	passthrough, warnings := sm.passthroughEnv(pod.Namespace, targets, envToArgs)
+	sidecar.Env = append(sidecar.Env, passthrough...)
 	if len(envToArgs) > 0 {
 		envs := []string{}
-		for _, v := range envToArgs {
-			envs = append(envs, v)
+		for _, k := range sortedKeys(envToArgs) {
+			envs = append(envs, envToArgs[k])
 		}
 		sidecar.Env = append(sidecar.Env, createEnvVarFromString("NRIA_PASSTHROUGH_ENVIRONMENT", strings.Join(envs, ",")))
 	}
 
-	sidecar.Env = append(sidecar.Env, createEnvVarFromString("NRIA_AGENT_DIR", defaultAgentDirPath))
+	sidecar.Env = append(sidecar.Env, createEnvVarFromString("NRIA_AGENT_DIR", sm.agentDir))
+	return warnings
+}
+
+// mergeEnvToArgs adds the `$VAR` arguments of the integration config to envToArgs, which maps the env var of the pod
+// to the argument it is passed through as. It returns a warning for every argument already passed through from a
+// different env var by a previous integration.
+func mergeEnvToArgs(envToArgs map[string]string, intCfg integrationCfg, sourceName string) []string {
+	args := map[string]string{}
+	for env, arg := range envToArgs {
+		args[arg] = env
+	}
+
+	var warnings []string
+	for _, inst := range intCfg.Instances {
+		for _, k := range sortedKeys(inst.Arguments) {
+			v := inst.Arguments[k]
+			if !strings.HasPrefix(v, "$") {
+				continue
+			}
+			env, arg := v[1:], strings.ToUpper(k)
+			if prev, ok := args[arg]; ok && prev != env {
+				warnings = append(warnings, fmt.Sprintf("argument %s of %s is already passed through from $%s, ignoring $%s",
+					k, sourceName, prev, env))
+				continue
+			}
+			args[arg] = env
+			envToArgs[env] = arg
+		}
+	}
+	return warnings
 }
 
 type integrationCfg struct {
-	Instances []struct {
+	IntegrationName string `yaml:"integration_name"`
+	Instances       []struct {
 		Arguments map[string]string `yaml:"arguments"`
 	} `yaml:"instances"`
 }
 
-func (sm *SidecarMutator) createSidecar(pod *corev1.Pod) ([]corev1.Container, []corev1.Volume, error) {
-	containerDef := *sm.containerDefinition
+// resourceAnnotations maps the annotations overriding the sidecar resources to the resource they set.
+var resourceAnnotations = []struct {
+	annotation string
+	limit      bool
+	resource   corev1.ResourceName
+}{
+	{annotationCPURequest, false, corev1.ResourceCPU},
+	{annotationCPULimit, true, corev1.ResourceCPU},
+	{annotationMemoryRequest, false, corev1.ResourceMemory},
+	{annotationMemoryLimit, true, corev1.ResourceMemory},
+}
+
+// sidecarResources returns the resources of the sidecar, overriding the default ones with the resource annotations of
+// the pod. Invalid annotations are ignored, and explained in the returned warnings.
+func sidecarResources(pod *corev1.Pod, defaults corev1.ResourceRequirements) (corev1.ResourceRequirements, []string) {
+	resources := *defaults.DeepCopy()
+	var warnings []string
+
 	annotations := pod.GetAnnotations()
+	for _, ra := range resourceAnnotations {
+		value, ok := annotations[ra.annotation]
+		if !ok {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil || quantity.Sign() < 0 {
+			warnings = append(warnings, fmt.Sprintf("invalid quantity '%s' in annotation %s, using the default sidecar resources", value, ra.annotation))
+			continue
+		}
+		if ra.limit {
+			if resources.Limits == nil {
+				resources.Limits = corev1.ResourceList{}
+			}
+			resources.Limits[ra.resource] = quantity
+		} else {
+			if resources.Requests == nil {
+				resources.Requests = corev1.ResourceList{}
+			}
+			resources.Requests[ra.resource] = quantity
+		}
+	}
 
-	if configImageName := annotations[annotationIntegrationImage]; configImageName != "" {
-		containerDef.Image = configImageName
+	if err := validateResources(resources); err != nil {
+		warnings = append(warnings, fmt.Sprintf("invalid sidecar resources set by annotations (%s), using the default sidecar resources", err))
+		return *defaults.DeepCopy(), warnings
 	}
-	configMapName := annotations[annotationIntegrationConfigKey]
+	return resources, warnings
+}
 
-	cfgMap, err := sm.cfgMapRtrv.ConfigMap(pod.Namespace, configMapName)
+// sidecarSecurityContext returns the security context of the sidecar, making its root filesystem read-only or writable
+// as set by the newrelic.com/integrations-sidecar-read-only-root-filesystem annotation of the pod. The agent only
+// writes to the tmpfs volumes, so it can run with a read-only root filesystem.
+func sidecarSecurityContext(pod *corev1.Pod, defaults *corev1.SecurityContext) (*corev1.SecurityContext, []string) {
+	value, ok := pod.GetAnnotations()[annotationReadOnlyRootFS]
+	if !ok {
+		return defaults, nil
+	}
+	readOnly, err := strconv.ParseBool(value)
 	if err != nil {
-		if k8s_errors.IsNotFound(err) {
-			return nil, nil, &ConfigMapNotFoundErr{
-				configMapName: configMapName,
+		return defaults, []string{fmt.Sprintf("%s must be true or false, got '%s'", annotationReadOnlyRootFS, value)}
+	}
+	securityContext := &corev1.SecurityContext{}
+	if defaults != nil {
+		securityContext = defaults.DeepCopy()
+	}
+	securityContext.ReadOnlyRootFilesystem = &readOnly
+	return securityContext, nil
+}
+
+// integrationSource is the content of the ConfigMap or Secret holding the integration config of a pod, along with the
+// source of the volume mounting it.
+type integrationSource struct {
+	name         string
+	data         map[string]string
+	volumeSource corev1.VolumeSource
+}
+
+// integrationConfigs retrieves the integration configs of the pod from the Secrets listed in the
+// newrelic.com/integrations-sidecar-secret annotation or, otherwise, from the ConfigMaps listed in the
+// newrelic.com/integrations-sidecar-configmap one. Both annotations take a comma-separated list of names.
+func (sm *SidecarMutator) integrationConfigs(pod *corev1.Pod) ([]*integrationSource, []string, error) {
+	annotations := pod.GetAnnotations()
+
+	secretNames := splitNames(annotations[annotationIntegrationSecretKey])
+	if len(secretNames) == 0 {
+		var sources []*integrationSource
+		for _, name := range splitNames(annotations[annotationIntegrationConfigKey]) {
+			cfgMap, err := sm.configMap(pod.Namespace, name)
+			if err != nil {
+				return nil, nil, err
 			}
+			sources = append(sources, cfgMap)
 		}
-		return nil, nil, errors.Wrapf(err, "error retrieving config map '%s'", configMapName)
+		return sources, nil, nil
 	}
 
-	var intCfg integrationCfg
-	err = yaml.Unmarshal([]byte(cfgMap.Data[configKey]), &intCfg)
-	if err != nil {
-		return nil, nil, errors.Wrapf(err, "error unmarshaling integration config: %s", configMapName)
+	var warnings []string
+	if annotations[annotationIntegrationConfigKey] != "" {
+		warnings = append(warnings, fmt.Sprintf("both %s and %s annotations are set, using the secret",
+			annotationIntegrationSecretKey, annotationIntegrationConfigKey))
+	}
+	if sm.secretRtrv == nil {
+		return nil, warnings, fmt.Errorf("secrets are not available to the sidecar mutator")
 	}
 
-	envToArgs := map[string]string{}
-	for _, inst := range intCfg.Instances {
-		for k, v := range inst.Arguments {
-			if strings.HasPrefix(v, "$") {
-				envToArgs[v[1:]] = strings.ToUpper(k)
+	var sources []*integrationSource
+	for _, name := range secretNames {
+		secret, err := sm.secret(pod.Namespace, name)
+		if err != nil {
+			return nil, warnings, err
+		}
+		sources = append(sources, secret)
+	}
+	return sources, warnings, nil
+}
+
+// splitNames splits a comma-separated list of object names, dropping blanks and duplicates.
+func splitNames(value string) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+func (sm *SidecarMutator) secret(namespace, secretName string) (*integrationSource, error) {
+	secret, err := sm.secretRtrv.Secret(namespace, secretName)
+	if err != nil {
+		if k8s_errors.IsNotFound(err) {
+			return nil, &SecretNotFoundErr{
+				namespace:  namespace,
+				secretName: secretName,
+			}
+		}
+		if k8s_errors.IsForbidden(err) {
+			return nil, &SecretForbiddenErr{
+				namespace:  namespace,
+				secretName: secretName,
 			}
 		}
+		return nil, errors.Wrapf(err, "error retrieving secret '%s'", secretName)
 	}
 
-	volumes := []corev1.Volume{
-		{
-			Name: integrationConfigVolumeName,
-			VolumeSource: corev1.VolumeSource{
-				ConfigMap: &corev1.ConfigMapVolumeSource{
-					LocalObjectReference: corev1.LocalObjectReference{
-						Name: configMapName,
-					},
+	data := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return &integrationSource{
+		name: secretName,
+		data: data,
+		volumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: secretName},
+		},
+	}, nil
+}
+
+func (sm *SidecarMutator) configMap(namespace, configMapName string) (*integrationSource, error) {
+	cfgMap, err := sm.cfgMapRtrv.ConfigMap(namespace, configMapName)
+	if err != nil {
+		if k8s_errors.IsNotFound(err) {
+			return nil, &ConfigMapNotFoundErr{
+				namespace:     namespace,
+				configMapName: configMapName,
+			}
+		}
+		return nil, errors.Wrapf(err, "error retrieving config map '%s'", configMapName)
+	}
+	return &integrationSource{
+		name: configMapName,
+		data: cfgMap.Data,
+		volumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: configMapName,
 				},
 			},
 		},
-		{
-			Name: tmpfsDataVolumeName,
-		},
-		{
-			Name: tmpfsUserDataVolumeName,
-		},
-		{
-			Name: tmpfsTmpVolumeName,
-		},
+	}, nil
+}
+
+// baseSidecar returns the sidecar container and volumes the integration configs are added to, rendered from the
+// template when there is one.
+func (sm *SidecarMutator) baseSidecar(pod *corev1.Pod) (corev1.Container, []corev1.Volume, error) {
+	if sm.templateErr != nil {
+		return corev1.Container{}, nil, errors.Wrap(sm.templateErr, "invalid sidecar template")
+	}
+	if sm.template != nil {
+		spec, err := sm.template.render(pod, sm.clusterName, sm.agentDir)
+		if err != nil {
+			return corev1.Container{}, nil, err
+		}
+		containerDef := spec.Container
+		if containerDef.Image == "" {
+			containerDef.Image = sm.containerDefinition.Image
+		}
+		if containerDef.ImagePullPolicy == "" {
+			containerDef.ImagePullPolicy = sm.containerDefinition.ImagePullPolicy
+		}
+		if len(containerDef.Resources.Requests) == 0 && len(containerDef.Resources.Limits) == 0 {
+			containerDef.Resources = *sm.containerDefinition.Resources.DeepCopy()
+		}
+		return containerDef, spec.Volumes, nil
+	}
+
+	containerDef := *sm.containerDefinition
+	volumes := []corev1.Volume{
+		tmpfsVolume(tmpfsDataVolumeName, sm.tmpfs.DataSizeLimit),
+		tmpfsVolume(tmpfsUserDataVolumeName, sm.tmpfs.UserDataSizeLimit),
+		tmpfsVolume(tmpfsTmpVolumeName, sm.tmpfs.TmpSizeLimit),
 	}
 	containerDef.VolumeMounts = []corev1.VolumeMount{
-		{
-			Name:      integrationConfigVolumeName,
-			MountPath: defaultAgentDirPath + "/integrations.d/integration.yaml",
-			SubPath:   configKey,
-		},
-		{
-			Name:      integrationConfigVolumeName,
-			MountPath: defaultAgentDirPath + "/newrelic-integrations/definition.yaml",
-			SubPath:   definitionKey,
-		},
 		{
 			Name:      tmpfsDataVolumeName,
-			MountPath: defaultAgentDirPath + "/data",
+			MountPath: sm.agentDir + "/data",
 		},
 		{
 			Name:      tmpfsUserDataVolumeName,
-			MountPath: defaultAgentDirPath + "/user_data",
+			MountPath: sm.agentDir + "/user_data",
 		},
 		{
 			Name:      tmpfsTmpVolumeName,
 			MountPath: "/tmp",
 		},
 	}
+	return containerDef, volumes, nil
+}
+
+// tmpfsVolume returns a memory-backed emptyDir volume.
+func tmpfsVolume(name string, sizeLimit *resource.Quantity) corev1.Volume {
+	emptyDir := &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory}
+	if sizeLimit != nil {
+		limit := sizeLimit.DeepCopy()
+		emptyDir.SizeLimit = &limit
+	}
+	return corev1.Volume{
+		Name:         name,
+		VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir},
+	}
+}
+
+func (sm *SidecarMutator) createSidecar(pod *corev1.Pod) ([]corev1.Container, []corev1.Volume, []string, error) {
+	annotations := pod.GetAnnotations()
+
+	sources, warnings, err := sm.integrationConfigs(pod)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	containerDef, volumes, err := sm.baseSidecar(pod)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	resources, resourceWarnings := sidecarResources(pod, containerDef.Resources)
+	containerDef.Resources = resources
+	warnings = append(warnings, resourceWarnings...)
+	securityContext, securityContextWarnings := sidecarSecurityContext(pod, containerDef.SecurityContext)
+	containerDef.SecurityContext = securityContext
+	warnings = append(warnings, securityContextWarnings...)
 
-	// map the rest of the ConfigMap
-	if len(cfgMap.Data) > 2 {
-		for k := range cfgMap.Data {
-			if k != configKey && k != definitionKey {
-				vol := corev1.VolumeMount{
-					Name:      integrationConfigVolumeName,
-					MountPath: defaultAgentDirPath + "/user_data/" + k,
-					SubPath:   k,
-				}
-				containerDef.VolumeMounts = append(containerDef.VolumeMounts, vol)
+	var cfgVolumes []corev1.Volume
+	var cfgMounts, userDataMounts []corev1.VolumeMount
+	envToArgs := map[string]string{}
+	userDataFiles := map[string]string{}
+	var integrationNames []string
+	for i, source := range sources {
+		var intCfg integrationCfg
+		err = yaml.Unmarshal([]byte(source.data[configKey]), &intCfg)
+		if err != nil {
+			return nil, nil, nil, errors.Wrapf(err, "error unmarshaling integration config: %s", source.name)
+		}
+		if problems := validateIntegrationConfig(source.data, sm.binaryPrefixes); len(problems) > 0 {
+			if sm.strictValidation {
+				return nil, nil, nil, &IntegrationConfigInvalidErr{source: source.name, problems: problems}
+			}
+			for _, problem := range problems {
+				warnings = append(warnings, fmt.Sprintf("invalid integration config %s: %s", source.name, problem))
 			}
 		}
-	}
+		warnings = append(warnings, mergeEnvToArgs(envToArgs, intCfg, source.name)...)
+		integrationNames = append(integrationNames, intCfg.IntegrationName)
+
+		// A single integration keeps the historical file names, several ones are told apart by the source name.
+		volumeName := integrationConfigVolumeName
+		configFile, definitionFile := "integration.yaml", "definition.yaml"
+		if i > 0 {
+			volumeName = fmt.Sprintf("%s-%d", integrationConfigVolumeName, i)
+		}
+		if len(sources) > 1 {
+			configFile, definitionFile = source.name+".yaml", source.name+"-definition.yaml"
+		}
 
-	if len(pod.Spec.Containers) > 0 {
-		for _, vol := range pod.Spec.Containers[0].VolumeMounts {
-			volCp := vol.DeepCopy()
-			volCp.ReadOnly = true
-			containerDef.VolumeMounts = append(containerDef.VolumeMounts, *volCp)
+		cfgVolumes = append(cfgVolumes, corev1.Volume{
+			Name:         volumeName,
+			VolumeSource: source.volumeSource,
+		})
+		cfgMounts = append(cfgMounts,
+			corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: sm.agentDir + "/integrations.d/" + configFile,
+				SubPath:   configKey,
+			},
+			corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: sm.agentDir + "/newrelic-integrations/" + definitionFile,
+				SubPath:   definitionKey,
+			},
+		)
+
+		// map the rest of the ConfigMap or Secret
+		for _, k := range sortedKeys(source.data) {
+			if k == configKey || k == definitionKey {
+				continue
+			}
+			if owner, ok := userDataFiles[k]; ok {
+				warnings = append(warnings, fmt.Sprintf("file %s of %s is not mounted, %s already provides it", k, source.name, owner))
+				continue
+			}
+			userDataFiles[k] = source.name
+			userDataMounts = append(userDataMounts, corev1.VolumeMount{
+				Name:      volumeName,
+				MountPath: sm.agentDir + "/user_data/" + k,
+				SubPath:   k,
+			})
 		}
 	}
+	// The image set in the pod wins over the default image of its integrations, which wins over the configured one.
+	image := annotations[annotationIntegrationImage]
+	if image == "" {
+		image = sm.imagePolicy.integrationImage(integrationNames)
+	}
+	if image == "" {
+		image = containerDef.Image
+	}
+	var digestWarning string
+	containerDef.Image, digestWarning, err = sm.imagePolicy.resolve(image, sm.digests)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if digestWarning != "" {
+		warnings = append(warnings, digestWarning)
+	}
+
+	volumes = append(cfgVolumes, volumes...)
+	containerDef.VolumeMounts = append(append(cfgMounts, containerDef.VolumeMounts...), userDataMounts...)
+	// The apiserver rejects pods with duplicated container or volume names, so the ones already in the pod are renamed.
+	renameSidecarVolumes(pod, volumes, containerDef.VolumeMounts)
+	if name := sidecarContainerName(pod, containerDef.Name); name != containerDef.Name {
+		warnings = append(warnings, fmt.Sprintf("container %s already exists in the pod, the sidecar is named %s", containerDef.Name, name))
+		containerDef.Name = name
+	}
+
+	targets, targetWarnings := targetContainers(pod)
+	warnings = append(warnings, targetWarnings...)
+	sharedMounts, mountWarnings := sharedVolumeMounts(targets)
+	warnings = append(warnings, mountWarnings...)
+	sharedMounts, mountWarnings = withoutConflictingMounts(sharedMounts, containerDef.VolumeMounts, sm.agentDir)
+	containerDef.VolumeMounts = append(containerDef.VolumeMounts, sharedMounts...)
+	warnings = append(warnings, mountWarnings...)
 
-	sm.addEnvVars(pod, &containerDef, envToArgs)
+	warnings = append(warnings, sm.addEnvVars(pod, &containerDef, targets, envToArgs)...)
 
-	return []corev1.Container{containerDef}, volumes, nil
+	return []corev1.Container{containerDef}, volumes, warnings, nil
 }
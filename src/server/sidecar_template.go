@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// sidecarTemplate renders the base container and volumes of the sidecar, before the integration configs, the env vars
+// and the volume mounts shared with the pod are added to them.
+type sidecarTemplate struct {
+	tmpl *template.Template
+}
+
+// sidecarTemplateSpec is the YAML document the template renders to.
+type sidecarTemplateSpec struct {
+	Container corev1.Container `json:"container"`
+	Volumes   []corev1.Volume  `json:"volumes,omitempty"`
+}
+
+// sidecarTemplateData holds the values the template is rendered with. The values of the pod are set by whoever creates
+// it, so they are rendered as quoted YAML strings and cannot add fields to the sidecar, e.g. a hostPath volume. The
+// values of the configuration are rendered as they are.
+type sidecarTemplateData struct {
+	Pod         sidecarTemplatePod
+	Annotations map[string]podValue
+	ClusterName string
+	AgentDir    string
+}
+
+// sidecarTemplatePod holds the fields of the pod available to the template.
+type sidecarTemplatePod struct {
+	Name               podValue
+	GenerateName       podValue
+	Namespace          podValue
+	Labels             map[string]podValue
+	Annotations        map[string]podValue
+	ServiceAccountName podValue
+}
+
+// podValue is a value of the pod, rendered by the template as a double quoted YAML string.
+type podValue string
+
+func (v podValue) String() string {
+	b, _ := json.Marshal(string(v))
+	return string(b)
+}
+
+// podValues returns the values of the labels or annotations of the pod. The keys the apiserver would reject are left
+// out, as they could not be used with index anyway.
+func podValues(m map[string]string) map[string]podValue {
+	values := make(map[string]podValue, len(m))
+	for k, v := range m {
+		if len(validation.IsQualifiedName(k)) == 0 {
+			values[k] = podValue(v)
+		}
+	}
+	return values
+}
+
+// rawValue returns the value as it is, unquoted.
+func rawValue(value interface{}) string {
+	if v, ok := value.(podValue); ok {
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
+
+var sidecarTemplateFuncs = template.FuncMap{
+	// default returns the value, or the default when the value is empty, e.g. {{ index .Annotations "x" | default "y" }}.
+	"default": func(def string, value podValue) podValue {
+		if value == "" {
+			return podValue(def)
+		}
+		return value
+	},
+	// quote returns the value as a double quoted YAML string. The values of the pod already are.
+	"quote": func(value interface{}) podValue {
+		return podValue(rawValue(value))
+	},
+	// concat joins the values into a double quoted YAML string, e.g. {{ concat "nri-" .Pod.Namespace }}.
+	"concat": func(values ...interface{}) podValue {
+		var b strings.Builder
+		for _, v := range values {
+			b.WriteString(rawValue(v))
+		}
+		return podValue(b.String())
+	},
+}
+
+// parseSidecarTemplate parses the template and checks that it renders a valid sidecar for an example pod.
+func parseSidecarTemplate(text string) (*sidecarTemplate, error) {
+	tmpl, err := template.New("sidecar").Funcs(sidecarTemplateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &sidecarTemplate{tmpl: tmpl}
+
+	example := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "example", Namespace: metav1.NamespaceDefault},
+	}
+	if _, err := t.render(example, "cluster", defaultAgentDirPath); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// render renders the template for the pod and validates the resulting container and volumes.
+func (t *sidecarTemplate) render(pod *corev1.Pod, clusterName, agentDir string) (*sidecarTemplateSpec, error) {
+	annotations := podValues(pod.Annotations)
+	data := sidecarTemplateData{
+		Pod: sidecarTemplatePod{
+			Name:               podValue(pod.Name),
+			GenerateName:       podValue(pod.GenerateName),
+			Namespace:          podValue(pod.Namespace),
+			Labels:             podValues(pod.Labels),
+			Annotations:        annotations,
+			ServiceAccountName: podValue(pod.Spec.ServiceAccountName),
+		},
+		Annotations: annotations,
+		ClusterName: clusterName,
+		AgentDir:    agentDir,
+	}
+
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&out, data); err != nil {
+		return nil, errors.Wrap(err, "error rendering sidecar template")
+	}
+	var spec sidecarTemplateSpec
+	if err := yaml.UnmarshalStrict(out.Bytes(), &spec); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling rendered sidecar template")
+	}
+	if err := spec.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid rendered sidecar template")
+	}
+	return &spec, nil
+}
+
+// validate checks the names of the container and volumes, and that the volume mounts of the container reference the
+// volumes of the template.
+func (s *sidecarTemplateSpec) validate() error {
+	if problems := validation.IsDNS1123Label(s.Container.Name); len(problems) > 0 {
+		return fmt.Errorf("container.name '%s': %s", s.Container.Name, problems[0])
+	}
+	volumes := map[string]bool{}
+	for i, v := range s.Volumes {
+		if problems := validation.IsDNS1123Label(v.Name); len(problems) > 0 {
+			return fmt.Errorf("volumes[%d].name '%s': %s", i, v.Name, problems[0])
+		}
+		if volumes[v.Name] {
+			return fmt.Errorf("volumes[%d].name '%s' is duplicated", i, v.Name)
+		}
+		volumes[v.Name] = true
+	}
+	for i, m := range s.Container.VolumeMounts {
+		if !volumes[m.Name] {
+			return fmt.Errorf("container.volumeMounts[%d] references volume '%s', which is not in volumes", i, m.Name)
+		}
+		if m.MountPath == "" {
+			return fmt.Errorf("container.volumeMounts[%d].mountPath is required", i)
+		}
+	}
+	if err := validateResources(s.Container.Resources); err != nil {
+		return errors.Wrap(err, "container.resources")
+	}
+	return nil
+}
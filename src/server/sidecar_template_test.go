@@ -0,0 +1,188 @@
+package server
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseSidecarTemplateErrors(t *testing.T) {
+	cases := []struct {
+		desc     string
+		template string
+	}{
+		{
+			desc:     "template syntax",
+			template: "container:\n  name: {{ .Pod.Name",
+		},
+		{
+			desc:     "unknown field",
+			template: "container:\n  name: sidecar\n  unknown: true",
+		},
+		{
+			desc:     "missing container name",
+			template: "container:\n  image: nginx",
+		},
+		{
+			desc:     "invalid volume name",
+			template: "container:\n  name: sidecar\nvolumes:\n- name: Data",
+		},
+		{
+			desc:     "duplicated volume",
+			template: "container:\n  name: sidecar\nvolumes:\n- name: data\n- name: data",
+		},
+		{
+			desc:     "mount of unknown volume",
+			template: "container:\n  name: sidecar\n  volumeMounts:\n  - name: data\n    mountPath: /data",
+		},
+		{
+			desc:     "request greater than limit",
+			template: "container:\n  name: sidecar\n  resources:\n    requests:\n      cpu: 200m\n    limits:\n      cpu: 100m",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			_, err := parseSidecarTemplate(c.template)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCreateSidecarFromTemplate(t *testing.T) {
+	tmpl, err := ioutil.ReadFile("testdata/sidecarTemplate.yaml")
+	require.NoError(t, err)
+
+	cfg := defaultSidecarConfig()
+	cfg.Image = "newrelic/nri-default:1.0.0"
+	cfg.Template = string(tmpl)
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{
+		ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}},
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "production",
+			Annotations: map[string]string{
+				annotationIntegrationConfigKey: configName,
+				"example.com/sidecar-cpu":      "300m",
+				annotationMemoryLimit:          "256Mi",
+			},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	containers, volumes, warnings, err := sm.createSidecar(pod)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	require.Len(t, containers, 1)
+	sidecar := containers[0]
+
+	assert.Equal(t, "newrelic-sidecar", sidecar.Name)
+	assert.Equal(t, "newrelic/nri-default:1.0.0", sidecar.Image)
+	assert.Equal(t, corev1.PullIfNotPresent, sidecar.ImagePullPolicy)
+	assert.Equal(t, int64(2000), *sidecar.SecurityContext.RunAsUser)
+	require.NotNil(t, sidecar.Lifecycle)
+	assert.NotNil(t, sidecar.Lifecycle.PreStop)
+	assertResourceList(t, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("300m")}, sidecar.Resources.Requests)
+	assertResourceList(t, corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")}, sidecar.Resources.Limits)
+
+	// The env vars of the template are kept, before the ones added by the webhook.
+	assert.Equal(t, corev1.EnvVar{Name: "POD_NAMESPACE", Value: "production"}, sidecar.Env[0])
+	assert.Equal(t, defaultAgentDirPath, containerEnv(sidecar)["NRIA_AGENT_DIR"].Value)
+
+	// The volumes of the template replace the default tmpfs volumes.
+	volumeNames := []string{}
+	for _, v := range volumes {
+		volumeNames = append(volumeNames, v.Name)
+	}
+	assert.Equal(t, []string{integrationConfigVolumeName, "agent-data", "agent-tmp"}, volumeNames)
+	assert.Equal(t, corev1.StorageMediumMemory, volumes[1].EmptyDir.Medium)
+	mountPaths := []string{}
+	for _, m := range sidecar.VolumeMounts {
+		mountPaths = append(mountPaths, m.MountPath)
+	}
+	assert.Equal(t, []string{
+		defaultAgentDirPath + "/integrations.d/integration.yaml",
+		defaultAgentDirPath + "/newrelic-integrations/definition.yaml",
+		defaultAgentDirPath + "/data",
+		"/tmp",
+	}, mountPaths)
+
+	// Without the annotation, the default of the template is used.
+	delete(pod.Annotations, "example.com/sidecar-cpu")
+	containers, _, _, err = sm.createSidecar(pod)
+	require.NoError(t, err)
+	assertResourceList(t, corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("50m")}, containers[0].Resources.Requests)
+}
+
+func TestSidecarTemplateEscapesPodValues(t *testing.T) {
+	cfg := defaultSidecarConfig()
+	cfg.Image = "newrelic/nri-default:1.0.0"
+	cfg.ImagePolicy.AllowedRepositories = []string{"newrelic/*"}
+	cfg.Template = `container:
+  name: newrelic-sidecar
+  env:
+  - name: TEAM
+    value: {{ index .Annotations "example.com/team" }}
+  - name: SIDECAR_ID
+    value: {{ concat "nri-" .Pod.Namespace "-" (index .Pod.Labels "app") }}
+  - name: INVALID_KEY
+    value: {{ index .Annotations "bad key: x" | default "none" }}
+`
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{
+		ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}},
+	})
+	require.NoError(t, sm.templateErr)
+
+	malicious := "ops\n  image: evil.example.com/agent:latest\nvolumes:\n- name: host\n  hostPath:\n    path: /"
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "production",
+			Labels:    map[string]string{"app": "shop"},
+			Annotations: map[string]string{
+				annotationIntegrationConfigKey: configName,
+				"example.com/team":             malicious,
+				"bad key: x":                   "injected",
+			},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	containers, volumes, _, err := sm.createSidecar(pod)
+	require.NoError(t, err)
+	sidecar := containers[0]
+
+	// The annotation is a plain string value, it cannot add fields to the sidecar.
+	assert.Equal(t, "newrelic/nri-default:1.0.0", sidecar.Image)
+	assert.Equal(t, malicious, containerEnv(sidecar)["TEAM"].Value)
+	for _, v := range volumes {
+		assert.Nil(t, v.HostPath, "volume %s", v.Name)
+	}
+	assert.Equal(t, "nri-production-shop", containerEnv(sidecar)["SIDECAR_ID"].Value)
+	assert.Equal(t, "none", containerEnv(sidecar)["INVALID_KEY"].Value)
+}
+
+func TestSidecarTemplateImagePolicy(t *testing.T) {
+	cfg := defaultSidecarConfig()
+	cfg.ImagePolicy.AllowedRepositories = []string{"newrelic/*"}
+	cfg.Template = "container:\n  name: newrelic-sidecar\n  image: evil.example.com/agent:1.0.0\n"
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{
+		ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}},
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Annotations: map[string]string{annotationIntegrationConfigKey: configName},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	_, _, _, err := sm.createSidecar(pod)
+	require.Error(t, err)
+	assert.IsType(t, &ImageNotAllowedErr{}, err)
+}
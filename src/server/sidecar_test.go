@@ -0,0 +1,319 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestSidecarResources(t *testing.T) {
+	cases := []struct {
+		desc         string
+		annotations  map[string]string
+		wantRequests corev1.ResourceList
+		wantLimits   corev1.ResourceList
+		wantWarnings int
+	}{
+		{
+			desc: "defaults",
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+		},
+		{
+			desc: "requests and limits from annotations",
+			annotations: map[string]string{
+				annotationCPURequest:    "50m",
+				annotationCPULimit:      "200m",
+				annotationMemoryRequest: "32Mi",
+				annotationMemoryLimit:   "128Mi",
+			},
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("50m"),
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+			wantLimits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("200m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+		},
+		{
+			desc: "invalid quantity is ignored",
+			annotations: map[string]string{
+				annotationCPURequest:  "lots",
+				annotationMemoryLimit: "128Mi",
+			},
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+			wantLimits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+			wantWarnings: 1,
+		},
+		{
+			desc: "limit lower than request falls back to the defaults",
+			annotations: map[string]string{
+				annotationMemoryLimit: "32Mi",
+			},
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+			wantWarnings: 1,
+		},
+	}
+
+	sm := NewSidecarMutator(clusterName, nil)
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+
+			resources, warnings := sidecarResources(pod, sm.containerDefinition.Resources)
+
+			assert.Len(t, warnings, c.wantWarnings)
+			assertResourceList(t, c.wantRequests, resources.Requests)
+			assertResourceList(t, c.wantLimits, resources.Limits)
+		})
+	}
+	// The configured resources are not modified.
+	assert.Empty(t, sm.containerDefinition.Resources.Limits)
+}
+
+func TestSidecarSecurityContext(t *testing.T) {
+	cases := []struct {
+		desc         string
+		annotations  map[string]string
+		wantReadOnly bool
+		wantWarnings int
+	}{
+		{
+			desc: "defaults",
+		},
+		{
+			desc:         "read-only root filesystem",
+			annotations:  map[string]string{annotationReadOnlyRootFS: "true"},
+			wantReadOnly: true,
+		},
+		{
+			desc:         "invalid value is ignored",
+			annotations:  map[string]string{annotationReadOnlyRootFS: "yes please"},
+			wantWarnings: 1,
+		},
+	}
+
+	sm := NewSidecarMutator(clusterName, nil)
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: c.annotations}}
+
+			securityContext, warnings := sidecarSecurityContext(pod, sm.containerDefinition.SecurityContext)
+
+			assert.Len(t, warnings, c.wantWarnings)
+			require.NotNil(t, securityContext.ReadOnlyRootFilesystem)
+			assert.Equal(t, c.wantReadOnly, *securityContext.ReadOnlyRootFilesystem)
+			assert.Equal(t, int64(1000), *securityContext.RunAsUser)
+		})
+	}
+	// The configured security context is not modified.
+	assert.False(t, *sm.containerDefinition.SecurityContext.ReadOnlyRootFilesystem)
+
+	securityContext, _ := sidecarSecurityContext(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{annotationReadOnlyRootFS: "true"},
+	}}, nil)
+	assert.True(t, *securityContext.ReadOnlyRootFilesystem)
+}
+
+func TestTmpfsVolumes(t *testing.T) {
+	cfg := defaultSidecarConfig()
+	cfg.Tmpfs.TmpSizeLimit = nil
+	sm := newSidecarMutatorFromConfig(clusterName, cfg, K8sClients{ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}}})
+
+	_, volumes, _, err := sm.createSidecar(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Annotations: map[string]string{annotationIntegrationConfigKey: configName}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	})
+	require.NoError(t, err)
+	sizeLimits := map[string]string{}
+	for _, v := range volumes[1:] {
+		require.NotNil(t, v.EmptyDir, v.Name)
+		assert.Equal(t, corev1.StorageMediumMemory, v.EmptyDir.Medium, v.Name)
+		sizeLimits[v.Name] = ""
+		if v.EmptyDir.SizeLimit != nil {
+			sizeLimits[v.Name] = v.EmptyDir.SizeLimit.String()
+		}
+	}
+	assert.Equal(t, map[string]string{
+		tmpfsDataVolumeName:     "32Mi",
+		tmpfsUserDataVolumeName: "8Mi",
+		tmpfsTmpVolumeName:      "",
+	}, sizeLimits)
+}
+
+func TestCreateSidecarFromSecret(t *testing.T) {
+	secrets := &dummySecretRetriever{
+		namespace: "default",
+		name:      "my-secret",
+		data: map[string][]byte{
+			configKey:     []byte("integration_name: com.newrelic.redis\ninstances:\n  - name: redis\n    command: metrics\n    arguments:\n      password: $REDIS_PASSWORD"),
+			definitionKey: []byte("name: com.newrelic.redis\ncommands:\n  metrics:\n    command: [./bin/nri-redis]"),
+			"ca.pem":      []byte("ca"),
+		},
+	}
+	sm := newSidecarMutatorFromConfig(clusterName, defaultSidecarConfig(), K8sClients{
+		ConfigMaps: makeConfigMapRetriever("default", configName, map[string]string{configKey: integrationConfig}),
+		Secrets:    secrets,
+	})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Annotations: map[string]string{annotationIntegrationSecretKey: "my-secret"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "redis",
+			Env:  []corev1.EnvVar{{Name: "REDIS_PASSWORD", Value: "s3cr3t"}},
+		}}},
+	}
+	containers, volumes, warnings, err := sm.createSidecar(pod)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+	require.Len(t, containers, 1)
+	require.NotNil(t, volumes[0].Secret)
+	assert.Equal(t, "my-secret", volumes[0].Secret.SecretName)
+	assert.Nil(t, volumes[0].ConfigMap)
+	assert.Contains(t, containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      integrationConfigVolumeName,
+		MountPath: defaultAgentDirPath + "/user_data/ca.pem",
+		SubPath:   "ca.pem",
+	})
+	assert.Contains(t, containers[0].Env, corev1.EnvVar{Name: "PASSWORD", Value: "s3cr3t"})
+
+	// The secret takes precedence over the config map.
+	pod.Annotations[annotationIntegrationConfigKey] = configName
+	_, volumes, warnings, err = sm.createSidecar(pod)
+	require.NoError(t, err)
+	assert.Len(t, warnings, 1)
+	assert.NotNil(t, volumes[0].Secret)
+
+	pod.Annotations[annotationIntegrationSecretKey] = "missing"
+	_, _, _, err = sm.createSidecar(pod)
+	sErr, ok := err.(*SecretNotFoundErr)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.Equal(t, "missing", sErr.SecretName())
+	assert.Equal(t, "default", sErr.Namespace())
+}
+
+func TestCreateSidecarMultipleConfigMaps(t *testing.T) {
+	cfgMaps := configMapsRetriever{
+		"nginx-config": {
+			configKey:     "integration_name: com.newrelic.nginx\ninstances:\n  - name: nginx\n    command: metrics\n    arguments:\n      status_url: $STATUS_URL",
+			definitionKey: "name: com.newrelic.nginx\ncommands:\n  metrics:\n    command: [./bin/nri-nginx]\n    interval: 15",
+			"nginx.pem":   "pem",
+		},
+		"redis-config": {
+			configKey:   "integration_name: com.newrelic.redis\ninstances:\n  - name: redis\n    command: metrics\n    arguments:\n      password: $REDIS_PASSWORD\n      status_url: $REDIS_URL",
+			"nginx.pem": "other",
+		},
+	}
+	sm := NewSidecarMutator(clusterName, cfgMaps)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Annotations: map[string]string{annotationIntegrationConfigKey: "nginx-config, redis-config,nginx-config"},
+		},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name: "app",
+			Env: []corev1.EnvVar{
+				{Name: "STATUS_URL", Value: "http://127.0.0.1/status"},
+				{Name: "REDIS_PASSWORD", Value: "s3cr3t"},
+				{Name: "REDIS_URL", Value: "redis://127.0.0.1"},
+			},
+		}}},
+	}
+	containers, volumes, warnings, err := sm.createSidecar(pod)
+	require.NoError(t, err)
+	require.Len(t, containers, 1)
+
+	// One warning for the conflicting status_url argument and one for the duplicated nginx.pem file.
+	assert.Len(t, warnings, 2)
+	require.Len(t, volumes, 5)
+	assert.Equal(t, integrationConfigVolumeName, volumes[0].Name)
+	assert.Equal(t, "nginx-config", volumes[0].ConfigMap.Name)
+	assert.Equal(t, integrationConfigVolumeName+"-1", volumes[1].Name)
+	assert.Equal(t, "redis-config", volumes[1].ConfigMap.Name)
+
+	mounts := map[string]string{}
+	for _, m := range containers[0].VolumeMounts {
+		mounts[m.MountPath] = m.Name + "/" + m.SubPath
+	}
+	assert.Equal(t, map[string]string{
+		defaultAgentDirPath + "/integrations.d/nginx-config.yaml":                   "integration-config/config.yaml",
+		defaultAgentDirPath + "/newrelic-integrations/nginx-config-definition.yaml": "integration-config/definition.yaml",
+		defaultAgentDirPath + "/integrations.d/redis-config.yaml":                   "integration-config-1/config.yaml",
+		defaultAgentDirPath + "/newrelic-integrations/redis-config-definition.yaml": "integration-config-1/definition.yaml",
+		defaultAgentDirPath + "/user_data/nginx.pem":                                "integration-config/nginx.pem",
+		defaultAgentDirPath + "/data":                                               tmpfsDataVolumeName + "/",
+		defaultAgentDirPath + "/user_data":                                          tmpfsUserDataVolumeName + "/",
+		"/tmp":                                                                      tmpfsTmpVolumeName + "/",
+	}, mounts)
+
+	env := map[string]string{}
+	for _, e := range containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	assert.Equal(t, "http://127.0.0.1/status", env["STATUS_URL"])
+	assert.Equal(t, "s3cr3t", env["PASSWORD"])
+	assert.Equal(t, "PASSWORD,STATUS_URL", env["NRIA_PASSTHROUGH_ENVIRONMENT"])
+
+	pod.Annotations[annotationIntegrationConfigKey] = "nginx-config,missing"
+	_, _, _, err = sm.createSidecar(pod)
+	cErr, ok := err.(*ConfigMapNotFoundErr)
+	require.True(t, ok, "unexpected error: %v", err)
+	assert.Equal(t, "missing", cErr.ConfigMapName())
+}
+
+// configMapsRetriever retrieves the data of the config maps by name, in any namespace.
+type configMapsRetriever map[string]map[string]string
+
+func (cmr configMapsRetriever) ConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
+	data, ok := cmr[name]
+	if !ok {
+		return nil, k8s_errors.NewNotFound(schema.GroupResource{}, name)
+	}
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}, Data: data}, nil
+}
+
+type dummySecretRetriever struct {
+	namespace string
+	name      string
+	data      map[string][]byte
+}
+
+func (dsr *dummySecretRetriever) Secret(namespace, name string) (*corev1.Secret, error) {
+	if dsr.namespace == namespace && dsr.name == name {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       dsr.data,
+		}, nil
+	}
+	return nil, k8s_errors.NewNotFound(schema.GroupResource{}, name)
+}
+
+func assertResourceList(t *testing.T, expected, actual corev1.ResourceList) {
+	t.Helper()
+	assert.Len(t, actual, len(expected))
+	for name, q := range expected {
+		assert.True(t, q.Equal(actual[name]), "%s: expected %s, got %s", name, q.String(), actual.Name(name, resource.DecimalSI).String())
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// skippedStatusPrefix is prepended to the reason in the status annotation of the pods the sidecar was not injected in.
+	skippedStatusPrefix = "skipped:"
+
+	skipReasonNamespaceIgnored  = "namespace-ignored"
+	skipReasonConfigMapNotFound = "configmap-not-found"
+	skipReasonSecretNotFound    = "secret-not-found"
+	skipReasonSecretForbidden   = "secret-forbidden"
+	skipReasonImageNotAllowed   = "image-not-allowed"
+
+	eventReasonSidecarSkipped = "IntegrationsSidecarSkipped"
+)
+
+// eventRecorder records K8s Events. It is satisfied by record.EventRecorder.
+type eventRecorder interface {
+	Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{})
+}
+
+// sidecarSkip explains why the sidecar requested by a pod was not injected.
+type sidecarSkip struct {
+	reason  string
+	message string
+}
+
+// sidecarRequested returns whether the pod asks for the integrations sidecar.
+func sidecarRequested(pod *corev1.Pod) bool {
+	annotations := pod.GetAnnotations()
+	return annotations[annotationIntegrationConfigKey] != "" || annotations[annotationIntegrationSecretKey] != ""
+}
+
+// skipSidecar stamps the reason of the skip in the status annotation of the pod, and explains it to the user with an
+// admission warning and, unless it is a dry-run request, an Event on the workload owning the pod.
+func (whsvr *Webhook) skipSidecar(pod *corev1.Pod, skip sidecarSkip, dryRun bool, events eventRecorder, owners ownerRetriever) ([]PatchOperation, string) {
+	sidecarSkipsTotal.WithLabelValues(skip.reason).Inc()
+	whsvr.Logger.Infow("skipped sidecar injection", "namespace", pod.Namespace, "pod", pod.Name, "reason", skip.reason)
+
+	warning := fmt.Sprintf("integrations sidecar not injected: %s", skip.message)
+	if events != nil && !dryRun {
+		if workload := workloadOf(pod, owners); workload != nil {
+			events.Eventf(workload, corev1.EventTypeWarning, eventReasonSidecarSkipped, "Pod %s: %s", podDisplayName(pod), warning)
+		}
+	}
+
+	patch := updateAnnotation(pod.Annotations, map[string]string{annotationStatusKey: skippedStatusPrefix + skip.reason})
+	return patch, warning
+}
+
+// workloadOf returns a reference to the workload owning the pod, following ReplicaSets up to their Deployment and Jobs
+// up to their CronJob when owners is set. It returns nil for pods without an owner.
+func workloadOf(pod *corev1.Pod, owners ownerRetriever) *corev1.ObjectReference {
+	owner := podOwner(pod)
+	if owner == nil {
+		return nil
+	}
+	if owners != nil && (owner.Kind == "ReplicaSet" || owner.Kind == "Job") {
+		if controller, err := owners.ControllerOf(pod.Namespace, owner.Kind, owner.Name); err == nil && controller != nil {
+			owner = controller
+		}
+	}
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  pod.Namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
+
+// podDisplayName returns the name of the pod, or its generateName prefix when the name is not set yet.
+func podDisplayName(pod *corev1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName + "*"
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestServeHTTPSkippedSidecar(t *testing.T) {
+	cases := []struct {
+		name           string
+		namespace      string
+		annotations    map[string]string
+		expectedStatus string
+		expectedEvents int
+	}{
+		{
+			name:           "ignored namespace",
+			namespace:      metav1.NamespaceSystem,
+			annotations:    map[string]string{annotationIntegrationConfigKey: configName},
+			expectedStatus: "skipped:namespace-ignored",
+			expectedEvents: 1,
+		},
+		{
+			name:           "config map not found",
+			namespace:      "default",
+			annotations:    map[string]string{annotationIntegrationConfigKey: "wrong"},
+			expectedStatus: "skipped:configmap-not-found",
+			expectedEvents: 1,
+		},
+		{
+			name:           "image not allowed",
+			namespace:      "default",
+			annotations:    map[string]string{annotationIntegrationConfigKey: configName, annotationIntegrationImage: "evil/sidecar"},
+			expectedStatus: "skipped:image-not-allowed",
+			expectedEvents: 1,
+		},
+		{
+			name:           "secret forbidden",
+			namespace:      "default",
+			annotations:    map[string]string{annotationIntegrationSecretKey: "credentials"},
+			expectedStatus: "skipped:secret-forbidden",
+			expectedEvents: 1,
+		},
+		{
+			name:        "already injected",
+			namespace:   "default",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName, annotationStatusKey: injected},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			retriever := &delayedCfgMapRetriever{
+				dummyCfgMapRetriever: dummyCfgMapRetriever{namespace: "default", name: configName, data: map[string]string{"config.yaml": integrationConfig}},
+				// Make the cache give up right away on the missing config map.
+				noWait: true,
+			}
+			sidecarCfg := defaultSidecarConfig()
+			sidecarCfg.ImagePolicy.AllowedRepositories = []string{"newrelic/*"}
+			whsvr := &Webhook{
+				ClusterName: clusterName,
+				Server:      &http.Server{},
+				Mutators: []podMutator{
+					newSidecarMutatorFromConfig(clusterName, sidecarCfg, K8sClients{
+						ConfigMaps: &retriever.dummyCfgMapRetriever,
+						Secrets:    forbiddenSecretRetriever{},
+					}),
+				},
+				IgnoreNamespaces: []string{metav1.NamespaceSystem},
+				ConfigMapCache:   retriever,
+				Events:           recorder,
+				Owners: &dummyOwnerRetriever{controllers: map[string]*metav1.OwnerReference{
+					c.namespace + "/ReplicaSet/": {APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+				}},
+			}
+
+			server := httptest.NewServer(whsvr)
+			defer server.Close()
+
+			reason := strings.TrimPrefix(c.expectedStatus, skippedStatusPrefix)
+			skipped := testutil.ToFloat64(sidecarSkipsTotal.WithLabelValues(reason))
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(makeV1TestData(t, c.namespace, c.annotations)))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var gotReview admissionv1.AdmissionReview
+			gotBody, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+			require.Len(t, gotReview.Response.Warnings, 1)
+
+			if c.expectedStatus == "" {
+				assert.Empty(t, gotReview.Response.Patch)
+				assert.Empty(t, recorder.Events)
+				return
+			}
+
+			var patches []PatchOperation
+			require.NoError(t, json.Unmarshal(gotReview.Response.Patch, &patches))
+			require.Len(t, patches, 1)
+			assert.Equal(t, "/metadata/annotations/newrelic.com~1integrations-sidecar-injector-status", patches[0].Path)
+			assert.Equal(t, c.expectedStatus, patches[0].Value)
+			assert.Equal(t, skipped+1, testutil.ToFloat64(sidecarSkipsTotal.WithLabelValues(reason)))
+
+			require.Len(t, recorder.Events, c.expectedEvents)
+			event := <-recorder.Events
+			assert.Contains(t, event, corev1.EventTypeWarning+" "+eventReasonSidecarSkipped)
+		})
+	}
+}
+
+func TestWorkloadOf(t *testing.T) {
+	owners := &dummyOwnerRetriever{controllers: map[string]*metav1.OwnerReference{
+		"default/ReplicaSet/web-6f9c8d7b4": {APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+	}}
+	controller := true
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default"}}
+	assert.Nil(t, workloadOf(pod, owners))
+
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "web-6f9c8d7b4", Controller: &controller}}
+	assert.Equal(t, &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Namespace: "default", Name: "web"}, workloadOf(pod, owners))
+	assert.Equal(t, "ReplicaSet", workloadOf(pod, nil).Kind)
+
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", Controller: &controller}}
+	assert.Equal(t, &corev1.ObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Namespace: "default", Name: "db"}, workloadOf(pod, owners))
+}
+
+// forbiddenSecretRetriever answers like the api server when the webhook is not allowed to read the secrets.
+type forbiddenSecretRetriever struct{}
+
+func (forbiddenSecretRetriever) Secret(namespace, name string) (*corev1.Secret, error) {
+	return nil, k8s_errors.NewForbidden(schema.GroupResource{Resource: "secrets"}, name, errors.New("no role"))
+}
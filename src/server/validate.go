@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// validatedKinds are the workloads whose pod template is checked on /validate.
+var validatedKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+}
+
+// ValidateHandler returns the handler of the /validate endpoint, which checks the New Relic annotations of the pod
+// template of Deployments, StatefulSets and DaemonSets when they are applied, so mistakes show up before their pods are
+// created. The problems are reported as warnings or deny the workload, depending on the validation mode of its
+// namespace.
+func (whsvr *Webhook) ValidateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := resultError
+		defer func() { validationRequestsTotal.WithLabelValues(result).Inc() }()
+
+		admissionResponse := whsvr.serveReview(w, r, whsvr.validate)
+		if admissionResponse == nil {
+			return
+		}
+
+		switch {
+		case !admissionResponse.Allowed:
+			result = resultDenied
+		case len(admissionResponse.Warnings) > 0:
+			result = resultWarned
+		default:
+			result = resultAllowed
+		}
+	})
+}
+
+// podTemplateWorkload holds the fields shared by the validated workloads.
+type podTemplateWorkload struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              struct {
+		Template corev1.PodTemplateSpec `json:"template"`
+	} `json:"spec"`
+}
+
+// validate checks the pod template of the workload contained in the request. When an error is returned, the int is
+// the HTTP status code that should be sent back to the API server.
+func (whsvr *Webhook) validate(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, int, error) {
+	admissionResponse := &admissionv1.AdmissionResponse{Allowed: true}
+	if req.Operation == admissionv1.Delete || !validatedKinds[req.Kind.Kind] {
+		return admissionResponse, http.StatusOK, nil
+	}
+
+	var workload podTemplateWorkload
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		whsvr.Logger.Errorw("could not unmarshal raw object", "err", err, "object", string(req.Object.Raw))
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to unmarshal %s: %q %q", req.Kind.Kind, req.Object.Raw, err.Error())
+	}
+	namespace := workload.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: *workload.Spec.Template.ObjectMeta.DeepCopy(),
+		Spec:       workload.Spec.Template.Spec,
+	}
+	pod.Namespace = namespace
+
+	whsvr.RLock()
+	mutators := whsvr.Mutators
+	ignoreNamespaces := whsvr.IgnoreNamespaces
+	validation := whsvr.Validation
+	whsvr.RUnlock()
+
+	// The config map of the sidecar can be applied along with the workload, and not be in the cache yet. Dry-run
+	// requests do not wait for it, as it is not going to be created either.
+	var waitForConfigMap func(*ConfigMapNotFoundErr) bool
+	if whsvr.ConfigMapCache != nil && (req.DryRun == nil || !*req.DryRun) {
+		deadline := retryDeadline(ctx)
+		waitForConfigMap = func(err *ConfigMapNotFoundErr) bool { return whsvr.waitForConfigMap(err, deadline) }
+	}
+	problems, warnings := templateProblems(pod, mutators, ignoreNamespaces, waitForConfigMap)
+	if len(problems) == 0 {
+		admissionResponse.Warnings = warnings
+		return admissionResponse, http.StatusOK, nil
+	}
+
+	mode := validation.ModeFor(namespace)
+	whsvr.Logger.Infow("invalid New Relic annotations", "kind", req.Kind.Kind, "namespace", namespace,
+		"name", workload.Name, "mode", mode, "problems", problems)
+	if mode == ValidationEnforce {
+		admissionResponse.Allowed = false
+		admissionResponse.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: fmt.Sprintf("invalid New Relic annotations: %s", strings.Join(problems, "; ")),
+		}
+		return admissionResponse, http.StatusOK, nil
+	}
+	admissionResponse.Warnings = append(problems, warnings...)
+	return admissionResponse, http.StatusOK, nil
+}
+
+// templateProblems returns the problems of the New Relic annotations of the pod template, as the mutators would find
+// them when the pods are created, and the warnings the sidecar would be injected with. Only the problems deny the
+// workload in enforce mode: the warnings describe how the sidecar is adapted to the pod, e.g. renamed volumes, or why
+// it is not injected by the configuration of the webhook, which are not mistakes of the workload. Missing config maps
+// are waited for with waitForConfigMap, when not nil, before being reported.
+func templateProblems(pod *corev1.Pod, mutators []podMutator, ignoreNamespaces []string, waitForConfigMap func(*ConfigMapNotFoundErr) bool) ([]string, []string) {
+	var problems []string
+	annotations := pod.GetAnnotations()
+
+	if value, ok := annotations[annotationInjectMetadata]; ok {
+		if _, err := strconv.ParseBool(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s must be true or false, got '%s'", annotationInjectMetadata, value))
+		}
+	}
+	selected := selectedContainers(pod)
+	for _, c := range pod.Spec.Containers {
+		delete(selected, c.Name)
+	}
+	var unknown []string
+	for name := range selected {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		problems = append(problems, fmt.Sprintf("%s: container %s not found in the pod template", annotationInjectMetadataContainers, name))
+	}
+
+	if !sidecarRequested(pod) {
+		return problems, nil
+	}
+	if !mutationRequired(ignoreNamespaces, &pod.ObjectMeta) {
+		return problems, []string{fmt.Sprintf("the integrations sidecar is not injected in namespace '%s'", pod.Namespace)}
+	}
+	var sm *SidecarMutator
+	for _, m := range mutators {
+		if s, ok := m.(*SidecarMutator); ok {
+			sm = s
+		}
+	}
+	if sm == nil {
+		return problems, []string{"the integrations sidecar injection is disabled"}
+	}
+
+	_, _, warnings, err := sm.createSidecar(pod)
+	waited := map[string]bool{}
+	for {
+		cmErr, ok := err.(*ConfigMapNotFoundErr)
+		if !ok || waitForConfigMap == nil || waited[cmErr.ConfigMapName()] || !waitForConfigMap(cmErr) {
+			break
+		}
+		// Every config map of the pod is waited for once.
+		waited[cmErr.ConfigMapName()] = true
+		_, _, warnings, err = sm.createSidecar(pod)
+	}
+	if fErr, ok := err.(*SecretForbiddenErr); ok {
+		// Not a mistake of the workload, but of the permissions of the webhook.
+		return problems, []string{secretForbiddenMessage(fErr)}
+	}
+	switch sErr := err.(type) {
+	case nil:
+	case *ConfigMapNotFoundErr:
+		problems = append(problems, fmt.Sprintf("config map '%s' not found in namespace '%s'", sErr.ConfigMapName(), sErr.Namespace()))
+	case *SecretNotFoundErr:
+		problems = append(problems, fmt.Sprintf("secret '%s' not found in namespace '%s'", sErr.SecretName(), sErr.Namespace()))
+	case *ImageNotAllowedErr:
+		problems = append(problems, sErr.Error())
+	case *IntegrationConfigInvalidErr:
+		for _, problem := range sErr.Problems() {
+			problems = append(problems, fmt.Sprintf("invalid integration config %s: %s", sErr.source, problem))
+		}
+	default:
+		problems = append(problems, err.Error())
+	}
+	if err != nil {
+		return problems, nil
+	}
+
+	// The sidecar is injected anyway when the values of its annotations or its integration configs are not valid, with
+	// a warning, but these are mistakes of the workload.
+	sidecarProblems := sm.annotationProblems(pod)
+	isProblem := map[string]bool{}
+	for _, problem := range sidecarProblems {
+		isProblem[problem] = true
+	}
+	problems = append(problems, sidecarProblems...)
+	var infos []string
+	for _, warning := range warnings {
+		if !isProblem[warning] {
+			infos = append(infos, warning)
+		}
+	}
+	return problems, infos
+}
+
+// annotationProblems returns the warnings of the sidecar caused by invalid values of its annotations, unknown target
+// containers or invalid integration configs.
+func (sm *SidecarMutator) annotationProblems(pod *corev1.Pod) []string {
+	var problems []string
+	if containerDef, _, err := sm.baseSidecar(pod); err == nil {
+		_, resourceProblems := sidecarResources(pod, containerDef.Resources)
+		problems = append(problems, resourceProblems...)
+		_, securityContextProblems := sidecarSecurityContext(pod, containerDef.SecurityContext)
+		problems = append(problems, securityContextProblems...)
+	}
+	_, targetProblems := targetContainers(pod)
+	problems = append(problems, targetProblems...)
+
+	sources, _, err := sm.integrationConfigs(pod)
+	if err != nil {
+		return problems
+	}
+	for _, source := range sources {
+		for _, problem := range validateIntegrationConfig(source.data, sm.binaryPrefixes) {
+			problems = append(problems, fmt.Sprintf("invalid integration config %s: %s", source.name, problem))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+func TestValidateHandler(t *testing.T) {
+	cases := []struct {
+		desc         string
+		kind         string
+		namespace    string
+		annotations  map[string]string
+		spec         *corev1.PodSpec
+		wantAllowed  bool
+		wantWarnings []string
+		wantMessage  string
+	}{
+		{
+			desc:        "no annotations",
+			kind:        "Deployment",
+			namespace:   "default",
+			wantAllowed: true,
+		},
+		{
+			desc:        "valid annotations",
+			kind:        "StatefulSet",
+			namespace:   "default",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName, annotationInjectMetadata: "true"},
+			wantAllowed: true,
+		},
+		{
+			desc:        "missing config map",
+			kind:        "DaemonSet",
+			namespace:   "default",
+			annotations: map[string]string{annotationIntegrationConfigKey: "missing"},
+			wantAllowed: true,
+			wantWarnings: []string{
+				"config map 'missing' not found in namespace 'default'",
+			},
+		},
+		{
+			desc:      "invalid annotations",
+			kind:      "Deployment",
+			namespace: "default",
+			annotations: map[string]string{
+				annotationIntegrationConfigKey:     configName,
+				annotationInjectMetadata:           "yes",
+				annotationInjectMetadataContainers: "app,db",
+				annotationTargetContainer:          "db",
+			},
+			wantAllowed: true,
+			wantWarnings: []string{
+				"newrelic.com/inject-metadata must be true or false, got 'yes'",
+				"newrelic.com/inject-metadata-containers: container db not found in the pod template",
+				"target container db not found in the pod",
+				"no target container found, using app",
+			},
+		},
+		{
+			desc:        "ignored namespace",
+			kind:        "Deployment",
+			namespace:   "kube-system",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName},
+			wantAllowed: true,
+			wantWarnings: []string{
+				"the integrations sidecar is not injected in namespace 'kube-system'",
+			},
+		},
+		{
+			desc:        "ignored enforced namespace",
+			kind:        "Deployment",
+			namespace:   "kube-public",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName},
+			wantAllowed: true,
+			wantWarnings: []string{
+				"the integrations sidecar is not injected in namespace 'kube-public'",
+			},
+		},
+		{
+			desc:        "enforced namespace",
+			kind:        "Deployment",
+			namespace:   "production",
+			annotations: map[string]string{annotationIntegrationConfigKey: "missing"},
+			wantAllowed: false,
+			wantMessage: "invalid New Relic annotations: config map 'missing' not found in namespace 'production'",
+		},
+		{
+			desc:        "enforced namespace with sidecar warnings",
+			kind:        "Deployment",
+			namespace:   "production",
+			annotations: map[string]string{annotationIntegrationConfigKey: configName},
+			spec: &corev1.PodSpec{
+				Containers: []corev1.Container{{
+					Name:         "newrelic-sidecar",
+					Image:        "nginx",
+					VolumeMounts: []corev1.VolumeMount{{Name: "tmpfs-tmp", MountPath: "/tmp"}},
+				}},
+				Volumes: []corev1.Volume{{Name: "tmpfs-tmp"}},
+			},
+			wantAllowed: true,
+			wantWarnings: []string{
+				"container newrelic-sidecar already exists in the pod, the sidecar is named nri-newrelic-sidecar",
+				"volume tmpfs-tmp is not shared, the sidecar mounts nri-tmpfs-tmp at /tmp",
+			},
+		},
+		{
+			desc:      "enforced namespace with invalid sidecar annotations",
+			kind:      "Deployment",
+			namespace: "production",
+			annotations: map[string]string{
+				annotationIntegrationConfigKey: configName,
+				annotationMemoryLimit:          "lots",
+			},
+			wantAllowed: false,
+			wantMessage: "invalid New Relic annotations: invalid quantity 'lots' in annotation " + annotationMemoryLimit +
+				", using the default sidecar resources",
+		},
+		{
+			desc:        "forbidden secret",
+			kind:        "Deployment",
+			namespace:   "production",
+			annotations: map[string]string{annotationIntegrationSecretKey: "credentials"},
+			wantAllowed: true,
+			wantWarnings: []string{
+				"secret 'credentials' in namespace 'production' cannot be read by the webhook, bind the newrelic-webhook-secrets-reader role in the namespace",
+			},
+		},
+		{
+			desc:        "other kinds are not validated",
+			kind:        "ReplicaSet",
+			namespace:   "production",
+			annotations: map[string]string{annotationIntegrationConfigKey: "missing"},
+			wantAllowed: true,
+		},
+	}
+
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewEnvVarMutator(clusterName),
+			newSidecarMutatorFromConfig(clusterName, defaultSidecarConfig(), K8sClients{
+				ConfigMaps: configMapsRetriever{configName: {configKey: integrationConfig}},
+				Secrets:    forbiddenSecretRetriever{},
+			}),
+		},
+		IgnoreNamespaces: []string{"kube-system", "kube-public"},
+		Validation: ValidationConfig{
+			Mode:       ValidationWarn,
+			Namespaces: map[string]ValidationMode{"production": ValidationEnforce, "kube-public": ValidationEnforce},
+		},
+	}
+	server := httptest.NewServer(whsvr.ValidateHandler())
+	defer server.Close()
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			spec := corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}}
+			if c.spec != nil {
+				spec = *c.spec
+			}
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(makeWorkloadReview(t, c.kind, c.namespace, c.annotations, spec)))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var gotReview admissionv1.AdmissionReview
+			gotBody, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+			require.NotNil(t, gotReview.Response)
+			assert.Equal(t, types.UID("1"), gotReview.Response.UID)
+			assert.Equal(t, c.wantAllowed, gotReview.Response.Allowed)
+			assert.Equal(t, c.wantWarnings, gotReview.Response.Warnings)
+			assert.Empty(t, gotReview.Response.Patch)
+			if c.wantMessage != "" {
+				require.NotNil(t, gotReview.Response.Result)
+				assert.Equal(t, c.wantMessage, gotReview.Response.Result.Message)
+			}
+		})
+	}
+}
+
+func TestValidateWaitsForConfigMap(t *testing.T) {
+	retriever := &delayedCfgMapRetriever{
+		dummyCfgMapRetriever: dummyCfgMapRetriever{namespace: "production", name: configName, data: map[string]string{configKey: integrationConfig}},
+	}
+	whsvr := &Webhook{
+		ClusterName:    clusterName,
+		Server:         &http.Server{},
+		Mutators:       []podMutator{NewSidecarMutator(clusterName, retriever)},
+		ConfigMapCache: retriever,
+		Validation:     ValidationConfig{Mode: ValidationEnforce},
+	}
+
+	review := makeWorkloadReview(t, "Deployment", "production", map[string]string{annotationIntegrationConfigKey: configName},
+		corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx"}}})
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(review))
+	req.Header.Set("Content-Type", "application/json")
+	whsvr.ValidateHandler().ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	var gotReview admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &gotReview))
+	require.NotNil(t, gotReview.Response)
+	assert.True(t, gotReview.Response.Allowed, "config map applied along with the workload denied")
+	assert.Empty(t, gotReview.Response.Warnings)
+	assert.Equal(t, 1, retriever.waits)
+}
+
+func TestValidationModeFor(t *testing.T) {
+	assert.Equal(t, ValidationWarn, ValidationConfig{}.ModeFor("default"))
+	v := ValidationConfig{Mode: ValidationEnforce, Namespaces: map[string]ValidationMode{"dev": ValidationWarn}}
+	assert.Equal(t, ValidationEnforce, v.ModeFor("default"))
+	assert.Equal(t, ValidationWarn, v.ModeFor("dev"))
+}
+
+func makeWorkloadReview(t *testing.T, kind, namespace string, annotations map[string]string, spec corev1.PodSpec) []byte {
+	t.Helper()
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Annotations: annotations},
+		Spec:       spec,
+	}
+	meta := metav1.ObjectMeta{Name: "app", Namespace: namespace}
+	var workload runtime.Object
+	switch kind {
+	case "StatefulSet":
+		workload = &appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: template}}
+	case "DaemonSet":
+		workload = &appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: template}}
+	case "ReplicaSet":
+		workload = &appsv1.ReplicaSet{ObjectMeta: meta, Spec: appsv1.ReplicaSetSpec{Template: template}}
+	default:
+		workload = &appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: template}}
+	}
+	raw, err := json.Marshal(workload)
+	require.NoError(t, err)
+
+	review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("1"),
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: kind},
+			Namespace: namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	require.NoError(t, err)
+	return review
+}
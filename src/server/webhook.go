@@ -3,7 +3,9 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -12,20 +14,28 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 
 	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	k8sversion "k8s.io/apimachinery/pkg/version"
 )
 
 const (
 	maxMutationRetries = 10
 	mutationRetryDelay = 500 * time.Millisecond
+	// mutationRetryTimeout bounds the time spent retrying the mutation of a pod on missing config maps and secrets.
+	mutationRetryTimeout = maxMutationRetries * mutationRetryDelay
+	// responseMargin is the time left to answer the review when the retries stop because the request times out.
+	responseMargin = 500 * time.Millisecond
 )
 
 var (
@@ -45,6 +55,47 @@ type podMutator interface {
 	Mutate(pod *corev1.Pod) ([]PatchOperation, error)
 }
 
+// podUpdateMutator is implemented by the mutators that also take part in the UPDATE reviews of the
+// pods/ephemeralcontainers subresource, which add ephemeral containers to running pods.
+type podUpdateMutator interface {
+	MutateUpdate(oldPod, pod *corev1.Pod) ([]PatchOperation, error)
+}
+
+// warningPodMutator is implemented by the mutators that can explain the settings of the pod they had to ignore. The
+// warnings are returned to the client in the admission response.
+type warningPodMutator interface {
+	MutateWithWarnings(pod *corev1.Pod) ([]PatchOperation, []string, error)
+}
+
+// sideEffectPodMutator is implemented by the mutators that need other objects to exist for their patch to work, e.g. a
+// secret referenced by the sidecar. The side effects are not applied on dry-run requests.
+type sideEffectPodMutator interface {
+	ApplySideEffects(pod *corev1.Pod) []string
+}
+
+// configMapCache is implemented by config map retrievers backed by a local cache, which can notify when a missing
+// config map shows up instead of polling for it.
+type configMapCache interface {
+	HasSynced() bool
+	WaitForConfigMap(namespace, name string, timeout time.Duration) bool
+}
+
+// K8sClients groups the access to the K8s api used by the mutators.
+type K8sClients struct {
+	ConfigMaps configMapRetriever
+	// Owners is optional. Without it, the owners of the pods are guessed from their names.
+	Owners ownerRetriever
+	// Secrets is optional. Without it, the integration configs can only be read from config maps.
+	Secrets secretRetriever
+	// SecretWriter is optional. Without it, the license key secret is not replicated into the namespaces of the pods.
+	SecretWriter secretWriter
+	// Events is optional. It records the Events explaining why the sidecar was not injected.
+	Events eventRecorder
+	// ServerVersion is the version of the apiserver, read once at startup. It is optional. Without it, the sidecar is
+	// injected into the pods of Jobs as a native sidecar only when jobSidecar is set to native.
+	ServerVersion *k8sversion.Info
+}
+
 // Webhook is a webhook server that can accept requests from the Apiserver
 type Webhook struct {
 	sync.RWMutex
@@ -57,6 +108,17 @@ type Webhook struct {
 	CertWatcher      *fsnotify.Watcher
 	Mutators         []podMutator
 	IgnoreNamespaces []string
+	ConfigMapCache   configMapCache
+	// Events and Owners are used to report the skipped sidecar injections on the workload owning the pod.
+	Events eventRecorder
+	Owners ownerRetriever
+	// Validation configures how the problems found on /validate are reported.
+	Validation ValidationConfig
+
+	// draining is set when the webhook is shutting down, so it is taken out of the endpoints of its service.
+	draining bool
+	// serveErr is the error the server stopped with, which makes the liveness probe fail.
+	serveErr error
 }
 
 // GetCert returns the certificate that should be used by the server in the TLS handshake.
@@ -66,10 +128,79 @@ func (whsvr *Webhook) GetCert(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return whsvr.Cert, nil
 }
 
+// SetCert replaces the certificate used by the server. The certificate is parsed into its Leaf if it was not yet, so its
+// expiry can be checked by the readiness probe and exposed as a metric.
+func (whsvr *Webhook) SetCert(pair *tls.Certificate) error {
+	if pair.Leaf == nil && len(pair.Certificate) > 0 {
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return errors.Wrap(err, "error parsing certificate")
+		}
+		pair.Leaf = leaf
+	}
+	if pair.Leaf != nil {
+		certExpiryTimestampSeconds.Set(float64(pair.Leaf.NotAfter.Unix()))
+	}
+
+	whsvr.Lock()
+	defer whsvr.Unlock()
+	whsvr.Cert = pair
+	return nil
+}
+
+// CheckCertRenewal returns whether the serving certificate expires within renewBefore, i.e. it should have been
+// rotated already. It is exposed as the cert_renewal_due metric and logged, so it can be noticed before the certificate
+// expires and the readiness probe fails.
+func (whsvr *Webhook) CheckCertRenewal(renewBefore time.Duration) bool {
+	whsvr.RLock()
+	var leaf *x509.Certificate
+	if whsvr.Cert != nil {
+		leaf = whsvr.Cert.Leaf
+	}
+	whsvr.RUnlock()
+
+	if leaf == nil || time.Until(leaf.NotAfter) >= renewBefore {
+		certRenewalDue.Set(0)
+		return false
+	}
+	certRenewalDue.Set(1)
+	whsvr.Logger.Warnw("serving certificate expires within its renewal window and was not rotated",
+		"notAfter", leaf.NotAfter, "renewBefore", renewBefore)
+	return true
+}
+
+// ApplyConfig replaces the mutators and settings of the webhook with the ones described by the configuration.
+// Requests that are being served when the configuration is applied finish with the previous configuration.
+func (whsvr *Webhook) ApplyConfig(cfg *Config, clients K8sClients) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	var mutators []podMutator
+	if cfg.EnvVarMutator.Enabled {
+		mutators = append(mutators, newEnvVarMutatorFromConfig(cfg.ClusterName, cfg.EnvVarMutator, clients.Owners))
+	}
+	if cfg.SidecarMutator.Enabled {
+		mutators = append(mutators, newSidecarMutatorFromConfig(cfg.ClusterName, cfg.SidecarMutator, clients))
+	}
+
+	whsvr.Lock()
+	defer whsvr.Unlock()
+	whsvr.ClusterName = cfg.ClusterName
+	whsvr.IgnoreNamespaces = append([]string{}, cfg.IgnoreNamespaces...)
+	whsvr.Mutators = mutators
+	whsvr.Events = clients.Events
+	whsvr.Owners = clients.Owners
+	whsvr.Validation = cfg.Validation
+	return nil
+}
+
 func init() {
 	_ = corev1.AddToScheme(runtimeScheme)
+	_ = admissionv1.AddToScheme(runtimeScheme)
+	_ = v1beta1.AddToScheme(runtimeScheme)
+	_ = admissionregistrationv1.AddToScheme(runtimeScheme)
 	_ = admissionregistrationv1beta1.AddToScheme(runtimeScheme)
-	_ = corev1.AddToScheme(runtimeScheme)
 }
 
 // Check whether the target resoured need to be mutated
@@ -92,6 +223,25 @@ func errorCode(err error) int {
 
 // Serve method for webhook server
 func (whsvr *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := resultError
+	defer func() { admissionRequestsTotal.WithLabelValues(result).Inc() }()
+
+	admissionResponse := whsvr.serveReview(w, r, whsvr.admit)
+	if admissionResponse == nil {
+		return
+	}
+
+	result = resultSkipped
+	if !admissionResponse.Allowed {
+		result = resultDenied
+	} else if len(admissionResponse.Patch) > 0 {
+		result = resultMutated
+	}
+}
+
+// serveReview decodes the AdmissionReview of the request, answers it with the response returned by admit, in the same
+// version, and returns that response. It returns nil when the review could not be answered.
+func (whsvr *Webhook) serveReview(w http.ResponseWriter, r *http.Request, admit func(context.Context, *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, int, error)) *admissionv1.AdmissionResponse {
 	var body []byte
 
 	if whsvr.Logger == nil {
@@ -106,7 +256,7 @@ func (whsvr *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(body) == 0 {
 		whsvr.Logger.Error("empty body")
 		http.Error(w, "empty body", http.StatusBadRequest)
-		return
+		return nil
 	}
 
 	// verify the content type is accurate
@@ -114,34 +264,85 @@ func (whsvr *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if contentType != "application/json" {
 		whsvr.Logger.Errorw("invalid content type", "expected", "application/json", "context type", contentType)
 		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
+		return nil
 	}
 
-	admissionReviewResponse := v1beta1.AdmissionReview{
-		Response: &v1beta1.AdmissionResponse{
-			Allowed: true, // Always allow the creation of the pod since this webhook does not act as Validating Webhook.
-		},
-	}
-
-	admissionReviewRequest := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &admissionReviewRequest); err != nil {
+	// Reviews without apiVersion/kind are decoded as v1beta1, which is what older API servers send.
+	obj, _, err := deserializer.Decode(body, nil, &v1beta1.AdmissionReview{})
+	if err != nil {
 		whsvr.Logger.Errorw("can't decode body", "err", err, "body", body)
 		http.Error(w, fmt.Sprintf("could not decode request body: %q", err.Error()), http.StatusBadRequest)
-		return
+		return nil
 	}
 
-	if len(admissionReviewRequest.Request.Object.Raw) == 0 {
+	var req *admissionv1.AdmissionRequest
+	switch review := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		req = review.Request
+	case *v1beta1.AdmissionReview:
+		req = v1beta1RequestToV1(review.Request)
+	default:
+		whsvr.Logger.Errorw("unsupported admission review version", "gvk", obj.GetObjectKind().GroupVersionKind())
+		http.Error(w, fmt.Sprintf("unsupported admission review version: %q", obj.GetObjectKind().GroupVersionKind()), http.StatusBadRequest)
+		return nil
+	}
+
+	if req == nil || len(req.Object.Raw) == 0 {
 		whsvr.Logger.Errorw("object not present in request body", "body", body)
 		http.Error(w, fmt.Sprintf("object not present in request body: %q", body), http.StatusBadRequest)
-		return
+		return nil
+	}
+
+	admissionResponse, code, err := admit(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), code)
+		return nil
+	}
+	admissionResponse.UID = req.UID
+
+	var admissionReviewResponse interface{}
+	if _, ok := obj.(*admissionv1.AdmissionReview); ok {
+		// admission.k8s.io/v1 requires the response to echo the apiVersion and kind of the request.
+		admissionReviewResponse = admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: admissionv1.SchemeGroupVersion.String(),
+				Kind:       "AdmissionReview",
+			},
+			Response: admissionResponse,
+		}
+	} else {
+		admissionReviewResponse = v1beta1.AdmissionReview{
+			Response: v1ResponseToV1beta1(admissionResponse),
+		}
+	}
+
+	resp, err := json.Marshal(admissionReviewResponse)
+	if err != nil {
+		whsvr.Logger.Errorw("can't decode response", "err", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return nil
+	}
+	whsvr.Logger.Info("writing response")
+	if _, err := w.Write(resp); err != nil {
+		whsvr.Logger.Errorw("can't write response", "err", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+		return nil
+	}
+	return admissionResponse
+}
+
+// admit runs the mutators over the pod contained in the request. When an error is returned, the int is the HTTP status
+// code that should be sent back to the API server. The mutation is retried on missing config maps and secrets until the
+// retry deadline of the request context.
+func (whsvr *Webhook) admit(ctx context.Context, req *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, int, error) {
+	admissionResponse := &admissionv1.AdmissionResponse{
+		Allowed: true, // Only pods with an invalid integration config are denied, in strict validation mode.
 	}
 
-	req := admissionReviewRequest.Request
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		whsvr.Logger.Errorw("could not unmarshal raw object", "err", err, "object", string(req.Object.Raw))
-		http.Error(w, fmt.Sprintf("failed to unmarshal pod: %q %q", body, err.Error()), http.StatusBadRequest)
-		return
+		return nil, http.StatusBadRequest, fmt.Errorf("failed to unmarshal pod: %q %q", req.Object.Raw, err.Error())
 	}
 	// workaround for empty namespace on the pod level
 	if pod.Namespace == "" {
@@ -149,61 +350,235 @@ func (whsvr *Webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	whsvr.Logger.Infow("received admission review", "kind", req.Kind, "namespace", req.Namespace, "name",
-		req.Name, "pod", pod.Name, "UID", req.UID, "operation", req.Operation, "userinfo", req.UserInfo)
+		req.Name, "pod", pod.Name, "UID", req.UID, "operation", req.Operation, "subresource", req.SubResource,
+		"userinfo", req.UserInfo)
+
+	var oldPod *corev1.Pod
+	if req.Operation == admissionv1.Update {
+		if req.SubResource != "ephemeralcontainers" {
+			whsvr.Logger.Infow("skipped mutation", "namespace", pod.Namespace, "pod", pod.Name, "reason", "unsupported update")
+			return admissionResponse, http.StatusOK, nil
+		}
+		oldPod = &corev1.Pod{}
+		if err := json.Unmarshal(req.OldObject.Raw, oldPod); err != nil {
+			whsvr.Logger.Errorw("could not unmarshal raw old object", "err", err, "object", string(req.OldObject.Raw))
+			return nil, http.StatusBadRequest, fmt.Errorf("failed to unmarshal old pod: %q %q", req.OldObject.Raw, err.Error())
+		}
+	}
+
+	// Take the configuration at the beginning of the review, so a reload does not affect the ongoing request.
+	whsvr.RLock()
+	mutators, ignoreNamespaces := whsvr.Mutators, whsvr.IgnoreNamespaces
+	events, owners := whsvr.Events, whsvr.Owners
+	whsvr.RUnlock()
+
+	// Dry-run requests must not wait for config maps to show up. Retrying would only delay the answer, since the pod
+	// is not going to be created anyway. They must not record Events either.
+	dryRun := req.DryRun != nil && *req.DryRun
+
+	var patches []PatchOperation
 
 	// determine whether to perform mutation
-	if !mutationRequired(whsvr.IgnoreNamespaces, &pod.ObjectMeta) {
+	if !mutationRequired(ignoreNamespaces, &pod.ObjectMeta) {
 		whsvr.Logger.Infow("skipped mutation", "namespace", pod.Namespace, "pod", pod.Name, "reason", "policy check (special namespaces)")
-	} else {
-		var patches []PatchOperation
-		retries := 0
-		for _, m := range whsvr.Mutators {
-		retryMutate:
-			p, err := m.Mutate(&pod)
-			if err != nil {
-				if retries <= maxMutationRetries {
-					if cErr, ok := err.(*ConfigMapNotFoundErr); ok {
-						retries++
-						whsvr.Logger.Warnw("config map not found during mutation, retrying", "configmap", cErr.ConfigMapName())
-						time.Sleep(mutationRetryDelay)
+		if oldPod == nil && sidecarRequested(&pod) {
+			p, warning := whsvr.skipSidecar(&pod, sidecarSkip{
+				reason:  skipReasonNamespaceIgnored,
+				message: fmt.Sprintf("namespace '%s' is ignored by the webhook", pod.Namespace),
+			}, dryRun, events, owners)
+			admissionResponse.Warnings = append(admissionResponse.Warnings, warning)
+			return whsvr.patchResponse(admissionResponse, p)
+		}
+		return admissionResponse, http.StatusOK, nil
+	}
+
+	retries := 0
+	deadline := retryDeadline(ctx)
+	for _, m := range mutators {
+		name := mutatorName(m)
+		um, isUpdateMutator := m.(podUpdateMutator)
+		if oldPod != nil && !isUpdateMutator {
+			continue
+		}
+	retryMutate:
+		start := time.Now()
+		var p []PatchOperation
+		var err error
+		var w []string
+		if oldPod != nil {
+			p, err = um.MutateUpdate(oldPod, &pod)
+		} else if wm, ok := m.(warningPodMutator); ok {
+			p, w, err = wm.MutateWithWarnings(&pod)
+		} else {
+			p, err = m.Mutate(&pod)
+		}
+		mutatorDurationSeconds.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		if err != nil {
+			if retries <= maxMutationRetries && !dryRun && time.Now().Before(deadline) {
+				switch nfErr := err.(type) {
+				case *ConfigMapNotFoundErr:
+					retries++
+					configMapRetriesTotal.Inc()
+					whsvr.Logger.Warnw("config map not found during mutation, retrying", "configmap", nfErr.ConfigMapName())
+					if whsvr.waitForConfigMap(nfErr, deadline) {
 						goto retryMutate
 					}
+				case *SecretNotFoundErr:
+					// Secrets are not cached, so just give it some time to be created along with the pod.
+					retries++
+					whsvr.Logger.Warnw("secret not found during mutation, retrying", "secret", nfErr.SecretName())
+					sleepUntil(mutationRetryDelay, deadline)
+					goto retryMutate
+				}
+			}
+			var skip *sidecarSkip
+			switch nfErr := err.(type) {
+			case *ConfigMapNotFoundErr:
+				skip = &sidecarSkip{
+					reason:  skipReasonConfigMapNotFound,
+					message: fmt.Sprintf("config map '%s' not found in namespace '%s'", nfErr.ConfigMapName(), nfErr.Namespace()),
+				}
+			case *SecretNotFoundErr:
+				skip = &sidecarSkip{
+					reason:  skipReasonSecretNotFound,
+					message: fmt.Sprintf("secret '%s' not found in namespace '%s'", nfErr.SecretName(), nfErr.Namespace()),
+				}
+			case *SecretForbiddenErr:
+				skip = &sidecarSkip{
+					reason:  skipReasonSecretForbidden,
+					message: secretForbiddenMessage(nfErr),
+				}
+			case *ImageNotAllowedErr:
+				skip = &sidecarSkip{
+					reason:  skipReasonImageNotAllowed,
+					message: nfErr.Error(),
 				}
-				whsvr.Logger.Errorw("error during mutation", "err", err)
-				http.Error(w, fmt.Sprintf("error during mutation: %q", err.Error()), errorCode(err))
-				return
 			}
-			patches = append(patches, p...)
+			if skip != nil {
+				p, warning := whsvr.skipSidecar(&pod, *skip, dryRun, events, owners)
+				patches = append(patches, p...)
+				admissionResponse.Warnings = append(admissionResponse.Warnings, warning)
+				continue
+			}
+			if invalidErr, ok := err.(*IntegrationConfigInvalidErr); ok {
+				whsvr.Logger.Infow("denied pod with invalid integration config", "namespace", pod.Namespace, "pod", pod.Name, "err", err)
+				admissionResponse.Allowed = false
+				admissionResponse.Result = &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Reason:  metav1.StatusReasonInvalid,
+					Code:    http.StatusUnprocessableEntity,
+					Message: invalidErr.Error(),
+				}
+				return admissionResponse, http.StatusOK, nil
+			}
+			whsvr.Logger.Errorw("error during mutation", "err", err)
+			return nil, errorCode(err), fmt.Errorf("error during mutation: %q", err.Error())
+		}
+		patchOperationsTotal.WithLabelValues(name).Add(float64(len(p)))
+		patches = append(patches, p...)
+		admissionResponse.Warnings = append(admissionResponse.Warnings, w...)
+		if sm, ok := m.(sideEffectPodMutator); ok && len(p) > 0 && !dryRun {
+			admissionResponse.Warnings = append(admissionResponse.Warnings, sm.ApplySideEffects(&pod)...)
 		}
+	}
 
-		if len(patches) > 0 {
-			patchBytes, err := json.Marshal(patches)
-			if err != nil {
-				whsvr.Logger.Errorw("error marshaling patch", "err", err)
-				http.Error(w, fmt.Sprintf("error marshaling patch: %q", err.Error()), http.StatusInternalServerError)
-				return
-			}
-			admissionReviewResponse.Response.Patch = patchBytes
-			admissionReviewResponse.Response.PatchType = func() *v1beta1.PatchType {
-				pt := v1beta1.PatchTypeJSONPatch // Only PatchTypeJSONPatch is allowed by now.
-				return &pt
-			}()
+	return whsvr.patchResponse(admissionResponse, patches)
+}
+
+// secretForbiddenMessage explains that the webhook is not allowed to read the secret of the pod.
+func secretForbiddenMessage(err *SecretForbiddenErr) string {
+	return fmt.Sprintf("secret '%s' in namespace '%s' cannot be read by the webhook, bind the "+
+		"newrelic-webhook-secrets-reader role in the namespace", err.SecretName(), err.Namespace())
+}
+
+// patchResponse sets the patches in the admission response.
+func (whsvr *Webhook) patchResponse(admissionResponse *admissionv1.AdmissionResponse, patches []PatchOperation) (*admissionv1.AdmissionResponse, int, error) {
+	if len(patches) > 0 {
+		patchBytes, err := json.Marshal(patches)
+		if err != nil {
+			whsvr.Logger.Errorw("error marshaling patch", "err", err)
+			return nil, http.StatusInternalServerError, fmt.Errorf("error marshaling patch: %q", err.Error())
 		}
+		admissionResponse.Patch = patchBytes
+		admissionResponse.PatchType = func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch // Only PatchTypeJSONPatch is allowed by now.
+			return &pt
+		}()
+	}
+	return admissionResponse, http.StatusOK, nil
+}
+
+// waitForConfigMap waits until the missing config map could be available, at most until the deadline, and returns
+// whether the mutation should be retried. Without a cache, it just sleeps before the next retry.
+func (whsvr *Webhook) waitForConfigMap(err *ConfigMapNotFoundErr, deadline time.Time) bool {
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return false
 	}
-	if admissionReviewRequest.Request != nil {
-		admissionReviewResponse.Response.UID = admissionReviewRequest.Request.UID
+	if whsvr.ConfigMapCache == nil {
+		sleepUntil(mutationRetryDelay, deadline)
+		return true
 	}
+	return whsvr.ConfigMapCache.WaitForConfigMap(err.Namespace(), err.ConfigMapName(), remaining)
+}
 
-	resp, err := json.Marshal(admissionReviewResponse)
-	if err != nil {
-		whsvr.Logger.Errorw("can't decode response", "err", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-		return
+// retryDeadline returns when the retries of a review stop: after mutationRetryTimeout, or earlier when the request
+// times out before, so the review is still answered.
+func retryDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(mutationRetryTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Add(-responseMargin).Before(deadline) {
+		deadline = ctxDeadline.Add(-responseMargin)
 	}
-	whsvr.Logger.Info("writing response")
-	if _, err := w.Write(resp); err != nil {
-		whsvr.Logger.Errorw("can't write response", "err", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
-		return
+	return deadline
+}
+
+// sleepUntil sleeps for the given delay, but not past the deadline.
+func sleepUntil(delay time.Duration, deadline time.Time) {
+	if remaining := time.Until(deadline); remaining < delay {
+		delay = remaining
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// v1beta1RequestToV1 converts a v1beta1 admission request into its v1 counterpart. Both versions share the same schema.
+func v1beta1RequestToV1(req *v1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if req == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                req.UID,
+		Kind:               req.Kind,
+		Resource:           req.Resource,
+		SubResource:        req.SubResource,
+		RequestKind:        req.RequestKind,
+		RequestResource:    req.RequestResource,
+		RequestSubResource: req.RequestSubResource,
+		Name:               req.Name,
+		Namespace:          req.Namespace,
+		Operation:          admissionv1.Operation(req.Operation),
+		UserInfo:           req.UserInfo,
+		Object:             req.Object,
+		OldObject:          req.OldObject,
+		DryRun:             req.DryRun,
+		Options:            req.Options,
+	}
+}
+
+// v1ResponseToV1beta1 converts a v1 admission response into its v1beta1 counterpart. Both versions share the same schema.
+func v1ResponseToV1beta1(resp *admissionv1.AdmissionResponse) *v1beta1.AdmissionResponse {
+	out := &v1beta1.AdmissionResponse{
+		UID:              resp.UID,
+		Allowed:          resp.Allowed,
+		Result:           resp.Result,
+		Patch:            resp.Patch,
+		AuditAnnotations: resp.AuditAnnotations,
+		Warnings:         resp.Warnings,
+	}
+	if resp.PatchType != nil {
+		pt := v1beta1.PatchType(*resp.PatchType)
+		out.PatchType = &pt
 	}
+	return out
 }
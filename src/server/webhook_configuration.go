@@ -0,0 +1,162 @@
+package server
+
+import (
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultWebhookConfigName = "newrelic-webhook-cfg"
+	webhookName              = "webhook.newrelic.com"
+	defaultServiceName       = "newrelic-webhook-svc"
+	defaultMutatePath        = "/mutate"
+
+	defaultValidatingWebhookConfigName = "newrelic-webhook-validation-cfg"
+	validatingWebhookName              = "validation.webhook.newrelic.com"
+	defaultValidatePath                = "/validate"
+)
+
+// WebhookConfigOptions are the settings of the generated MutatingWebhookConfiguration.
+type WebhookConfigOptions struct {
+	Name             string
+	ServiceName      string
+	ServiceNamespace string
+	Path             string
+	CABundle         []byte
+	// FailurePolicy defaults to Ignore, so pods can still be created when the webhook is down.
+	FailurePolicy admissionregistrationv1.FailurePolicyType
+	// NamespaceSelector restricts the webhook to the namespaces matching it. All namespaces are selected when nil.
+	NamespaceSelector *metav1.LabelSelector
+	// EphemeralContainers registers the webhook for the pods/ephemeralcontainers subresource. It has to be set when
+	// envVarMutator.ephemeralContainers is enabled in the configuration file.
+	EphemeralContainers bool
+}
+
+// NewMutatingWebhookConfiguration returns the MutatingWebhookConfiguration registering the webhook in the K8s api.
+// The only side effect of the webhook are the Events explaining why a sidecar was not injected, which are not recorded
+// for dry-run requests, so it is also called for them.
+func NewMutatingWebhookConfiguration(opts WebhookConfigOptions) *admissionregistrationv1.MutatingWebhookConfiguration {
+	if opts.Name == "" {
+		opts.Name = defaultWebhookConfigName
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = defaultServiceName
+	}
+	if opts.ServiceNamespace == "" {
+		opts.ServiceNamespace = metav1.NamespaceDefault
+	}
+	if opts.Path == "" {
+		opts.Path = defaultMutatePath
+	}
+	if opts.FailurePolicy == "" {
+		opts.FailurePolicy = admissionregistrationv1.Ignore
+	}
+
+	rules := []admissionregistrationv1.RuleWithOperations{
+		podsRule(admissionregistrationv1.Create, "pods"),
+	}
+	if opts.EphemeralContainers {
+		rules = append(rules, podsRule(admissionregistrationv1.Update, "pods/ephemeralcontainers"))
+	}
+
+	sideEffects := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   opts.Name,
+			Labels: map[string]string{"app": "newrelic-webhook"},
+		},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{
+				Name: webhookName,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Name:      opts.ServiceName,
+						Namespace: opts.ServiceNamespace,
+						Path:      &opts.Path,
+					},
+					CABundle: opts.CABundle,
+				},
+				Rules:                   rules,
+				NamespaceSelector:       opts.NamespaceSelector,
+				FailurePolicy:           &opts.FailurePolicy,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+}
+
+// NewValidatingWebhookConfiguration returns the ValidatingWebhookConfiguration registering the validation of the New
+// Relic annotations of Deployments, StatefulSets and DaemonSets. Name and Path default to the ones of the validation
+// webhook, and EphemeralContainers is ignored.
+func NewValidatingWebhookConfiguration(opts WebhookConfigOptions) *admissionregistrationv1.ValidatingWebhookConfiguration {
+	if opts.Name == "" {
+		opts.Name = defaultValidatingWebhookConfigName
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = defaultServiceName
+	}
+	if opts.ServiceNamespace == "" {
+		opts.ServiceNamespace = metav1.NamespaceDefault
+	}
+	if opts.Path == "" {
+		opts.Path = defaultValidatePath
+	}
+	if opts.FailurePolicy == "" {
+		opts.FailurePolicy = admissionregistrationv1.Ignore
+	}
+
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "ValidatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   opts.Name,
+			Labels: map[string]string{"app": "newrelic-webhook"},
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{
+			{
+				Name: validatingWebhookName,
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{
+					Service: &admissionregistrationv1.ServiceReference{
+						Name:      opts.ServiceName,
+						Namespace: opts.ServiceNamespace,
+						Path:      &opts.Path,
+					},
+					CABundle: opts.CABundle,
+				},
+				Rules: []admissionregistrationv1.RuleWithOperations{
+					{
+						Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+						Rule: admissionregistrationv1.Rule{
+							APIGroups:   []string{"apps"},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"deployments", "statefulsets", "daemonsets"},
+						},
+					},
+				},
+				NamespaceSelector:       opts.NamespaceSelector,
+				FailurePolicy:           &opts.FailurePolicy,
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1", "v1beta1"},
+			},
+		},
+	}
+}
+
+func podsRule(op admissionregistrationv1.OperationType, resource string) admissionregistrationv1.RuleWithOperations {
+	return admissionregistrationv1.RuleWithOperations{
+		Operations: []admissionregistrationv1.OperationType{op},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{resource},
+		},
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestNewMutatingWebhookConfiguration(t *testing.T) {
+	cfg := NewMutatingWebhookConfiguration(WebhookConfigOptions{
+		ServiceNamespace: "newrelic",
+		CABundle:         []byte("ca"),
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{"newrelic-webhook": "enabled"},
+		},
+		EphemeralContainers: true,
+	})
+
+	expected, err := ioutil.ReadFile(path.Join("testdata", "expectedMutatingWebhookConfiguration.yaml"))
+	require.NoError(t, err)
+	got, err := yaml.Marshal(cfg)
+	require.NoError(t, err)
+	assert.YAMLEq(t, string(expected), string(got))
+}
+
+func TestNewMutatingWebhookConfigurationDefaults(t *testing.T) {
+	cfg := NewMutatingWebhookConfiguration(WebhookConfigOptions{})
+
+	require.Len(t, cfg.Webhooks, 1)
+	wh := cfg.Webhooks[0]
+	assert.Equal(t, "newrelic-webhook-cfg", cfg.Name)
+	assert.Equal(t, "newrelic-webhook-svc", wh.ClientConfig.Service.Name)
+	assert.Equal(t, "default", wh.ClientConfig.Service.Namespace)
+	assert.Equal(t, "/mutate", *wh.ClientConfig.Service.Path)
+	assert.Equal(t, admissionregistrationv1.Ignore, *wh.FailurePolicy)
+	assert.Equal(t, admissionregistrationv1.SideEffectClassNoneOnDryRun, *wh.SideEffects)
+	assert.Equal(t, []string{"v1", "v1beta1"}, wh.AdmissionReviewVersions)
+	require.Len(t, wh.Rules, 1)
+	assert.Equal(t, []string{"pods"}, wh.Rules[0].Resources)
+}
+
+func TestNewValidatingWebhookConfiguration(t *testing.T) {
+	cfg := NewValidatingWebhookConfiguration(WebhookConfigOptions{
+		ServiceNamespace: "newrelic",
+		CABundle:         []byte("ca"),
+		FailurePolicy:    admissionregistrationv1.Fail,
+	})
+
+	require.Len(t, cfg.Webhooks, 1)
+	wh := cfg.Webhooks[0]
+	assert.Equal(t, "newrelic-webhook-validation-cfg", cfg.Name)
+	assert.Equal(t, "validation.webhook.newrelic.com", wh.Name)
+	assert.Equal(t, "newrelic", wh.ClientConfig.Service.Namespace)
+	assert.Equal(t, "/validate", *wh.ClientConfig.Service.Path)
+	assert.Equal(t, []byte("ca"), wh.ClientConfig.CABundle)
+	assert.Equal(t, admissionregistrationv1.Fail, *wh.FailurePolicy)
+	assert.Equal(t, admissionregistrationv1.SideEffectClassNone, *wh.SideEffects)
+	require.Len(t, wh.Rules, 1)
+	assert.Equal(t, []string{"apps"}, wh.Rules[0].APIGroups)
+	assert.Equal(t, []string{"deployments", "statefulsets", "daemonsets"}, wh.Rules[0].Resources)
+	assert.Equal(t, []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update}, wh.Rules[0].Operations)
+}
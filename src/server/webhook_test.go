@@ -8,12 +8,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kinbiko/jsonassert"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	k8s_errors "k8s.io/apimachinery/pkg/api/errors"
@@ -22,6 +25,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -52,6 +56,7 @@ func loadTestData(t *testing.T, name string) []byte {
 func TestServeHTTP(t *testing.T) {
 	expectedEnvVarsPatchForValidBody := loadTestData(t, "expectedEnvVarsAdmissionReviewPatch.json")
 	expectedSidecarPatchForValidBody := loadTestData(t, "expectedSidecarAdmissionReviewPatch.json")
+	expectedSkippedSidecarPatchForValidBody := loadTestData(t, "expectedSkippedSidecarAdmissionReviewPatch.json")
 	missingObjectRequestBody := bytes.Replace(makeTestData(t, "default", map[string]string{}), []byte("\"object\""), []byte("\"foo\""), -1)
 
 	patchTypeForValidBody := v1beta1.PatchTypeJSONPatch
@@ -70,7 +75,7 @@ func TestServeHTTP(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedAdmissionReview: v1beta1.AdmissionReview{
 				Response: &v1beta1.AdmissionResponse{
-					UID:       types.UID(1),
+					UID:       types.UID("1"),
 					Allowed:   true,
 					Result:    nil,
 					Patch:     expectedEnvVarsPatchForValidBody,
@@ -85,7 +90,7 @@ func TestServeHTTP(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedAdmissionReview: v1beta1.AdmissionReview{
 				Response: &v1beta1.AdmissionResponse{
-					UID:       types.UID(1),
+					UID:       types.UID("1"),
 					Allowed:   true,
 					Result:    nil,
 					Patch:     nil,
@@ -127,7 +132,7 @@ func TestServeHTTP(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedAdmissionReview: v1beta1.AdmissionReview{
 				Response: &v1beta1.AdmissionResponse{
-					UID:       types.UID(1),
+					UID:       types.UID("1"),
 					Allowed:   true,
 					Result:    nil,
 					Patch:     expectedSidecarPatchForValidBody,
@@ -136,11 +141,19 @@ func TestServeHTTP(t *testing.T) {
 			},
 		},
 		{
-			name:                      "sidecar mutation - wrong config map name",
-			requestBody:               makeTestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": "wrong"}),
-			contentType:               "application/json",
-			expectedStatusCode:        http.StatusBadRequest,
-			expectedBodyWhenHTTPError: fmt.Sprintf("error during mutation: \"%s\"\n", ConfigMapNotFoundErr{}.Error()),
+			name:               "sidecar mutation skipped - wrong config map name",
+			requestBody:        makeTestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": "wrong"}),
+			contentType:        "application/json",
+			expectedStatusCode: http.StatusOK,
+			expectedAdmissionReview: v1beta1.AdmissionReview{
+				Response: &v1beta1.AdmissionResponse{
+					UID:       types.UID("1"),
+					Allowed:   true,
+					Result:    nil,
+					Patch:     expectedSkippedSidecarPatchForValidBody,
+					PatchType: &patchTypeForValidBody,
+				},
+			},
 		},
 	}
 
@@ -180,6 +193,339 @@ func TestServeHTTP(t *testing.T) {
 
 }
 
+func TestServeHTTPAdmissionReviewVersions(t *testing.T) {
+	expectedEnvVarsPatchForValidBody := loadTestData(t, "expectedEnvVarsAdmissionReviewPatch.json")
+	expectedSidecarPatchForValidBody := loadTestData(t, "expectedSidecarAdmissionReviewPatch.json")
+
+	cases := []struct {
+		name             string
+		requestBody      []byte
+		expectedResponse []byte
+		expectedPatch    []byte
+	}{
+		{
+			name:             "v1beta1 - mutation not applied",
+			requestBody:      makeTestData(t, "kube-system", nil),
+			expectedResponse: loadTestData(t, "expectedAdmissionReviewV1beta1Response.json"),
+		},
+		{
+			name:             "v1 - mutation not applied",
+			requestBody:      makeV1TestData(t, "kube-system", nil),
+			expectedResponse: loadTestData(t, "expectedAdmissionReviewV1Response.json"),
+		},
+		{
+			name:          "v1 - mutation applied",
+			requestBody:   makeV1TestData(t, "default", nil),
+			expectedPatch: expectedEnvVarsPatchForValidBody,
+		},
+		{
+			name:          "v1 - sidecar mutation applied",
+			requestBody:   makeV1TestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": configName}),
+			expectedPatch: expectedSidecarPatchForValidBody,
+		},
+	}
+
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewEnvVarMutator(clusterName),
+			NewSidecarMutator(clusterName, makeConfigMapRetriever("default", configName, map[string]string{"config.yaml": integrationConfig})),
+		},
+		IgnoreNamespaces: []string{metav1.NamespaceSystem, metav1.NamespacePublic},
+	}
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	ja := jsonassert.New(t)
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("[%d] %s", i, c.name), func(t *testing.T) {
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(c.requestBody))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			gotBody, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			if c.expectedResponse != nil {
+				ja.Assertf(string(gotBody), string(c.expectedResponse))
+			}
+			if c.expectedPatch != nil {
+				var gotReview admissionv1.AdmissionReview
+				require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+				assert.Equal(t, "admission.k8s.io/v1", gotReview.APIVersion)
+				assert.Equal(t, "AdmissionReview", gotReview.Kind)
+				ja.Assertf(string(gotReview.Response.Patch), string(c.expectedPatch))
+			}
+		})
+	}
+}
+
+func TestServeHTTPWaitsForConfigMapCache(t *testing.T) {
+	expectedSidecarPatchForValidBody := loadTestData(t, "expectedSidecarAdmissionReviewPatch.json")
+
+	retriever := &delayedCfgMapRetriever{
+		dummyCfgMapRetriever: dummyCfgMapRetriever{namespace: "default", name: configName, data: map[string]string{"config.yaml": integrationConfig}},
+	}
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewEnvVarMutator(clusterName),
+			NewSidecarMutator(clusterName, retriever),
+		},
+		ConfigMapCache: retriever,
+	}
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Post(server.URL, "application/json",
+		bytes.NewReader(makeTestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": configName})))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, time.Since(start) < mutationRetryDelay, "mutation should not sleep when a cache is available")
+	assert.Equal(t, 1, retriever.waits)
+
+	gotBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var gotReview v1beta1.AdmissionReview
+	require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+	jsonassert.New(t).Assertf(string(gotReview.Response.Patch), string(expectedSidecarPatchForValidBody))
+}
+
+func TestServeHTTPRetryDeadline(t *testing.T) {
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		// The config map never shows up without a cache, so the mutation is retried until the deadline.
+		Mutators: []podMutator{NewSidecarMutator(clusterName, alwaysMissingCfgMapRetriever{})},
+	}
+
+	server := httptest.NewServer(http.TimeoutHandler(whsvr, 2*time.Second, "server timeout"))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Post(server.URL, "application/json",
+		bytes.NewReader(makeV1TestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": configName})))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "review not answered before the request timed out")
+	elapsed := time.Since(start)
+	assert.True(t, elapsed < 2*time.Second, "retries took %s", elapsed)
+	assert.True(t, elapsed >= 2*time.Second-responseMargin-mutationRetryDelay, "retries stopped after %s", elapsed)
+
+	gotBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var gotReview admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+	require.NotNil(t, gotReview.Response)
+	assert.Equal(t, []string{"integrations sidecar not injected: config map '" + configName + "' not found in namespace 'default'"}, gotReview.Response.Warnings)
+}
+
+func TestServeHTTPDryRun(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	retriever := &delayedCfgMapRetriever{
+		dummyCfgMapRetriever: dummyCfgMapRetriever{namespace: "default", name: configName, data: map[string]string{"config.yaml": integrationConfig}},
+	}
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewSidecarMutator(clusterName, retriever),
+		},
+		ConfigMapCache: retriever,
+		Events:         recorder,
+	}
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	var review admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(makeV1TestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": configName}), &review))
+	dryRun := true
+	review.Request.DryRun = &dryRun
+	body, err := json.Marshal(review)
+	require.NoError(t, err)
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 0, retriever.waits, "dry-run requests should not wait for the config map")
+	assert.Empty(t, recorder.Events, "dry-run requests should not record events")
+
+	var gotReview admissionv1.AdmissionReview
+	gotBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+	assert.Len(t, gotReview.Response.Warnings, 1)
+}
+
+func TestServeHTTPDeterministicPatch(t *testing.T) {
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewEnvVarMutator(clusterName),
+			NewSidecarMutator(clusterName, makeConfigMapRetriever("default", configName, map[string]string{
+				"config.yaml": integrationConfig,
+				"extra-a":     "a",
+				"extra-b":     "b",
+				"extra-c":     "c",
+			})),
+		},
+	}
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	var first []byte
+	for i := 0; i < 10; i++ {
+		resp, err := http.Post(server.URL, "application/json",
+			bytes.NewReader(makeV1TestData(t, "default", map[string]string{"newrelic.com/integrations-sidecar-configmap": configName})))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var gotReview admissionv1.AdmissionReview
+		gotBody, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+		if first == nil {
+			first = gotReview.Response.Patch
+			continue
+		}
+		assert.Equal(t, string(first), string(gotReview.Response.Patch))
+	}
+}
+
+func TestServeHTTPWarnings(t *testing.T) {
+	whsvr := &Webhook{
+		ClusterName: clusterName,
+		Server:      &http.Server{},
+		Mutators: []podMutator{
+			NewSidecarMutator(clusterName, makeConfigMapRetriever("default", configName, map[string]string{"config.yaml": integrationConfig})),
+		},
+	}
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(makeV1TestData(t, "default", map[string]string{
+		"newrelic.com/integrations-sidecar-configmap":   configName,
+		"newrelic.com/integrations-sidecar-cpu-request": "lots",
+	})))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var gotReview admissionv1.AdmissionReview
+	gotBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+	assert.NotEmpty(t, gotReview.Response.Patch)
+	require.Len(t, gotReview.Response.Warnings, 1)
+	assert.Contains(t, gotReview.Response.Warnings[0], "newrelic.com/integrations-sidecar-cpu-request")
+}
+
+func TestServeHTTPStrictValidation(t *testing.T) {
+	invalidConfig := map[string]string{"config.yaml": "instances:\n  - name: nginx-server-metrics"}
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict %v", strict), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ClusterName = clusterName
+			cfg.EnvVarMutator.Enabled = false
+			cfg.SidecarMutator.StrictValidation = strict
+			whsvr := &Webhook{Server: &http.Server{}}
+			require.NoError(t, whsvr.ApplyConfig(cfg, K8sClients{ConfigMaps: makeConfigMapRetriever("default", configName, invalidConfig)}))
+
+			server := httptest.NewServer(whsvr)
+			defer server.Close()
+
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(makeV1TestData(t, "default", map[string]string{
+				"newrelic.com/integrations-sidecar-configmap": configName,
+			})))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var gotReview admissionv1.AdmissionReview
+			gotBody, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+			if strict {
+				assert.False(t, gotReview.Response.Allowed)
+				assert.Empty(t, gotReview.Response.Patch)
+				require.NotNil(t, gotReview.Response.Result)
+				assert.Equal(t, int32(http.StatusUnprocessableEntity), gotReview.Response.Result.Code)
+				assert.Contains(t, gotReview.Response.Result.Message, "integration_name is required")
+				return
+			}
+			assert.True(t, gotReview.Response.Allowed)
+			assert.NotEmpty(t, gotReview.Response.Patch)
+			assert.Equal(t, []string{
+				"invalid integration config my-config: config.yaml: integration_name is required",
+				"invalid integration config my-config: config.yaml: instances[0].command is required",
+			}, gotReview.Response.Warnings)
+		})
+	}
+}
+
+func TestServeHTTPUpdate(t *testing.T) {
+	oldPod := makeTestPod(t, "default", nil)
+	var pod corev1.Pod
+	require.NoError(t, json.Unmarshal(oldPod, &pod))
+	pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger"}}}
+	newPod, err := json.Marshal(&pod)
+	require.NoError(t, err)
+
+	cfg := DefaultConfig()
+	cfg.ClusterName = clusterName
+	cfg.EnvVarMutator.EphemeralContainers = true
+	whsvr := &Webhook{Server: &http.Server{}}
+	require.NoError(t, whsvr.ApplyConfig(cfg, K8sClients{ConfigMaps: makeConfigMapRetriever("default", configName, nil)}))
+
+	server := httptest.NewServer(whsvr)
+	defer server.Close()
+
+	for _, subResource := range []string{"", "ephemeralcontainers"} {
+		t.Run(fmt.Sprintf("subresource %q", subResource), func(t *testing.T) {
+			review := admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:         types.UID("1"),
+					Operation:   admissionv1.Update,
+					SubResource: subResource,
+					Object:      runtime.RawExtension{Raw: newPod},
+					OldObject:   runtime.RawExtension{Raw: oldPod},
+				},
+			}
+			body, err := json.Marshal(review)
+			require.NoError(t, err)
+
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(body))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var gotReview admissionv1.AdmissionReview
+			gotBody, err := ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(gotBody, &gotReview))
+
+			var patches []PatchOperation
+			if len(gotReview.Response.Patch) > 0 {
+				require.NoError(t, json.Unmarshal(gotReview.Response.Patch, &patches))
+			}
+			if subResource == "" {
+				assert.Empty(t, patches, "only updates of the ephemeral containers are mutated")
+				return
+			}
+			require.NotEmpty(t, patches)
+			for _, p := range patches {
+				assert.True(t, strings.HasPrefix(p.Path, "/spec/ephemeralContainers/0/env"), p.Path)
+			}
+		})
+	}
+}
+
 func TestServeHTTPIgnoreNamespaces(t *testing.T) {
 	expectedEnvVarsPatchForValidBody := loadTestData(t, "expectedEnvVarsAdmissionReviewPatch.json")
 
@@ -199,7 +545,7 @@ func TestServeHTTPIgnoreNamespaces(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedAdmissionReview: v1beta1.AdmissionReview{
 				Response: &v1beta1.AdmissionResponse{
-					UID:       types.UID(1),
+					UID:       types.UID("1"),
 					Allowed:   true,
 					Result:    nil,
 					Patch:     expectedEnvVarsPatchForValidBody,
@@ -214,7 +560,7 @@ func TestServeHTTPIgnoreNamespaces(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedAdmissionReview: v1beta1.AdmissionReview{
 				Response: &v1beta1.AdmissionResponse{
-					UID:       types.UID(1),
+					UID:       types.UID("1"),
 					Allowed:   true,
 					Result:    nil,
 					Patch:     expectedEnvVarsPatchForValidBody,
@@ -229,7 +575,7 @@ func TestServeHTTPIgnoreNamespaces(t *testing.T) {
 			expectedStatusCode: http.StatusOK,
 			expectedAdmissionReview: v1beta1.AdmissionReview{
 				Response: &v1beta1.AdmissionResponse{
-					UID:       types.UID(1),
+					UID:       types.UID("1"),
 					Allowed:   true,
 					Result:    nil,
 					Patch:     nil,
@@ -323,6 +669,50 @@ func Benchmark_SidecarWebhookPerformance(b *testing.B) {
 func makeTestData(t testing.TB, namespace string, annotations map[string]string) []byte {
 	t.Helper()
 
+	review := v1beta1.AdmissionReview{
+		Request: &v1beta1.AdmissionRequest{
+			Kind: metav1.GroupVersionKind{},
+			Object: runtime.RawExtension{
+				Raw: makeTestPod(t, namespace, annotations),
+			},
+			Operation: v1beta1.Create,
+			UID:       types.UID("1"),
+		},
+	}
+	reviewJSON, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("Failed to create AdmissionReview: %v", err)
+	}
+	return reviewJSON
+}
+
+func makeV1TestData(t testing.TB, namespace string, annotations map[string]string) []byte {
+	t.Helper()
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Request: &admissionv1.AdmissionRequest{
+			Kind: metav1.GroupVersionKind{},
+			Object: runtime.RawExtension{
+				Raw: makeTestPod(t, namespace, annotations),
+			},
+			Operation: admissionv1.Create,
+			UID:       types.UID("1"),
+		},
+	}
+	reviewJSON, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("Failed to create AdmissionReview: %v", err)
+	}
+	return reviewJSON
+}
+
+func makeTestPod(t testing.TB, namespace string, annotations map[string]string) []byte {
+	t.Helper()
+
 	pod := corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:            "test-123-123",
@@ -343,22 +733,7 @@ func makeTestData(t testing.TB, namespace string, annotations map[string]string)
 	if err != nil {
 		t.Fatalf("Could not create test pod: %v", err)
 	}
-
-	review := v1beta1.AdmissionReview{
-		Request: &v1beta1.AdmissionRequest{
-			Kind: metav1.GroupVersionKind{},
-			Object: runtime.RawExtension{
-				Raw: raw,
-			},
-			Operation: v1beta1.Create,
-			UID:       types.UID(1),
-		},
-	}
-	reviewJSON, err := json.Marshal(review)
-	if err != nil {
-		t.Fatalf("Failed to create AdmissionReview: %v", err)
-	}
-	return reviewJSON
+	return raw
 }
 
 type dummyCfgMapRetriever struct {
@@ -380,6 +755,39 @@ func (dcr *dummyCfgMapRetriever) ConfigMap(namespace, name string) (*corev1.Conf
 	return nil, k8s_errors.NewNotFound(schema.GroupResource{}, name)
 }
 
+// delayedCfgMapRetriever behaves like a config map cache where the config map only shows up after it has been waited for.
+type delayedCfgMapRetriever struct {
+	dummyCfgMapRetriever
+	waits  int
+	noWait bool
+}
+
+func (dcr *delayedCfgMapRetriever) ConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
+	if dcr.waits == 0 {
+		return nil, k8s_errors.NewNotFound(schema.GroupResource{}, name)
+	}
+	return dcr.dummyCfgMapRetriever.ConfigMap(namespace, name)
+}
+
+func (dcr *delayedCfgMapRetriever) HasSynced() bool {
+	return true
+}
+
+func (dcr *delayedCfgMapRetriever) WaitForConfigMap(namespace, name string, timeout time.Duration) bool {
+	if dcr.noWait {
+		return false
+	}
+	dcr.waits++
+	return true
+}
+
+// alwaysMissingCfgMapRetriever never finds the config maps.
+type alwaysMissingCfgMapRetriever struct{}
+
+func (alwaysMissingCfgMapRetriever) ConfigMap(namespace, name string) (*corev1.ConfigMap, error) {
+	return nil, k8s_errors.NewNotFound(schema.GroupResource{}, name)
+}
+
 func makeConfigMapRetriever(namespace, name string, data map[string]string) configMapRetriever {
 	return &dummyCfgMapRetriever{
 		namespace: namespace,